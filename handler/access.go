@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Formats of the access log. Empty follows the logging.format of the engine
+const (
+	accessLogJSON    = "json"
+	accessLogConsole = "console"
+)
+
+// languageKey stores the language of an execution in the request context, for the access log
+const languageKey = "hpw.language"
+
+// AccessLog logs a line per request once it's answered, with its status, latency and client, and the language and
+// outcome of executions
+func AccessLog(next web.HandlerFunc) web.HandlerFunc {
+	return func(c web.Context) error {
+		if !config.AccessLog {
+			return next(c)
+		}
+		start := time.Now()
+		ac := &accessContext{Context: c}
+		err := next(ac)
+
+		req := c.Request()
+		status := ac.status
+		switch {
+		case err != nil:
+			status = http.StatusInternalServerError
+		case status == 0 && strings.EqualFold(req.Header.Get("Upgrade"), "websocket"):
+			status = http.StatusSwitchingProtocols
+		}
+
+		event := accessLogger().Info().
+			Str("method", req.Method).
+			Str("path", req.URL.Path).
+			Int("status", status).
+			Int64("latency_ms", time.Since(start).Milliseconds()).
+			Str("client_ip", clientIP(req))
+		if id := c.Response().Header().Get(requestIDHeader); id != "" {
+			event = event.Str("request_id", id)
+		}
+		if language, ok := c.Get(languageKey).(string); ok && language != "" {
+			if lang, found := findLanguage(language); found {
+				language = lang.ID
+			}
+			event = event.Str("language", language)
+			if ac.body != nil {
+				event = event.Str("outcome", executionOutcome(ac.status, ac.body))
+			}
+		}
+		event.Msg("request")
+		return err
+	}
+}
+
+// accessLogger returns the logger of the access log in the configured format
+func accessLogger() *zerolog.Logger {
+	var out io.Writer
+	switch config.AccessLogFormat {
+	case accessLogJSON:
+		out = os.Stdout
+	case accessLogConsole:
+		out = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	default:
+		return &log.Logger
+	}
+	logger := zerolog.New(out).With().Timestamp().Logger()
+	return &logger
+}
+
+// accessContext remembers the status of the response and, when it's JSON, its body, for the access log
+type accessContext struct {
+	web.Context
+	status int
+	body   any
+}
+
+func (c *accessContext) JSON(code int, data any) error {
+	c.status, c.body = code, data
+	return c.Context.JSON(code, data)
+}
+
+func (c *accessContext) String(code int, s string) error {
+	c.status = code
+	return c.Context.String(code, s)
+}
+
+func (c *accessContext) NoContent(code int) error {
+	c.status = code
+	return c.Context.NoContent(code)
+}
+
+func (c *accessContext) Error(code int, err error) {
+	c.status = code
+	c.Context.Error(code, err)
+}
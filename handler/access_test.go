@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// accessEntry is a line of the access log
+type accessEntry struct {
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+	LatencyMs *int64 `json:"latency_ms"`
+	ClientIP  string `json:"client_ip"`
+	RequestID string `json:"request_id"`
+	Language  string `json:"language"`
+	Outcome   string `json:"outcome"`
+}
+
+// accessLog runs the request through AccessLog and returns the line it logged
+func accessLog(t *testing.T, r *http.Request, next web.HandlerFunc) accessEntry {
+	t.Helper()
+	buf := withLogger(t, zerolog.InfoLevel)
+	c, _ := newTestContext(r)
+	_ = AccessLog(next)(c)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %q, want a single line", lines)
+	}
+	var entry accessEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("%v: %s", err, lines[0])
+	}
+	return entry
+}
+
+func TestAccessLog(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AccessLog = true })
+	withFakeEngine(t, func(*input.Job) *tork.Job {
+		return tracedJob()
+	})
+
+	r := newJSONRequest("/execute", strings.NewReader(`{"language":"cpp","code":"int main() {}"}`))
+	r.RemoteAddr = "192.0.2.1:1234"
+	entry := accessLog(t, r, Handler)
+	if entry.Level != "info" || entry.Message != "request" || entry.Method != http.MethodPost || entry.Path != "/execute" ||
+		entry.Status != http.StatusOK || entry.LatencyMs == nil || entry.ClientIP != "192.0.2.1" || entry.RequestID == "" {
+		t.Errorf("access log = %+v", entry)
+	}
+	// The language is logged by its ID, whatever alias the request used
+	if entry.Language != "c++" || entry.Outcome != outcomeSuccess {
+		t.Errorf("language and outcome = %q %q, want c++ %s", entry.Language, entry.Outcome, outcomeSuccess)
+	}
+
+	entry = accessLog(t, httptest.NewRequest(http.MethodGet, "/health", nil), func(c web.Context) error {
+		return errors.New("broken")
+	})
+	if entry.Status != http.StatusInternalServerError || entry.Language != "" || entry.Outcome != "" {
+		t.Errorf("access log of a failed request = %+v", entry)
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AccessLog = false })
+	buf := withLogger(t, zerolog.InfoLevel)
+	c, _ := newTestContext(httptest.NewRequest(http.MethodGet, "/health", nil))
+	if err := AccessLog(func(c web.Context) error { return c.NoContent(http.StatusOK) })(c); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged %s", buf)
+	}
+}
@@ -0,0 +1,315 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// BatchRequest runs the same code against several inputs, e.g. the test cases of an assignment
+type BatchRequest struct {
+	ExecRequest
+	// Each input is fed verbatim to the program's standard input, like the stdin field
+	Inputs []string `json:"inputs"`
+	// CompileOnce compiles the code once and runs the program against every input in the same task, without tracing
+	// it. The runs share the timeout
+	CompileOnce bool `json:"compile_once"`
+}
+
+// batchResult is the response to the execution of one of the inputs
+type batchResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	Result any `json:"result"`
+}
+
+// Batch runs the code once per input, concurrently, and responds with the results in the order of the inputs
+func Batch(c web.Context) error {
+	start := time.Now()
+	logger := requestLogger(c)
+	br := BatchRequest{}
+
+	if apiErr := bindJSON(c, &br); apiErr != nil {
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+	c.Set(languageKey, br.Language)
+
+	if len(br.Inputs) == 0 {
+		return respondError(c, http.StatusBadRequest, CodeEmptyInputs, "there are no inputs")
+	}
+	if len(br.Inputs) > config.MaxBatchInputs {
+		return respondError(c, http.StatusBadRequest, CodeTooManyInputs,
+			fmt.Sprintf("there are more than %d inputs", config.MaxBatchInputs))
+	}
+	for i, in := range br.Inputs {
+		br.Inputs[i] = normalizeNewlines(in)
+		if inputTooLarge(br.Inputs[i]) {
+			apiErr := inputTooLargeError()
+			return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+		}
+	}
+
+	if apiErr := checkRequest(logger, &br.ExecRequest); apiErr != nil {
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+
+	if br.CompileOnce {
+		return batchRuns(c, logger, br, start)
+	}
+
+	// Every input gets its own request, so the task and cache key are the same as if it was executed alone
+	requests := make([]ExecRequest, len(br.Inputs))
+	tasks := make([]input.Task, len(br.Inputs))
+	for i, in := range br.Inputs {
+		er := br.ExecRequest
+		er.Input = ""
+		er.Stdin = in
+		task, err := buildTask(c.Request().Context(), er, config)
+		if err != nil {
+			apiErr := taskError(logger, err)
+			return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+		}
+		requests[i] = er
+		tasks[i] = task
+	}
+
+	type indexedResult struct {
+		index int
+		res   jobResult
+	}
+	// Buffered, so the goroutines forwarding the results never block when the handler already returned
+	done := make(chan indexedResult, len(tasks))
+
+	out := make([]batchResult, len(tasks))
+	// Each input is an execution, so it takes its own slot until its result arrives or the batch ends
+	releases := make([]func(), 0, len(tasks))
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	pending := 0
+	for i, task := range tasks {
+		out[i].Index = i
+		key := cacheKey(requests[i])
+		if status, body, ok := results.get(key); ok {
+			observeExecution(requests[i].Language, start, status, body)
+			out[i].Status, out[i].Result = status, body
+			continue
+		}
+
+		release, ok := acquireExecution(requests[i].Language)
+		if !ok {
+			apiErr := serverBusyError()
+			out[i].Status, out[i].Result = apiErr.Status, newErrorBody(apiErr.Status, apiErr.Code, apiErr.Message)
+			continue
+		}
+		releases = append(releases, release)
+
+		result := make(chan jobResult, 1)
+		job := &input.Job{
+			Name:  "code execution",
+			Tasks: []input.Task{task},
+		}
+		if _, err := submitJob(c.Request().Context(), job, newJobListener(result)); err != nil {
+			release()
+			logger.Error().Err(err).Msgf("error submitting the job of input %d", i)
+			apiErr := engineUnavailableError()
+			out[i].Status, out[i].Result = apiErr.Status, newErrorBody(apiErr.Status, apiErr.Code, apiErr.Message)
+			continue
+		}
+		pending++
+		go func(i int) {
+			res := <-result
+			release()
+			done <- indexedResult{index: i, res: res}
+		}(i)
+	}
+
+	// The executions run concurrently, but the whole batch is bounded too
+	deadline := time.After(config.BatchTimeout)
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-done:
+			er := requests[r.index]
+			status, body, err := executionResponse(logger, er, r.res)
+			if err != nil {
+				logger.Error().Err(err).Msgf("error building the result of input %d", r.index)
+				apiErr := unreadableResultError()
+				status, body = apiErr.Status, newErrorBody(apiErr.Status, apiErr.Code, apiErr.Message)
+			}
+			results.put(cacheKey(er), status, body)
+			observeExecution(er.Language, start, status, body)
+			out[r.index].Status, out[r.index].Result = status, body
+
+		case <-deadline:
+			logger.Debug().Msgf("%d executions of the batch didn't finish in time", pending)
+			for i := range out {
+				if out[i].Result == nil {
+					out[i].Status = http.StatusGatewayTimeout
+					out[i].Result = newErrorBody(http.StatusGatewayTimeout, CodeBatchTimeout,
+						"the execution didn't finish before the batch timed out")
+				}
+			}
+			return c.JSON(http.StatusOK, map[string]any{"results": out})
+
+		case <-c.Done():
+			if c.Request().Context().Err() != nil {
+				logger.Debug().Msg("client disconnected before the batch finished")
+				return respondError(c, statusClientClosedRequest, CodeClientDisconnected, "the client went away")
+			}
+			logger.Debug().Msg("server shut down before the batch finished")
+			return respondError(c, http.StatusServiceUnavailable, CodeServerShuttingDown, "the server is shutting down")
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"results": out})
+}
+
+// batchRuns runs a batch with CompileOnce, whose inputs are all run by a single task
+func batchRuns(c web.Context, logger zerolog.Logger, br BatchRequest, start time.Time) error {
+	er := br.ExecRequest
+	er.Input = ""
+	er.inputs = br.Inputs
+	task, err := buildTask(c.Request().Context(), er, config)
+	if err != nil {
+		apiErr := taskError(logger, err)
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+
+	release, ok := acquireExecution(er.Language)
+	if !ok {
+		c.Response().Header().Set("Retry-After", "1")
+		apiErr := serverBusyError()
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+	defer release()
+
+	result := make(chan jobResult, 1)
+	job := &input.Job{
+		Name:  "code execution",
+		Tasks: []input.Task{task},
+	}
+	if _, err := submitJob(c.Request().Context(), job, newJobListener(result)); err != nil {
+		logger.Error().Err(err).Msg("error submitting the job")
+		apiErr := engineUnavailableError()
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+
+	select {
+	case res := <-result:
+		out, status, body, err := runsResults(logger, er, res)
+		if err != nil {
+			logger.Error().Err(err).Msg("error building the results of the batch")
+			apiErr := unreadableResultError()
+			return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+		}
+		if out == nil {
+			observeExecution(er.Language, start, status, body)
+			return c.JSON(status, body)
+		}
+		for _, r := range out {
+			observeExecution(er.Language, start, r.Status, r.Result)
+		}
+		return c.JSON(http.StatusOK, map[string]any{"results": out})
+
+	case <-time.After(config.BatchTimeout):
+		logger.Debug().Msg("the runs of the batch didn't finish in time")
+		return respondError(c, http.StatusGatewayTimeout, CodeBatchTimeout, "the executions didn't finish before the batch timed out")
+
+	case <-c.Done():
+		if c.Request().Context().Err() != nil {
+			logger.Debug().Msg("client disconnected before the batch finished")
+			return respondError(c, statusClientClosedRequest, CodeClientDisconnected, "the client went away")
+		}
+		logger.Debug().Msg("server shut down before the batch finished")
+		return respondError(c, http.StatusServiceUnavailable, CodeServerShuttingDown, "the server is shutting down")
+	}
+}
+
+// runsResults returns the result of each run of a batch with CompileOnce. When the task itself failed, e.g. because
+// the code didn't compile, there are no results, only the status and body of the response, like for a single execution
+func runsResults(logger zerolog.Logger, er ExecRequest, res jobResult) ([]batchResult, int, any, error) {
+	_, metadata := splitMetadata(res.output)
+	if res.failed || res.noExecution || metadata["compile_failed"] != "" {
+		status, body, err := executionResponse(logger, er, res)
+		return nil, status, body, err
+	}
+
+	warnings := parseGccWarnings(er.Code, metadata["warning"])
+	out := make([]batchResult, len(er.inputs))
+	for i := range er.inputs {
+		out[i].Index = i
+		suffix := "." + strconv.Itoa(i)
+		stdout := metadata["stdout"+suffix]
+		stdoutTruncated, stderrTruncated, _ := truncatedOutputs(metadata["truncated"+suffix])
+		if stdoutTruncated {
+			stdout = trimPartialRune(stdout) + truncationMarker
+		}
+		stderr := sanitizeErrorPaths(metadata["stderr"+suffix])
+		if stderrTruncated {
+			stderr = trimPartialRune(stderr) + truncationMarker
+		}
+
+		if timedOut := metadata["timed_out"+suffix]; timedOut != "" {
+			seconds, _ := strconv.Atoi(timedOut)
+			out[i].Status, out[i].Result = http.StatusGatewayTimeout, newTimeoutBody(seconds, stdout, stderr)
+			continue
+		}
+		exitCode, err := strconv.Atoi(metadata["exit_code"+suffix])
+		if err != nil {
+			logger.Error().Msgf("run %d of the batch didn't report its exit code", i)
+			out[i].Status = http.StatusInternalServerError
+			out[i].Result = newErrorBody(http.StatusInternalServerError, CodeNoExecutionResult, "the code couldn't be executed")
+			continue
+		}
+		if exitCode == exitCodeKilled {
+			ret := newOutOfMemoryRet(er.Code)
+			ret.Stdout = stdout
+			ret.Stderr = stderr
+			out[i].Status, out[i].Result = http.StatusBadRequest, ret
+			continue
+		}
+
+		result := map[string]interface{}{
+			"stdout":    stdout,
+			"stderr":    stderr,
+			"exit_code": exitCode,
+			"warnings":  warnings,
+			"phase":     phaseComplete,
+		}
+		if stdoutTruncated || stderrTruncated {
+			result["truncated"] = true
+		}
+		if signal, ok := exitSignal(exitCode); ok {
+			result["exit_signal"] = signal
+		}
+		// Without a trace, only assertions know where the program stopped
+		if assertion, ok := assertionError(metadata["assertion"+suffix]); ok {
+			if strings.HasPrefix(assertion.File, "usercode.") {
+				assertion = assertion.withSnippet(er.Code)
+			}
+			result["error"] = assertion
+			result["errors"] = []ErrorMsg{assertion}
+			result["phase"] = phaseRun
+		} else if crash, ok := crashError(exitCode, nil); ok {
+			result["error"] = crash
+			result["errors"] = []ErrorMsg{crash}
+			result["phase"] = phaseRun
+		}
+		if elapsed, err := strconv.ParseFloat(metadata["elapsed_s"+suffix], 64); err == nil {
+			result["elapsed_ms"] = int(elapsed * 1000)
+		}
+		if maxRSS, err := strconv.Atoi(metadata["max_rss_kb"+suffix]); err == nil {
+			result["max_rss_kb"] = maxRSS
+		}
+		out[i].Status, out[i].Result = http.StatusOK, result
+	}
+	return out, 0, nil, nil
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+func TestBatch(t *testing.T) {
+	// The program prints its input, and loops forever on "loop"
+	fake := withFakeEngine(t, func(job *input.Job) *tork.Job {
+		stdin := job.Tasks[0].Files["programInput.txt"]
+		if stdin == "loop" {
+			return completedJob(metadataPrefix + "timed_out=18\n")
+		}
+		return tracedJob("stdout=" + stdin)
+	})
+
+	status, body := batchRequest(t, `{"language":"c","code":"int main() {}","inputs":["1","loop","3"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("batch = %d %v", status, body)
+	}
+	results, _ := body["results"].([]any)
+	if len(results) != 3 {
+		t.Fatalf("results = %v, want one per input", results)
+	}
+	want := []struct {
+		status float64
+		stdout string
+	}{{http.StatusOK, "1"}, {http.StatusGatewayTimeout, ""}, {http.StatusOK, "3"}}
+	for i, r := range results {
+		r := r.(map[string]any)
+		result, _ := r["result"].(map[string]any)
+		if r["index"] != float64(i) || r["status"] != want[i].status || (want[i].stdout != "" && result["stdout"] != want[i].stdout) {
+			t.Errorf("result %d = %v", i, r)
+		}
+	}
+	if n := len(fake.submitted()); n != 3 {
+		t.Errorf("submitted %d jobs, want one per input", n)
+	}
+}
+
+func TestBatchInputs(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxBatchInputs = 2 })
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job { return completedJob("") })
+	tests := []struct {
+		body string
+		want ErrorCode
+	}{
+		{body: `{"language":"c","code":"int main() {}"}`, want: CodeEmptyInputs},
+		{body: `{"language":"c","code":"int main() {}","inputs":[]}`, want: CodeEmptyInputs},
+		{body: `{"language":"c","code":"int main() {}","inputs":["1","2","3"]}`, want: CodeTooManyInputs},
+		{body: `{"language":"c","inputs":["1"]}`, want: CodeEmptyCode},
+	}
+	for _, tt := range tests {
+		status, body := batchRequest(t, tt.body)
+		if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(tt.want) {
+			t.Errorf("%s = %d %v, want %s", tt.body, status, body, tt.want)
+		}
+	}
+	if n := len(fake.submitted()); n != 0 {
+		t.Errorf("submitted %d jobs", n)
+	}
+}
+
+func TestBatchCompileOnce(t *testing.T) {
+	fake := withFakeEngine(t, func(job *input.Job) *tork.Job {
+		if strings.Contains(job.Tasks[0].Files["usercode.c"], "broken") {
+			return compileFailedJob(jobPath("usercode.c") + ":1:1: error: expected ';'\n")
+		}
+		return completedJob(metadataPrefix + "exit_code.0=0\n" + metadataPrefix + "stdout.0=1\n" +
+			metadataPrefix + "exit_code.1=3\n" + metadataPrefix + "stdout.1=2\n")
+	})
+
+	status, body := batchRequest(t, `{"language":"c","code":"int main() {}","inputs":["1","2"],"compile_once":true}`)
+	if status != http.StatusOK {
+		t.Fatalf("batch = %d %v", status, body)
+	}
+	jobs := fake.submitted()
+	if len(jobs) != 1 {
+		t.Fatalf("submitted %d jobs, want a single one", len(jobs))
+	}
+	task := jobs[0].Tasks[0]
+	if n := strings.Count(task.Run, "gcc "); n != 1 {
+		t.Errorf("the code is compiled %d times: %s", n, task.Run)
+	}
+	if task.Files[runInputFilename(0)] != "1" || task.Files[runInputFilename(1)] != "2" {
+		t.Errorf("the inputs aren't passed as files: %v", task.Files)
+	}
+
+	results, _ := body["results"].([]any)
+	if len(results) != 2 {
+		t.Fatalf("results = %v, want one per input", results)
+	}
+	want := []struct {
+		stdout   string
+		exitCode float64
+	}{{"1", 0}, {"2", 3}}
+	for i, r := range results {
+		r := r.(map[string]any)
+		result, _ := r["result"].(map[string]any)
+		if r["index"] != float64(i) || r["status"] != float64(http.StatusOK) ||
+			result["stdout"] != want[i].stdout || result["exit_code"] != want[i].exitCode {
+			t.Errorf("result %d = %v", i, r)
+		}
+	}
+
+	// Without a program there are no runs, only the response of the compilation
+	status, body = batchRequest(t, `{"language":"c","code":"broken","inputs":["1","2"],"compile_once":true}`)
+	e := errorOf(body)
+	if _, ok := body["results"]; ok || status != http.StatusBadRequest || e["code"] != string(CodeCompileError) || body["phase"] != phaseCompile {
+		t.Errorf("failed compilation = %d %v", status, body)
+	}
+}
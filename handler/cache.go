@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cachedResponse is the response to an execution, kept for identical submissions
+type cachedResponse struct {
+	key     string
+	status  int
+	body    any
+	expires time.Time
+}
+
+// resultCache is an LRU cache of responses, keyed by a hash of the request
+type resultCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used first
+	order *list.List
+}
+
+var results = &resultCache{entries: make(map[string]*list.Element), order: list.New()}
+
+// cacheKey hashes everything in the request that affects the result
+func cacheKey(er ExecRequest) string {
+	// Maps are encoded with sorted keys, so the encoding is deterministic
+	data, _ := json.Marshal(er)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheable reports whether a response can be served again. Timeouts and server errors may not happen again
+func cacheable(status int) bool {
+	return status == http.StatusOK || status == http.StatusBadRequest
+}
+
+// get returns the response stored for the key, if caching is enabled and it hasn't expired
+func (rc *resultCache) get(key string) (int, any, bool) {
+	if !config.CacheEnabled {
+		return 0, nil, false
+	}
+	rc.Lock()
+	defer rc.Unlock()
+
+	e, ok := rc.entries[key]
+	if !ok {
+		return 0, nil, false
+	}
+	entry := e.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		rc.order.Remove(e)
+		delete(rc.entries, key)
+		return 0, nil, false
+	}
+	rc.order.MoveToFront(e)
+	return entry.status, entry.body, true
+}
+
+// put stores the response, evicting the least recently used ones above the maximum size
+func (rc *resultCache) put(key string, status int, body any) {
+	if !config.CacheEnabled || !cacheable(status) {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+
+	entry := &cachedResponse{key: key, status: status, body: body, expires: time.Now().Add(config.CacheTTL)}
+	if e, ok := rc.entries[key]; ok {
+		e.Value = entry
+		rc.order.MoveToFront(e)
+		return
+	}
+	rc.entries[key] = rc.order.PushFront(entry)
+	for rc.order.Len() > config.CacheMaxSize {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
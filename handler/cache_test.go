@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+// withResultCache gives the test an empty cache of its own, enabled with the size and TTL
+func withResultCache(t *testing.T, size int, ttl time.Duration) {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.CacheEnabled = true
+		c.CacheMaxSize = size
+		c.CacheTTL = ttl
+	})
+	saved := results
+	t.Cleanup(func() { results = saved })
+	results = &resultCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func TestResultCache(t *testing.T) {
+	withResultCache(t, 2, time.Hour)
+
+	results.put("a", http.StatusOK, "a")
+	results.put("b", http.StatusBadRequest, "b")
+	// a is now the most recently used, so c evicts b
+	if _, body, ok := results.get("a"); !ok || body != "a" {
+		t.Fatalf("get(a) = %v, %v", body, ok)
+	}
+	results.put("c", http.StatusOK, "c")
+	if _, _, ok := results.get("b"); ok {
+		t.Error("the least recently used response wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := results.get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	results.put("timeout", http.StatusGatewayTimeout, "timeout")
+	if _, _, ok := results.get("timeout"); ok {
+		t.Error("a timeout was cached")
+	}
+}
+
+func TestResultCacheExpires(t *testing.T) {
+	withResultCache(t, 2, time.Millisecond)
+
+	results.put("a", http.StatusOK, "a")
+	time.Sleep(5 * time.Millisecond)
+	if _, _, ok := results.get("a"); ok {
+		t.Error("an expired response was served")
+	}
+	if n := results.order.Len(); n != 0 {
+		t.Errorf("%d responses left, want the expired one removed", n)
+	}
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+	withResultCache(t, 2, time.Hour)
+	config.CacheEnabled = false
+
+	results.put("a", http.StatusOK, "a")
+	if _, _, ok := results.get("a"); ok {
+		t.Error("a response was cached with the cache disabled")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Files: map[string]string{"a.h": "", "b.h": ""}}
+	same := ExecRequest{Language: "c", Code: "int main() {}", Files: map[string]string{"b.h": "", "a.h": ""}}
+	if cacheKey(er) != cacheKey(same) {
+		t.Error("identical requests have different keys")
+	}
+	other := er
+	other.Input = "1"
+	if cacheKey(er) == cacheKey(other) {
+		t.Error("requests with different input have the same key")
+	}
+}
+
+func TestIdenticalSubmissionsAreServedFromTheCache(t *testing.T) {
+	withResultCache(t, 8, time.Hour)
+	trace := `{"code":"int main() {}","trace":[{"event":"step_line","line":1}]}`
+	fake := withFakeEngine(t, func(job *input.Job) *tork.Job {
+		for _, code := range job.Tasks[0].Files {
+			if strings.Contains(code, "for") {
+				return completedJob(metadataPrefix + "timed_out=1\n")
+			}
+		}
+		return completedJob(trace + "\n" + metadataPrefix + "exit_code=0\n")
+	})
+
+	run := func(code string) int {
+		body := `{"language":"c","code":` + jsonString(code) + `}`
+		c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(body)))
+		if err := Handler(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		if status := run("int main() {}"); status != http.StatusOK {
+			t.Fatalf("execution %d = %d, want %d", i, status, http.StatusOK)
+		}
+	}
+	if n := len(fake.submitted()); n != 1 {
+		t.Errorf("submitted %d jobs for identical submissions, want 1", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := run("int main() { for (;;); }"); status != http.StatusGatewayTimeout {
+			t.Fatalf("execution %d = %d, want %d", i, status, http.StatusGatewayTimeout)
+		}
+	}
+	if n := len(fake.submitted()); n != 3 {
+		t.Errorf("submitted %d jobs, want the timeout to run again", n)
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// CompilerInfo is a compiler, or interpreter, of a language
+type CompilerInfo struct {
+	// Name accepted in the request's compiler field. Languages with a single compiler have the name of its binary
+	Name string `json:"name"`
+	// First line of its "--version", e.g. "gcc (Debian 6.3.0-18+deb9u1) 6.3.0 20170516". Omitted when probing is
+	// disabled or the compiler is unavailable
+	Version string `json:"version,omitempty"`
+	// Whether the compiler was found in its image. Compilers of images that couldn't be probed are unavailable
+	Available bool `json:"available"`
+}
+
+// LanguageCompilers lists the compilers of a language
+type LanguageCompilers struct {
+	Language  string         `json:"language"`
+	Compilers []CompilerInfo `json:"compilers"`
+}
+
+// Compilers lists the compilers of the enabled languages with the versions probed when the server started
+func Compilers(c web.Context) error {
+	return c.JSON(http.StatusOK, languageCompilers())
+}
+
+// compilerEntry is a compiler of a language and the image that has it
+type compilerEntry struct {
+	name   string
+	binary string
+	image  string
+}
+
+// enabledCompilers returns the enabled languages, their compilers, and the binaries of every image they use
+func enabledCompilers() ([]Language, map[string][]compilerEntry, map[string][]string) {
+	var enabled []Language
+	compilers := make(map[string][]compilerEntry)
+	binaries := make(map[string][]string)
+	for _, l := range languages {
+		if !l.enabled(config) {
+			continue
+		}
+		enabled = append(enabled, l)
+		names := slices.Sorted(maps.Keys(l.compilers))
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, name := range names {
+			binary, _ := l.compiler(name)
+			if name == "" {
+				name = binary
+			}
+			image := l.image(config, binary)
+			compilers[l.ID] = append(compilers[l.ID], compilerEntry{name: name, binary: binary, image: image})
+			if !slices.Contains(binaries[image], binary) {
+				binaries[image] = append(binaries[image], binary)
+			}
+		}
+	}
+	return enabled, compilers, binaries
+}
+
+// ProbeAllCompilers probes every image once, so /compilers and /version can serve their versions. It's meant to
+// run once, when the engine is up. A failed probe only makes the compilers of its image unavailable
+func ProbeAllCompilers(ctx context.Context) {
+	if !config.ProbeCompilers {
+		return
+	}
+	_, _, binaries := enabledCompilers()
+	for _, binary := range versionBinaries {
+		if !slices.Contains(binaries[config.Image], binary) {
+			binaries[config.Image] = append(binaries[config.Image], binary)
+		}
+	}
+	for _, image := range slices.Sorted(maps.Keys(binaries)) {
+		if err := probeVersions(ctx, image, binaries[image]); err != nil {
+			log.Error().Err(err).Msgf("error probing the compilers of image %s", image)
+		}
+	}
+}
+
+// languageCompilers returns the compilers of the enabled languages, from the versions cached by ProbeAllCompilers.
+// Until an image is probed, its compilers are assumed available, like when probing is disabled
+func languageCompilers() []LanguageCompilers {
+	enabled, compilers, binaries := enabledCompilers()
+
+	versions := make(map[string]map[string]string)
+	if config.ProbeCompilers {
+		for image, b := range binaries {
+			versions[image] = cachedVersions(image, b)
+		}
+	}
+
+	out := make([]LanguageCompilers, 0, len(enabled))
+	for _, l := range enabled {
+		lc := LanguageCompilers{Language: l.ID}
+		for _, c := range compilers[l.ID] {
+			version, probed := versions[c.image][c.binary]
+			lc.Compilers = append(lc.Compilers, CompilerInfo{
+				Name:      c.name,
+				Version:   version,
+				Available: !probed || version != "",
+			})
+		}
+		out = append(out, lc)
+	}
+	return out
+}
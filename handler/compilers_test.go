@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+// listCompilers requests /compilers and decodes the response by language and compiler
+func listCompilers(t *testing.T) map[string]map[string]CompilerInfo {
+	t.Helper()
+	c, rec := newTestContext(httptest.NewRequest(http.MethodGet, "/compilers", nil))
+	if err := Compilers(c); err != nil {
+		t.Fatal(err)
+	}
+	var resp []LanguageCompilers
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	out := make(map[string]map[string]CompilerInfo)
+	for _, lc := range resp {
+		out[lc.Language] = make(map[string]CompilerInfo)
+		for _, c := range lc.Compilers {
+			out[lc.Language][c.Name] = c
+		}
+	}
+	return out
+}
+
+func TestCompilers(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ProbeCompilers = true
+		c.SubmitRetries = 0
+		c.EnabledLanguages = []string{"c", "rust"}
+	})
+	resetCompilerVersions(t)
+	// clang isn't installed, and the image of Rust can't be pulled
+	fake := withFakeEngine(t, func(job *input.Job) *tork.Job {
+		if job.Tasks[0].Image == config.RustImage {
+			return failedJob("no such image")
+		}
+		return completedJob("gcc=gcc 6.3.0\ng++=g++ 6.3.0\nclang=\nclang++=\n")
+	})
+
+	before := listCompilers(t)
+	if len(before) != 2 || !before["c"]["gcc"].Available || !before["c"]["clang"].Available || before["c"]["gcc"].Version != "" {
+		t.Errorf("compilers before the probe = %v, want all available without versions", before)
+	}
+
+	ProbeAllCompilers(context.Background())
+	if n := len(fake.submitted()); n != 2 {
+		t.Errorf("submitted %d probes, want one per image", n)
+	}
+	after := listCompilers(t)
+	if gcc := after["c"]["gcc"]; !gcc.Available || gcc.Version != "gcc 6.3.0" {
+		t.Errorf("gcc = %+v, want available with its version", gcc)
+	}
+	if clang := after["c"]["clang"]; clang.Available || clang.Version != "" {
+		t.Errorf("clang = %+v, want unavailable", clang)
+	}
+	if len(after["rust"]) != 1 {
+		t.Fatalf("compilers of rust = %v, want one", after["rust"])
+	}
+	for _, rustc := range after["rust"] {
+		if rustc.Available {
+			t.Errorf("%s = %+v, want unavailable since its image couldn't be probed", rustc.Name, rustc)
+		}
+	}
+	if _, ok := after["python"]; ok {
+		t.Error("a disabled language is listed")
+	}
+}
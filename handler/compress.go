@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Compress gzips the JSON responses of clients that accept it. Responses smaller than Config.CompressMinBytes are
+// sent as they are, since compressing them isn't worth it
+func Compress(next web.HandlerFunc) web.HandlerFunc {
+	return func(c web.Context) error {
+		if !config.Compress {
+			return next(c)
+		}
+		c.Response().Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.Request().Header.Get("Accept-Encoding")) {
+			return next(c)
+		}
+		return next(&compressContext{Context: c})
+	}
+}
+
+// compressContext gzips what the handler responds with JSON. Anything else, e.g. a WebSocket, is left untouched
+type compressContext struct {
+	web.Context
+}
+
+func (c *compressContext) JSON(code int, data any) error {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(data); err != nil {
+		return err
+	}
+	if body.Len() < config.CompressMinBytes {
+		return c.Context.JSON(code, data)
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	c.Response().WriteHeader(code)
+	gz := gzip.NewWriter(c.Response())
+	if _, err := gz.Write(body.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip, e.g. "gzip, deflate, br". Codings with q=0
+// are refused
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"gzip, deflate, br":   true,
+		"deflate, GZIP;q=0.5": true,
+		"*":                   true,
+		"br":                  false,
+		"gzip;q=0":            false,
+		"gzip;q=0, identity":  false,
+		"identity, *;q=0.1":   true,
+		"x-gzip-not-this-one": false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := map[string]string{"stdout": strings.Repeat("a", 2048)}
+	tests := []struct {
+		name     string
+		disabled bool
+		accept   string
+		body     any
+		text     bool
+		gzip     bool
+	}{
+		{name: "large", accept: "gzip", body: large, gzip: true},
+		{name: "small", accept: "gzip", body: map[string]string{"stdout": "a"}},
+		{name: "not accepted", body: large},
+		{name: "disabled", disabled: true, accept: "gzip", body: large},
+		{name: "not JSON", accept: "gzip", text: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.Compress = !tt.disabled })
+			r := httptest.NewRequest(http.MethodGet, "/languages", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			c, rec := newTestContext(r)
+			next := func(c web.Context) error {
+				if tt.text {
+					return c.String(http.StatusOK, strings.Repeat("a", 2048))
+				}
+				return c.JSON(http.StatusOK, tt.body)
+			}
+			if err := Compress(next)(c); err != nil {
+				t.Fatal(err)
+			}
+
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.gzip {
+				t.Fatalf("gzipped = %v, want %v", gzipped, tt.gzip)
+			}
+			if !tt.disabled && rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+			}
+			if !gzipped {
+				return
+			}
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK || !strings.Contains(string(body), `"stdout":"aaaa`) {
+				t.Errorf("response = %d %s", rec.Code, body)
+			}
+		})
+	}
+}
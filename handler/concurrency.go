@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// running counts the executions submitted to the engine that haven't finished yet
+var running atomic.Int64
+
+// runningByLanguage counts them by language ID too
+var runningByLanguage = func() map[string]*atomic.Int64 {
+	counts := make(map[string]*atomic.Int64, len(languages))
+	for _, l := range languages {
+		counts[l.ID] = &atomic.Int64{}
+	}
+	return counts
+}()
+
+// acquireExecution takes one of the Config.MaxConcurrent slots for an execution, and one of the
+// Config.MaxConcurrentPerLanguage slots of its language. The returned func gives both back and can be called more
+// than once, so it can both be deferred and called as soon as the result arrives. ok is false when every slot is
+// taken
+func acquireExecution(language string) (release func(), ok bool) {
+	if !take(&running, config.MaxConcurrent) {
+		return nil, false
+	}
+	lang, _ := findLanguage(language)
+	langRunning := runningByLanguage[lang.ID]
+	if langRunning != nil && !take(langRunning, config.MaxConcurrentPerLanguage[lang.ID]) {
+		running.Add(-1)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if langRunning != nil {
+				langRunning.Add(-1)
+			}
+			running.Add(-1)
+		})
+	}, true
+}
+
+// take counts one more execution, unless there are already limit of them. 0 disables the limit
+func take(count *atomic.Int64, limit int) bool {
+	if count.Add(1) > int64(limit) && limit > 0 {
+		count.Add(-1)
+		return false
+	}
+	return true
+}
+
+// serverBusyError is the error of an execution rejected because the server is running as many as it can
+func serverBusyError() *apiError {
+	return &apiError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeServerBusy,
+		Message: "the server is running too many executions, try again later",
+	}
+}
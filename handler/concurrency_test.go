@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+func TestAcquireExecution(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxConcurrent = 2 })
+
+	first, ok := acquireExecution("c")
+	if !ok {
+		t.Fatal("the first execution was rejected")
+	}
+	second, ok := acquireExecution("python")
+	if !ok {
+		t.Fatal("the second execution was rejected")
+	}
+	if _, ok := acquireExecution("c"); ok {
+		t.Fatal("an execution over the limit was accepted")
+	}
+
+	// Releasing twice gives back a single slot
+	first()
+	first()
+	third, ok := acquireExecution("c")
+	if !ok {
+		t.Fatal("a released slot can't be taken again")
+	}
+	if _, ok := acquireExecution("c"); ok {
+		t.Error("releasing twice freed two slots")
+	}
+	second()
+	third()
+	if n := running.Load(); n != 0 {
+		t.Errorf("%d executions left running", n)
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxConcurrent = 1 })
+	release, ok := acquireExecution("c")
+	if !ok {
+		t.Fatal("the execution was rejected")
+	}
+	defer release()
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job { return completedJob("") })
+
+	c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}"}`)))
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("response = %d %v", rec.Code, rec.Header())
+	}
+	checkEnvelope(t, http.StatusServiceUnavailable, rec.Body.Bytes(), CodeServerBusy)
+	if n := len(fake.submitted()); n != 0 {
+		t.Errorf("submitted %d jobs", n)
+	}
+}
+
+func TestAcquireExecutionPerLanguage(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxConcurrent = 4
+		c.MaxConcurrentPerLanguage = map[string]int{"rust": 1}
+	})
+
+	rust, ok := acquireExecution("rs")
+	if !ok {
+		t.Fatal("the first rust execution was rejected")
+	}
+	if _, ok := acquireExecution("rust"); ok {
+		t.Fatal("a rust execution over the language's limit was accepted")
+	}
+	// The rejected execution gave back its global slot, so C still has three
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		release, ok := acquireExecution("c")
+		if !ok {
+			t.Fatalf("C execution %d was rejected while rust was saturated", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := acquireExecution("c"); ok {
+		t.Error("an execution over the global limit was accepted")
+	}
+
+	rust()
+	for _, release := range releases {
+		release()
+	}
+	if n, langN := running.Load(), runningByLanguage["rust"].Load(); n != 0 || langN != 0 {
+		t.Errorf("%d executions left running, %d of rust", n, langN)
+	}
+}
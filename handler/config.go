@@ -0,0 +1,469 @@
+package handler
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/runabol/tork/conf"
+)
+
+const (
+	defaultImage     = "gcc-compiler:latest"
+	defaultRustImage = "rust-compiler:latest"
+	// Where the execution images have the parser
+	defaultParserPath = "/tmp/parser/wsgi_backend.py"
+	defaultWorkDir    = "/tmp/user_code"
+	defaultCPUs       = "1"
+	defaultMemory     = "1000m"
+	defaultTimeout    = "20s"
+	// Separators accepted between values of the input, besides whitespace
+	defaultInputSeparators = ","
+	defaultMaxCodeBytes    = 64 * 1024
+	defaultMaxInputBytes   = 16 * 1024
+	defaultMaxBodyBytes    = 1024 * 1024
+	defaultMaxOutputBytes  = 1024 * 1024
+	defaultRateLimit       = 30
+	defaultShutdownGrace   = 30 * time.Second
+	defaultJobTTL          = 10 * time.Minute
+	defaultIdempotencyTTL  = time.Minute
+	defaultSubmitRetries   = 2
+	defaultSubmitBackoff   = 100 * time.Millisecond
+	defaultCacheTTL        = 10 * time.Minute
+	defaultCacheMaxSize    = 1000
+	defaultMaxBatchInputs  = 10
+	defaultBatchTimeout    = time.Minute
+	// Smaller responses fit in a packet anyway
+	defaultCompressMinBytes = 1024
+	defaultTabWidth         = 1
+)
+
+// Config holds the settings of the [execution] section of the config file
+type Config struct {
+	// Image used to compile and run C/C++ code
+	Image string
+	// Image used to compile and run Rust code
+	RustImage string
+	// Image used to compile and run C/C++ code with clang. Image is used when it's empty
+	ClangImage string
+	// Path of the parser (wsgi_backend.py) in the execution images
+	ParserPath string
+	// Paths of other versions of the parser by name, which requests can ask for in parser_version, e.g. to pin one
+	// while migrating to another
+	ParserVersions map[string]string
+	// Directory of the execution images under which each job gets a directory of its own for its files, removed when
+	// the job ends
+	WorkDir string
+	// Number of CPUs of each task, e.g. "1" or "0.5"
+	CPUs string
+	// Memory limit of each task, e.g. "1000m" or "2g"
+	Memory string
+	// Maximum duration of each task, e.g. "20s"
+	Timeout string
+	// Limits of the tasks of each language (language ID -> limit), in the format of the ones above, instead of the
+	// ones the language has. They're clamped to the ones above
+	LanguageTimeouts map[string]string
+	LanguageCPUs     map[string]string
+	LanguageMemory   map[string]string
+	// Characters accepted between the values of the input field, besides whitespace
+	InputSeparators string
+	// Pattern of the accepted inputs, compiled from InputSeparators
+	inputPattern *regexp.Regexp
+	// Maximum size of the submitted code, in bytes
+	MaxCodeBytes int
+	// Maximum size of the program input (input or stdin fields), in bytes
+	MaxInputBytes int
+	// Maximum number of lines of the program input (input or stdin fields). 0 disables the limit
+	MaxInputLines int
+	// Maximum size of the whole request body, in bytes. Bigger bodies aren't read at all
+	MaxBodyBytes int
+	// Maximum size of the output of the program and of its trace, in bytes. Bigger outputs are truncated
+	MaxOutputBytes int
+	// Whether /version and /compilers run the compilers of the execution images to report their versions
+	ProbeCompilers bool
+	// Maximum executions per minute of each client IP. 0 disables the limit
+	RateLimit int
+	// Whether the client IP is read from the X-Forwarded-For and X-Real-IP headers set by a reverse proxy
+	TrustProxyHeaders bool
+	// Maximum time to wait for the running executions when the server is shutting down
+	ShutdownGrace time.Duration
+	// How long the results of async executions are kept
+	JobTTL time.Duration
+	// How long the response to a request with an Idempotency-Key is given to the requests with the same key. 0
+	// disables the header
+	IdempotencyTTL time.Duration
+	// Times a job is submitted again when the engine fails to take it for a reason that may go away
+	SubmitRetries int
+	// Wait before submitting a job again, doubled on every retry
+	SubmitBackoff time.Duration
+	// Whether the responses are cached and served again for identical submissions
+	CacheEnabled bool
+	// How long the cached responses are kept
+	CacheTTL time.Duration
+	// Maximum number of cached responses. The least recently used ones are evicted
+	CacheMaxSize int
+	// Origins allowed to call the server from a browser. "*" allows any origin and an empty list disables CORS
+	CORSOrigins []string
+	// Methods allowed in CORS requests
+	CORSMethods []string
+	// Request headers allowed in CORS requests. "*" allows any header
+	CORSHeaders []string
+	// Whether a line is logged per request, at info level
+	AccessLog bool
+	// Format of the access log, accessLogJSON or accessLogConsole. Empty follows the logging of the engine
+	AccessLogFormat string
+	// Whether JSON responses are gzipped for the clients that accept it
+	Compress bool
+	// Minimum size of a response to be gzipped, in bytes
+	CompressMinBytes int
+	// Extra compiler flags that requests may pass to the C/C++ compilers
+	AllowedFlags []string
+	// Environment variables of every program (name -> value), e.g. LC_ALL=C for a deterministic locale
+	Env map[string]string
+	// Names of the environment variables that requests may set
+	AllowedEnv []string
+	// IDs of the languages that can be used, e.g. to disable one whose image is broken. Empty enables all of them
+	EnabledLanguages []string
+	// Messages of the requests for disabled languages (language ID -> message), e.g. where else they can be run.
+	// Languages without one get a generic message
+	DisabledMessages map[string]string
+	// Whether programs that aren't traced (compile, validate and assembly actions, and batches with compile_once) are
+	// compiled without debug information, which is faster
+	FastCompile bool
+	// Whether requests with unknown fields are rejected instead of ignoring the fields
+	StrictJSON bool
+	// Whether responses include the compile command, to debug the server. Never enable it in production
+	Debug bool
+	// Whether requests may ask for the raw trace of valgrind ("trace": "valgrind"), to debug the parser
+	ValgrindTrace bool
+	// Maximum executions running at once, from every client. 0 disables the limit
+	MaxConcurrent int
+	// Maximum executions of each language running at once (language ID -> limit), besides MaxConcurrent, e.g. for
+	// the ones with heavier images. Languages without one are only limited by MaxConcurrent
+	MaxConcurrentPerLanguage map[string]int
+	// Width of the tabs in the columns of compiler errors and warnings. 1 counts a tab as one character
+	TabWidth int
+	// Patterns rejected in the submitted code, e.g. calls to system(), as a defense on top of the sandbox. Empty
+	// disables the check
+	ForbiddenPatterns []*regexp.Regexp
+	// Maximum number of inputs of a batch execution
+	MaxBatchInputs int
+	// Maximum time to wait for all the executions of a batch. The ones still running get a batch_timeout error
+	BatchTimeout time.Duration
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Image:     defaultImage,
+		RustImage: defaultRustImage,
+
+		ParserPath: defaultParserPath,
+		WorkDir:    defaultWorkDir,
+		CPUs:       defaultCPUs,
+		Memory:     defaultMemory,
+		Timeout:    defaultTimeout,
+
+		InputSeparators: defaultInputSeparators,
+		inputPattern:    regexp.MustCompile(inputPattern(defaultInputSeparators)),
+		MaxCodeBytes:    defaultMaxCodeBytes,
+		MaxInputBytes:   defaultMaxInputBytes,
+		MaxBodyBytes:    defaultMaxBodyBytes,
+		MaxOutputBytes:  defaultMaxOutputBytes,
+		ProbeCompilers:  true,
+		RateLimit:       defaultRateLimit,
+		ShutdownGrace:   defaultShutdownGrace,
+		JobTTL:          defaultJobTTL,
+		IdempotencyTTL:  defaultIdempotencyTTL,
+		SubmitRetries:   defaultSubmitRetries,
+		SubmitBackoff:   defaultSubmitBackoff,
+		CacheTTL:        defaultCacheTTL,
+		CacheMaxSize:    defaultCacheMaxSize,
+		// Permissive, for local development. Deployments should list their frontend's origin
+		CORSOrigins: []string{"*"},
+		CORSMethods: []string{http.MethodGet, http.MethodPost},
+		CORSHeaders: []string{"*"},
+
+		AccessLog:        true,
+		Compress:         true,
+		CompressMinBytes: defaultCompressMinBytes,
+
+		AllowedFlags: []string{"-lm", "-pthread"},
+
+		MaxBatchInputs: defaultMaxBatchInputs,
+		BatchTimeout:   defaultBatchTimeout,
+		TabWidth:       defaultTabWidth,
+	}
+}
+
+// LoadConfig reads the execution settings. It must be called after conf.LoadConfig
+func LoadConfig() error {
+	c := defaultConfig()
+	var err error
+
+	c.Image = conf.StringDefault("execution.image", c.Image)
+	// The environment variable takes precedence, so images can be pinned per deployment
+	if image := os.Getenv("HPW_COMPILER_IMAGE"); image != "" {
+		c.Image = image
+	}
+	c.RustImage = conf.StringDefault("execution.rust_image", c.RustImage)
+	c.ClangImage = conf.String("execution.clang_image")
+	c.ParserPath = strings.TrimSpace(conf.StringDefault("execution.parser_path", c.ParserPath))
+	// The path is put in the shell command
+	if !parserPathPattern.MatchString(c.ParserPath) {
+		return errors.Errorf("invalid parser path: %q", c.ParserPath)
+	}
+	c.ParserVersions = make(map[string]string)
+	for name, parserPath := range conf.StringMap("execution.parser_versions") {
+		parserPath = strings.TrimSpace(parserPath)
+		if !parserVersionPattern.MatchString(name) || !parserPathPattern.MatchString(parserPath) {
+			return errors.Errorf("invalid parser version %q: %q", name, parserPath)
+		}
+		c.ParserVersions[name] = parserPath
+	}
+	c.WorkDir = path.Clean(strings.TrimSpace(conf.StringDefault("execution.work_dir", c.WorkDir)))
+	// Also put in the shell command, and the directory of each job is removed recursively
+	if !parserPathPattern.MatchString(c.WorkDir) || c.WorkDir == "/" {
+		return errors.Errorf("invalid work dir: %q", c.WorkDir)
+	}
+	c.CPUs = conf.StringDefault("execution.cpus", c.CPUs)
+	c.Memory = conf.StringDefault("execution.memory", c.Memory)
+	c.Timeout = conf.StringDefault("execution.timeout", c.Timeout)
+	if c.LanguageTimeouts, err = languageLimits("execution.language_timeouts", "timeout", validTimeout); err != nil {
+		return err
+	}
+	if c.LanguageCPUs, err = languageLimits("execution.language_cpus", "cpus", validCPUs); err != nil {
+		return err
+	}
+	if c.LanguageMemory, err = languageLimits("execution.language_memory", "memory", validMemory); err != nil {
+		return err
+	}
+	c.InputSeparators = conf.StringDefault("execution.input_separators", c.InputSeparators)
+	if strings.ContainsAny(c.InputSeparators, forbiddenInputChars) {
+		return errors.Errorf("invalid input separators %q: %s are not allowed", c.InputSeparators, forbiddenInputChars)
+	}
+	re, err := regexp.Compile(inputPattern(c.InputSeparators))
+	if err != nil {
+		return errors.Wrapf(err, "invalid input separators %q", c.InputSeparators)
+	}
+	c.inputPattern = re
+	c.MaxCodeBytes = conf.IntDefault("execution.max_code_bytes", c.MaxCodeBytes)
+	c.MaxInputBytes = conf.IntDefault("execution.max_input_bytes", c.MaxInputBytes)
+	c.MaxInputLines = conf.IntDefault("execution.max_input_lines", c.MaxInputLines)
+	if c.MaxInputLines < 0 {
+		return errors.Errorf("invalid max input lines: %d", c.MaxInputLines)
+	}
+	c.MaxBodyBytes = conf.IntDefault("execution.max_body_bytes", c.MaxBodyBytes)
+	if c.MaxBodyBytes <= 0 {
+		return errors.Errorf("invalid max body bytes: %d", c.MaxBodyBytes)
+	}
+	c.MaxOutputBytes = conf.IntDefault("execution.max_output_bytes", c.MaxOutputBytes)
+	if c.MaxOutputBytes <= 0 {
+		return errors.Errorf("invalid max output bytes: %d", c.MaxOutputBytes)
+	}
+	c.ProbeCompilers = conf.BoolDefault("execution.probe_compilers", c.ProbeCompilers)
+	c.RateLimit = conf.IntDefault("execution.rate_limit", c.RateLimit)
+	c.TrustProxyHeaders = conf.Bool("execution.trust_proxy_headers")
+	c.ShutdownGrace = conf.DurationDefault("execution.shutdown_grace", c.ShutdownGrace)
+	c.JobTTL = conf.DurationDefault("execution.job_ttl", c.JobTTL)
+	if c.JobTTL <= 0 {
+		return errors.Errorf("invalid job ttl: %s", c.JobTTL)
+	}
+	c.IdempotencyTTL = conf.DurationDefault("execution.idempotency_ttl", c.IdempotencyTTL)
+	if c.IdempotencyTTL < 0 {
+		return errors.Errorf("invalid idempotency ttl: %s", c.IdempotencyTTL)
+	}
+	c.SubmitRetries = conf.IntDefault("execution.submit_retries", c.SubmitRetries)
+	c.SubmitBackoff = conf.DurationDefault("execution.submit_backoff", c.SubmitBackoff)
+	if c.SubmitRetries < 0 || c.SubmitBackoff < 0 {
+		return errors.Errorf("invalid submit retries: %d, backoff %s", c.SubmitRetries, c.SubmitBackoff)
+	}
+	c.CacheEnabled = conf.Bool("execution.cache.enabled")
+	c.CacheTTL = conf.DurationDefault("execution.cache.ttl", c.CacheTTL)
+	c.CacheMaxSize = conf.IntDefault("execution.cache.max_size", c.CacheMaxSize)
+	if c.CacheEnabled && (c.CacheTTL <= 0 || c.CacheMaxSize <= 0) {
+		return errors.Errorf("invalid cache settings: ttl %s, max size %d", c.CacheTTL, c.CacheMaxSize)
+	}
+	c.CORSOrigins = stringsDefault("execution.cors.origins", c.CORSOrigins)
+	c.CORSMethods = stringsDefault("execution.cors.methods", c.CORSMethods)
+	c.CORSHeaders = stringsDefault("execution.cors.headers", c.CORSHeaders)
+	c.AccessLog = conf.BoolDefault("execution.access_log.enabled", c.AccessLog)
+	c.AccessLogFormat = strings.ToLower(strings.TrimSpace(conf.String("execution.access_log.format")))
+	if c.AccessLogFormat != "" && c.AccessLogFormat != accessLogJSON && c.AccessLogFormat != accessLogConsole {
+		return errors.Errorf("invalid access log format: %s", c.AccessLogFormat)
+	}
+	c.Compress = conf.BoolDefault("execution.compression.enabled", c.Compress)
+	c.CompressMinBytes = conf.IntDefault("execution.compression.min_bytes", c.CompressMinBytes)
+	if c.CompressMinBytes < 0 {
+		return errors.Errorf("invalid compression min bytes: %d", c.CompressMinBytes)
+	}
+	c.EnabledLanguages = stringsDefault("execution.enabled_languages", c.EnabledLanguages)
+	for i, name := range c.EnabledLanguages {
+		lang, ok := findLanguage(name)
+		if !ok {
+			return errors.Errorf("unknown enabled language: %s", name)
+		}
+		// Aliases are accepted, but the IDs are what's compared
+		c.EnabledLanguages[i] = lang.ID
+	}
+	c.DisabledMessages = make(map[string]string)
+	for name, message := range conf.StringMap("execution.disabled_messages") {
+		lang, ok := findLanguage(name)
+		if !ok {
+			return errors.Errorf("unknown language of disabled message: %s", name)
+		}
+		c.DisabledMessages[lang.ID] = strings.TrimSpace(message)
+	}
+	c.ValgrindTrace = conf.Bool("execution.valgrind_trace")
+	c.Debug = conf.Bool("execution.debug")
+	c.StrictJSON = conf.Bool("execution.strict_json")
+	c.FastCompile = conf.Bool("execution.fast_compile")
+	c.AllowedFlags = stringsDefault("execution.allowed_flags", c.AllowedFlags)
+	// The flags are put in the shell command, so even the configured ones can't carry anything else
+	for _, flag := range c.AllowedFlags {
+		if !flagPattern.MatchString(flag) {
+			return errors.Errorf("invalid allowed flag: %q", flag)
+		}
+	}
+	c.Env = make(map[string]string)
+	for name, value := range conf.StringMap("execution.env") {
+		if !validEnvName(name) || strings.ContainsRune(value, 0) {
+			return errors.Errorf("invalid env: %q=%q", name, value)
+		}
+		c.Env[name] = value
+	}
+	c.AllowedEnv = stringsDefault("execution.allowed_env", nil)
+	for _, name := range c.AllowedEnv {
+		if !validEnvName(name) {
+			return errors.Errorf("invalid allowed env: %q", name)
+		}
+	}
+	c.MaxConcurrent = conf.IntDefault("execution.max_concurrent", c.MaxConcurrent)
+	c.MaxConcurrentPerLanguage = make(map[string]int)
+	for name, limit := range conf.IntMap("execution.max_concurrent_per_language") {
+		lang, ok := findLanguage(name)
+		if !ok {
+			return errors.Errorf("unknown language of max concurrent: %s", name)
+		}
+		if limit < 0 {
+			return errors.Errorf("invalid max concurrent of %s: %d", lang.ID, limit)
+		}
+		c.MaxConcurrentPerLanguage[lang.ID] = limit
+	}
+	c.TabWidth = conf.IntDefault("execution.tab_width", c.TabWidth)
+	if c.TabWidth <= 0 {
+		return errors.Errorf("invalid tab width: %d", c.TabWidth)
+	}
+	for _, pattern := range stringsDefault("execution.forbidden_patterns", nil) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid forbidden pattern: %q", pattern)
+		}
+		c.ForbiddenPatterns = append(c.ForbiddenPatterns, re)
+	}
+	c.MaxBatchInputs = conf.IntDefault("execution.max_batch_inputs", c.MaxBatchInputs)
+	if c.MaxBatchInputs <= 0 {
+		return errors.Errorf("invalid max batch inputs: %d", c.MaxBatchInputs)
+	}
+	c.BatchTimeout = conf.DurationDefault("execution.batch_timeout", c.BatchTimeout)
+	if c.BatchTimeout <= 0 {
+		return errors.Errorf("invalid batch timeout: %s", c.BatchTimeout)
+	}
+
+	if err := validateLimits(c); err != nil {
+		return err
+	}
+
+	config = c
+	return nil
+}
+
+// parserPathPattern matches an absolute path without characters the shell interprets
+var parserPathPattern = regexp.MustCompile(`^/[A-Za-z0-9_./-]+$`)
+
+// parserVersionPattern matches the name of a parser version, e.g. "v2" or "2024-11"
+var parserVersionPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// envNamePattern matches the names of environment variables
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validEnvName reports whether name can be set in the task. The variables of the engine (TORK_*) can't be overridden
+func validEnvName(name string) bool {
+	return envNamePattern.MatchString(name) && !strings.HasPrefix(name, "TORK_")
+}
+
+// flagPattern matches a single compiler flag, e.g. "-lm", "-pthread" or "-DDEBUG=1"
+var flagPattern = regexp.MustCompile(`^-[A-Za-z0-9_+=.,-]+$`)
+
+// stringsDefault reads a list, given either as an array or as a comma separated string. Blank items are dropped,
+// so the key can be set to an empty string to get an empty list
+func stringsDefault(key string, dv []string) []string {
+	values := make([]string, 0)
+	for _, v := range conf.StringsDefault(key, dv) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// validateLimits checks that the task limits are in a format the engine understands
+func validateLimits(c Config) error {
+	if !validCPUs(c.CPUs) {
+		return errors.Errorf("invalid cpus limit: %s", c.CPUs)
+	}
+	if _, err := units.RAMInBytes(c.Memory); err != nil {
+		return errors.Wrapf(err, "invalid memory limit: %s", c.Memory)
+	}
+	// A timeout of 0 would stop every program right away
+	if timeout, err := time.ParseDuration(c.Timeout); err != nil {
+		return errors.Wrapf(err, "invalid timeout: %s", c.Timeout)
+	} else if timeout <= 0 {
+		return errors.Errorf("invalid timeout: %s", c.Timeout)
+	}
+	return nil
+}
+
+func validCPUs(cpus string) bool {
+	c, err := strconv.ParseFloat(cpus, 64)
+	return err == nil && c > 0
+}
+
+func validMemory(memory string) bool {
+	m, err := units.RAMInBytes(memory)
+	return err == nil && m > 0
+}
+
+func validTimeout(timeout string) bool {
+	t, err := time.ParseDuration(timeout)
+	return err == nil && t > 0
+}
+
+// languageLimits reads a limit of the tasks of each language, e.g. execution.language_timeouts, by language ID
+func languageLimits(key string, name string, valid func(string) bool) (map[string]string, error) {
+	limits := make(map[string]string)
+	for lang, limit := range conf.StringMap(key) {
+		l, ok := findLanguage(lang)
+		if !ok {
+			return nil, errors.Errorf("unknown language of %s limit: %s", name, lang)
+		}
+		limit = strings.TrimSpace(limit)
+		if !valid(limit) {
+			return nil, errors.Errorf("invalid %s limit of %s: %s", name, l.ID, limit)
+		}
+		limits[l.ID] = limit
+	}
+	return limits, nil
+}
+
+// ShutdownGrace returns the maximum time to wait for the running executions when the server is shutting down
+func ShutdownGrace() time.Duration {
+	return config.ShutdownGrace
+}
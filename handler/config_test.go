@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(c *Config)
+		wantErr bool
+	}{
+		{name: "defaults", set: func(c *Config) {}},
+		{name: "fractional cpus", set: func(c *Config) { c.CPUs = "0.5" }},
+		{name: "no cpus", set: func(c *Config) { c.CPUs = "0" }, wantErr: true},
+		{name: "cpus not a number", set: func(c *Config) { c.CPUs = "one" }, wantErr: true},
+		{name: "memory", set: func(c *Config) { c.Memory = "2g" }},
+		{name: "memory not a size", set: func(c *Config) { c.Memory = "a lot" }, wantErr: true},
+		{name: "timeout", set: func(c *Config) { c.Timeout = "1m30s" }},
+		{name: "timeout without unit", set: func(c *Config) { c.Timeout = "20" }, wantErr: true},
+		{name: "zero timeout", set: func(c *Config) { c.Timeout = "0s" }, wantErr: true},
+		{name: "negative timeout", set: func(c *Config) { c.Timeout = "-5s" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.set(&c)
+			if err := validateLimits(c); (err != nil) != tt.wantErr {
+				t.Errorf("validateLimits() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageFromEnvironment(t *testing.T) {
+	withConfig(t, func(c *Config) {})
+	t.Setenv("HPW_COMPILER_IMAGE", "registry.example.com/gcc-compiler:1.2")
+
+	if err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Image != "registry.example.com/gcc-compiler:1.2" {
+		t.Fatalf("image = %s, want the one of HPW_COMPILER_IMAGE", config.Image)
+	}
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Image != config.Image {
+		t.Errorf("task image = %s, want %s", task.Image, config.Image)
+	}
+}
+
+func TestFlagPattern(t *testing.T) {
+	for flag, want := range map[string]bool{"-lm": true, "-pthread": true, "-DDEBUG=1": true, "lm": false, "-lm;reboot": false,
+		"-l m": false, "-o$HOME": false} {
+		if got := flagPattern.MatchString(flag); got != want {
+			t.Errorf("flagPattern matches %q = %v, want %v", flag, got, want)
+		}
+	}
+}
+
+func TestParserPathPattern(t *testing.T) {
+	for path, want := range map[string]bool{"/tmp/parser/wsgi_backend.py": true, "/opt/parser-2/run.py": true,
+		"parser.py": false, "/tmp/parser.py; rm -rf /": false, "/tmp/$(id).py": false, "/tmp/my parser.py": false} {
+		if got := parserPathPattern.MatchString(path); got != want {
+			t.Errorf("parserPathPattern matches %q = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Response headers the browser lets the frontend read
+const corsExposedHeaders = "Location, Retry-After, X-Request-ID"
+
+// CORS sets the CORS headers for the allowed origins and answers preflight requests
+func CORS(next web.HandlerFunc) web.HandlerFunc {
+	return func(c web.Context) error {
+		req := c.Request()
+		header := c.Response().Header()
+		header.Add("Vary", "Origin")
+
+		origin := req.Header.Get("Origin")
+		allowed := origin != "" && corsAllowed(config.CORSOrigins, origin)
+		if allowed {
+			if slices.Contains(config.CORSOrigins, "*") {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+			header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if req.Method != http.MethodOptions {
+			return next(c)
+		}
+
+		if allowed {
+			header.Set("Access-Control-Allow-Methods", strings.Join(config.CORSMethods, ", "))
+			// The wildcard isn't understood by every browser, so the requested headers are allowed instead
+			if slices.Contains(config.CORSHeaders, "*") {
+				header.Set("Access-Control-Allow-Headers", req.Header.Get("Access-Control-Request-Headers"))
+			} else {
+				header.Set("Access-Control-Allow-Headers", strings.Join(config.CORSHeaders, ", "))
+			}
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// Preflight is the handler of the OPTIONS endpoints. CORS answers them, so it's never called
+func Preflight(c web.Context) error {
+	return c.NoContent(http.StatusNoContent)
+}
+
+// corsAllowed reports whether the origin is one of the allowed ones. "*" allows any origin
+func corsAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// corsRequest sends the request from the origin through CORS
+func corsRequest(t *testing.T, method string, origin string, header http.Header) (*httptest.ResponseRecorder, bool) {
+	t.Helper()
+	r := httptest.NewRequest(method, "/execute", nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	called := false
+	next := func(c web.Context) error {
+		called = true
+		return c.String(http.StatusOK, "ok")
+	}
+	c, rec := newTestContext(r)
+	if err := CORS(next)(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec, called
+}
+
+func TestCORS(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.CORSOrigins = []string{"https://app.example.com/"}
+		c.CORSMethods = []string{"GET", "POST"}
+		c.CORSHeaders = []string{"Content-Type"}
+	})
+
+	rec, called := corsRequest(t, http.MethodPost, "https://APP.example.com", nil)
+	if !called || rec.Header().Get("Access-Control-Allow-Origin") != "https://APP.example.com" ||
+		rec.Header().Get("Access-Control-Expose-Headers") != corsExposedHeaders {
+		t.Errorf("allowed origin = %v, called %v", rec.Header(), called)
+	}
+
+	rec, called = corsRequest(t, http.MethodPost, "https://evil.example.com", nil)
+	if !called || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin = %v, called %v", rec.Header(), called)
+	}
+	if rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("Vary = %q, want Origin", rec.Header().Get("Vary"))
+	}
+
+	rec, called = corsRequest(t, http.MethodOptions, "https://app.example.com", nil)
+	if called || rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") != "GET, POST" ||
+		rec.Header().Get("Access-Control-Allow-Headers") != "Content-Type" {
+		t.Errorf("preflight = %d %v, called %v", rec.Code, rec.Header(), called)
+	}
+
+	rec, _ = corsRequest(t, http.MethodOptions, "https://evil.example.com", nil)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("preflight of another origin = %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestCORSWildcards(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.CORSOrigins = []string{"*"}
+		c.CORSMethods = []string{"POST"}
+		c.CORSHeaders = []string{"*"}
+	})
+
+	header := http.Header{"Access-Control-Request-Headers": {"Content-Type, Idempotency-Key"}}
+	rec, _ := corsRequest(t, http.MethodOptions, "https://any.example.com", header)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		rec.Header().Get("Access-Control-Allow-Headers") != "Content-Type, Idempotency-Key" {
+		t.Errorf("preflight = %v", rec.Header())
+	}
+
+	rec, called := corsRequest(t, http.MethodPost, "", nil)
+	if !called || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("request without an origin = %v, called %v", rec.Header(), called)
+	}
+}
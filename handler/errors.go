@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// ErrorCode identifies why a request failed. Clients should compare it rather than the message, which may change
+type ErrorCode string
+
+// Codes of the failed responses. Each failure has exactly one, listed in the README
+const (
+	CodeArgsTooLarge         ErrorCode = "args_too_large"
+	CodeBatchTimeout         ErrorCode = "batch_timeout"
+	CodeBodyTooLarge         ErrorCode = "body_too_large"
+	CodeClientDisconnected   ErrorCode = "client_disconnected"
+	CodeCodeTooLarge         ErrorCode = "code_too_large"
+	CodeCompileError         ErrorCode = "compile_error"
+	CodeEmptyCode            ErrorCode = "empty_code"
+	CodeEmptyInputs          ErrorCode = "empty_inputs"
+	CodeEmptyLanguage        ErrorCode = "empty_language"
+	CodeEngineUnavailable    ErrorCode = "engine_unavailable"
+	CodeEnvNotAllowed        ErrorCode = "env_not_allowed"
+	CodeExecutionTimeout     ErrorCode = "execution_timeout"
+	CodeFlagNotAllowed       ErrorCode = "flag_not_allowed"
+	CodeForbiddenConstruct   ErrorCode = "forbidden_construct"
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeInputTooLarge        ErrorCode = "input_too_large"
+	CodeInternalError        ErrorCode = "internal_error"
+	CodeInvalidArgs          ErrorCode = "invalid_args"
+	CodeInvalidFilename      ErrorCode = "invalid_filename"
+	CodeInvalidGzip          ErrorCode = "invalid_gzip"
+	CodeInvalidInput         ErrorCode = "invalid_input"
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeInvalidTimeout       ErrorCode = "invalid_timeout"
+	CodeJobExpired           ErrorCode = "job_expired"
+	CodeJobFinished          ErrorCode = "job_finished"
+	CodeJobNotFound          ErrorCode = "job_not_found"
+	CodeLanguageDisabled     ErrorCode = "language_disabled"
+	CodeLinkError            ErrorCode = "link_error"
+	CodeNoExecutionResult    ErrorCode = "no_execution_result"
+	CodeOutOfMemory          ErrorCode = "out_of_memory"
+	CodeParserError          ErrorCode = "parser_error"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeServerBusy           ErrorCode = "server_busy"
+	CodeServerShuttingDown   ErrorCode = "server_shutting_down"
+	CodeTooManyInputs        ErrorCode = "too_many_inputs"
+	CodeUnknownError         ErrorCode = "unknown_error"
+	CodeUnknownField         ErrorCode = "unknown_field"
+	CodeUnknownParserVersion ErrorCode = "unknown_parser_version"
+	CodeUnsupportedEncoding  ErrorCode = "unsupported_encoding"
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+)
+
+// apiError describes why a request failed. Code is meant for clients and Message for people
+type apiError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Status  int       `json:"status"`
+}
+
+// errorBody is the body of every failed response, e.g. {"error":{"code":"invalid_input","message":"...","status":400}}
+type errorBody struct {
+	Error apiError `json:"error"`
+}
+
+func newErrorBody(status int, code ErrorCode, message string) errorBody {
+	return errorBody{Error: apiError{Code: code, Message: message, Status: status}}
+}
+
+// timeoutBody is the body of an execution that timed out, with what the program printed until it was stopped
+type timeoutBody struct {
+	errorBody
+	// Always "timeout", like the event of the errors in Ret
+	Event string `json:"event"`
+	// Shown to the user, since most programs that time out are stuck in a loop
+	Hint   string `json:"hint"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// Always phaseRun
+	Phase string `json:"phase"`
+}
+
+func newTimeoutBody(seconds int, stdout, stderr string) timeoutBody {
+	return timeoutBody{
+		errorBody: newErrorBody(http.StatusGatewayTimeout, CodeExecutionTimeout, "the execution took longer than its timeout"),
+		Event:     "timeout",
+		Hint:      fmt.Sprintf("Your program ran longer than %ds and was stopped — check for infinite loops.", seconds),
+		Stdout:    stdout,
+		Stderr:    stderr,
+		Phase:     phaseRun,
+	}
+}
+
+// respondError sends the error envelope with the status
+func respondError(c web.Context, status int, code ErrorCode, message string) error {
+	return c.JSON(status, newErrorBody(status, code, message))
+}
@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/engine"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	withConfig(t, func(c *Config) { c.SubmitRetries = 0 })
+	tests := []struct {
+		name   string
+		body   string
+		job    *tork.Job
+		status int
+		code   ErrorCode
+	}{
+		{name: "invalid JSON", body: `{"language":`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "unknown language", body: `{"language":"cobol","code":"x"}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "failed job", body: `{"language":"c","code":"int main() {}"}`, job: failedJob("no such image"),
+			status: http.StatusInternalServerError, code: CodeParserError},
+		{name: "timeout", body: `{"language":"c","code":"int main() {}"}`, job: completedJob(metadataPrefix + "timed_out=1\n"),
+			status: http.StatusGatewayTimeout, code: CodeExecutionTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFakeEngine(t, func(*input.Job) *tork.Job { return tt.job })
+			c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(tt.body)))
+			if err := Handler(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			checkEnvelope(t, tt.status, rec.Body.Bytes(), tt.code)
+		})
+	}
+}
+
+func TestEngineUnavailableEnvelope(t *testing.T) {
+	withUnavailableEngine(t)
+
+	c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}"}`)))
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	checkEnvelope(t, rec.Code, rec.Body.Bytes(), CodeEngineUnavailable)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// withUnavailableEngine makes every submission fail for the test, without retrying them
+func withUnavailableEngine(t *testing.T) {
+	t.Helper()
+	withConfig(t, func(c *Config) { c.SubmitRetries = 0 })
+	saved := engineSubmitJob
+	t.Cleanup(func() { engineSubmitJob = saved })
+	engineSubmitJob = func(context.Context, *input.Job, ...engine.JobListener) (*tork.Job, error) {
+		return nil, errors.New("engine is not running")
+	}
+}
+
+func TestTimeoutBody(t *testing.T) {
+	data, err := json.Marshal(newTimeoutBody(9, "1\n2\n", "warning"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEnvelope(t, http.StatusGatewayTimeout, data, CodeExecutionTimeout)
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["event"] != "timeout" || body["hint"] != "Your program ran longer than 9s and was stopped — check for infinite loops." ||
+		body["stdout"] != "1\n2\n" || body["stderr"] != "warning" || body["phase"] != phaseRun {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestEngineUnavailable(t *testing.T) {
+	withUnavailableEngine(t)
+	withIdempotencyStore(t)
+
+	c, rec := newTestContext(newJSONRequest("/execute?async=true", strings.NewReader(`{"language":"c","code":"int main() {}"}`)))
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("async status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	checkEnvelope(t, http.StatusServiceUnavailable, rec.Body.Bytes(), CodeEngineUnavailable)
+	if len(jobs.jobs) != 0 {
+		t.Errorf("the async job wasn't removed: %v", jobs.jobs)
+	}
+
+	status, body := batchRequest(t, `{"language":"c","code":"int main() {}","inputs":["1"]}`)
+	results, _ := body["results"].([]any)
+	if status != http.StatusOK || len(results) != 1 {
+		t.Fatalf("batch = %d %v", status, body)
+	}
+	result := results[0].(map[string]any)
+	data, _ := json.Marshal(result["result"])
+	if result["status"] != float64(http.StatusServiceUnavailable) {
+		t.Errorf("status of the input = %v, want %d", result["status"], http.StatusServiceUnavailable)
+	}
+	checkEnvelope(t, http.StatusServiceUnavailable, data, CodeEngineUnavailable)
+}
+
+// errorCodes returns the values of the ErrorCode constants of errors.go
+func errorCodes(t *testing.T) []ErrorCode {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "errors.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []ErrorCode
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			if ident, ok := value.Type.(*ast.Ident); !ok || ident.Name != "ErrorCode" {
+				continue
+			}
+			code, err := strconv.Unquote(value.Values[0].(*ast.BasicLit).Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, ErrorCode(code))
+		}
+	}
+	return codes
+}
+
+func TestErrorCodesAreDocumented(t *testing.T) {
+	readme, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := errorCodes(t)
+	if len(codes) == 0 {
+		t.Fatal("no error codes found")
+	}
+	seen := make(map[ErrorCode]bool)
+	for _, code := range codes {
+		if seen[code] {
+			t.Errorf("%s is used twice", code)
+		}
+		seen[code] = true
+		if !strings.Contains(string(readme), "| `"+string(code)+"` |") {
+			t.Errorf("%s isn't in the table of the README", code)
+		}
+	}
+}
+
+func TestBindErrorsAreJSON(t *testing.T) {
+	handlers := map[string]web.HandlerFunc{"/execute": Handler, "/validate": Validate, "/execute/batch": Batch}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        ErrorCode
+	}{
+		{name: "malformed", body: `{"language":"c",`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "wrong type", body: `{"language":"c","code":1}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "not JSON", contentType: "text/plain", body: `int main() {}`, status: http.StatusUnsupportedMediaType, code: CodeUnsupportedMediaType},
+	}
+	for path, handler := range handlers {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				fake := withFakeEngine(t, func(*input.Job) *tork.Job { return nil })
+				r := newJSONRequest(path, strings.NewReader(tt.body))
+				if tt.contentType != "" {
+					r.Header.Set("Content-Type", tt.contentType)
+				}
+				c, rec := newTestContext(r)
+				if err := handler(c); err != nil {
+					t.Fatalf("the error is returned to the engine: %v", err)
+				}
+				if rec.Code != tt.status || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+					t.Errorf("response = %d with Content-Type %q, want %d JSON", rec.Code, rec.Header().Get("Content-Type"), tt.status)
+				}
+				checkEnvelope(t, tt.status, rec.Body.Bytes(), tt.code)
+				if n := len(fake.submitted()); n != 0 {
+					t.Errorf("submitted %d jobs", n)
+				}
+			})
+		}
+	}
+}
@@ -1,16 +1,26 @@
 package handler
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"path"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"github.com/runabol/tork"
-	"github.com/runabol/tork/engine"
 	"github.com/runabol/tork/input"
 	"github.com/runabol/tork/middleware/web"
 )
@@ -18,41 +28,181 @@ import (
 type ExecRequest struct {
 	Code     string `json:"code"`
 	Language string `json:"language"`
-	Input    string `json:"input"`
+	// Input is fed to the program's standard input when Stdin is empty. It must pass sanitizeInput
+	Input string `json:"input"`
+	// Stdin is fed verbatim to the program's standard input and takes precedence over Input.
+	// It is never interpreted by the shell, so it is not restricted by sanitizeInput
+	Stdin string `json:"stdin"`
+	// Args are the optional arguments of the program (argv[1] onwards). They're passed through a file, never
+	// through the shell, so they're not restricted by sanitizeInput, but they can't have newlines
+	Args []string `json:"args"`
+	// Standard is the optional language standard, e.g. "c11" or "c++17". The compiler's default is used when empty
+	Standard string `json:"standard"`
+	// Compiler is the optional compiler preference for C/C++, "gcc" (default) or "clang"
+	Compiler string `json:"compiler"`
+	// Files are optional extra files (filename -> contents), e.g. headers and other sources, placed next to the main
+	// file. Sources of C/C++ are compiled and linked together with Code, which remains the file that is traced
+	Files map[string]string `json:"files"`
+	// CaptureFiles are optional paths, relative to the working directory of the program, of files it writes. Their
+	// contents are returned in the files field of the result
+	CaptureFiles []string `json:"capture_files"`
+	// Action is either actionRun (default), which traces the program, actionCompile, which only compiles it, or
+	// actionValidate, which only checks its syntax
+	Action string `json:"action"`
+	// Flags are optional extra compiler flags for C/C++, e.g. "-lm". Only the ones in Config.AllowedFlags are accepted
+	Flags []string `json:"flags"`
+	// Trace is the optional format of the trace. traceValgrind returns the raw output of valgrind, for debugging the
+	// parser. It's only accepted when Config.ValgrindTrace is set
+	Trace string `json:"trace"`
+	// ParserVersion is the optional name of the version of the parser, one of Config.ParserVersions. Config.ParserPath
+	// is used when it's empty
+	ParserVersion string `json:"parser_version"`
+	// Emit is the optional output of the compilation. emitAsm returns the generated assembly instead of running the
+	// program
+	Emit string `json:"emit"`
+	// Optimization is the optional optimization level, one of "O0" (default), "O1", "O2", "O3" and "Os". Traced
+	// programs are always compiled with O0, since the optimizer removes the variables valgrind shows
+	Optimization string `json:"optimization"`
+	// TimeoutMs is the optional timeout of the execution, in milliseconds. It's clamped to [minTimeout, Config.Timeout],
+	// which is also the default
+	TimeoutMs *int `json:"timeout_ms"`
+	// Env are optional environment variables of the program (name -> value). Only the names in Config.AllowedEnv are
+	// accepted, and they take precedence over the ones of Config.Env
+	Env map[string]string `json:"env"`
+	// stream is set by Stream, so what the program prints is also sent to the task's log while it runs
+	stream bool
+	// inputs are set by Batch to compile the code once and run it against each of them, natively, without tracing it
+	inputs []string
 }
 
-var debug_valgrind = false
+// minTimeout is the shortest timeout a request can ask for. Starting the container alone takes a while
+const minTimeout = time.Second
+
+const (
+	actionRun      = "run"
+	actionCompile  = "compile"
+	actionValidate = "validate"
+)
+
+const traceValgrind = "valgrind"
+
+const emitAsm = "asm"
+
+// Phases of an execution, reported in the phase field of the responses. The failed one, or phaseComplete when nothing
+// failed
+const (
+	phaseCompile  = "compile"
+	phaseLink     = "link"
+	phaseRun      = "run"
+	phaseComplete = "complete"
+)
+
+// compileOnly reports whether the request only compiles the code, only checks its syntax or only generates its
+// assembly
+func (er ExecRequest) compileOnly() bool {
+	action := strings.TrimSpace(er.Action)
+	return action == actionCompile || action == actionValidate || er.assembly()
+}
+
+// assembly reports whether the request asks for the generated assembly
+func (er ExecRequest) assembly() bool {
+	return strings.TrimSpace(er.Emit) == emitAsm
+}
+
+// syntaxOnly reports whether the request only checks the syntax of the code
+func (er ExecRequest) syntaxOnly() bool {
+	return strings.TrimSpace(er.Action) == actionValidate
+}
+
+// traced reports whether the program is traced, which needs the debug information of the compilation. Batches with
+// CompileOnce only run it
+func (er ExecRequest) traced() bool {
+	return !er.compileOnly() && len(er.inputs) == 0
+}
+
+// valgrindTrace reports whether the request asks for the raw trace of valgrind instead of the parsed one
+func (er ExecRequest) valgrindTrace() bool {
+	return strings.TrimSpace(er.Trace) == traceValgrind
+}
+
+// newJobListener returns a listener that passes the result of a job's task to the channel
+func newJobListener(result chan<- jobResult) func(j *tork.Job) {
+	// Only the first result matters. A non-blocking send guarantees the engine's event goroutine is never leaked,
+	// even if the event is delivered again after the handler returned
+	send := func(r jobResult) {
+		select {
+		case result <- r:
+		default:
+		}
+	}
+
+	return func(j *tork.Job) {
+		// The job can fail before any task was executed, e.g. when it couldn't be scheduled
+		if len(j.Execution) == 0 {
+			send(jobResult{output: j.Error, failed: true, noExecution: true})
+			return
+		}
+		if j.State == tork.JobStateCompleted {
+			send(jobResult{output: j.Execution[0].Result})
+		} else {
+			send(jobResult{output: j.Execution[0].Error, failed: true})
+		}
+	}
+}
+
+// Non-standard status (from nginx) for requests whose client went away before the response was sent
+const statusClientClosedRequest = 499
+
+// jobResult is what the job listener passes back to the handler
+type jobResult struct {
+	// Task result, or its error if it failed
+	output string
+	failed bool
+	// The job finished without executing its task, so output holds the job's error
+	noExecution bool
+}
 
 func Handler(c web.Context) error {
+	return execute(c, "")
+}
+
+// Validate only checks the syntax of the code, which is faster than compiling it, e.g. for the diagnostics of an
+// editor
+func Validate(c web.Context) error {
+	return execute(c, actionValidate)
+}
+
+// execute runs the request. A non-empty action replaces the one of the request
+func execute(c web.Context, action string) error {
+	start := time.Now()
+	logger := requestLogger(c)
 	er := ExecRequest{}
 
-	if err := c.Bind(&er); err != nil {
-		c.Error(http.StatusBadRequest, errors.Wrapf(err, "error binding request"))
-		return nil
+	if apiErr := bindJSON(c, &er); apiErr != nil {
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+	c.Set(languageKey, er.Language)
+	if action != "" {
+		er.Action = action
 	}
 
-	er.Input = strings.TrimSpace(er.Input)
-	if !sanitizeInput(er.Input) {
-		log.Debug().Msgf("invalid_input: \"%s\"", er.Input)
-		return c.JSON(http.StatusBadRequest, map[string]string{"message": "invalid_input"})
+	if apiErr := checkRequest(logger, &er); apiErr != nil {
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
 	}
 
-	log.Debug().Msgf("%s", er.Code)
+	logger.Debug().Msg(logPrefix(er.Code))
 
-	task, err := buildTask(er)
-	if err != nil {
-		c.Error(http.StatusBadRequest, err)
-		return nil
+	async, _ := strconv.ParseBool(c.Request().URL.Query().Get("async"))
+	// The result of async executions is fetched later, so they aren't bound to this request
+	ctx := c.Request().Context()
+	if async {
+		ctx = context.Background()
 	}
 
-	result := make(chan string)
-
-	listener := func(j *tork.Job) {
-		if j.State == tork.JobStateCompleted {
-			result <- j.Execution[0].Result
-		} else {
-			result <- j.Execution[0].Error
-		}
+	task, err := buildTask(ctx, er, config)
+	if err != nil {
+		apiErr := taskError(logger, err)
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
 	}
 
 	inputN := &input.Job{
@@ -60,194 +210,1640 @@ func Handler(c web.Context) error {
 		Tasks: []input.Task{task},
 	}
 
-	job, err := engine.SubmitJob(c.Request().Context(), inputN, listener)
+	key := cacheKey(er)
+
+	if async {
+		// The same request run synchronously isn't the same call, it gets another response
+		c, finish, ok, err := beginIdempotentCall(c, logger, key+"\nasync")
+		if !ok {
+			return err
+		}
+		defer finish()
+		return submitAsync(c, logger, er, key, inputN, start)
+	}
+
+	if status, body, ok := results.get(key); ok {
+		logger.Debug().Msg("serving a cached result")
+		observeExecution(er.Language, start, status, body)
+		return c.JSON(status, body)
+	}
+
+	c, finish, ok, err := beginIdempotentCall(c, logger, key)
+	if !ok {
+		return err
+	}
+	defer finish()
+
+	// Buffered, so the listener doesn't block when the handler already returned (e.g. the client disconnected)
+	result := make(chan jobResult, 1)
+
+	listener := newJobListener(result)
+
+	// Held until the result arrives or the client goes away, whichever happens first
+	release, ok := acquireExecution(er.Language)
+	if !ok {
+		c.Response().Header().Set("Retry-After", "1")
+		apiErr := serverBusyError()
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+	defer release()
+
+	job, err := submitJob(c.Request().Context(), inputN, listener)
 
 	if err != nil {
-		c.Error(http.StatusBadRequest, errors.Wrapf(err, "error executing code"))
-		return nil
+		logger.Error().Err(err).Msg("error submitting the job")
+		apiErr := engineUnavailableError()
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
 	}
 
-	log.Debug().Msgf("job %s submitted", job.ID)
+	logger.Debug().Msgf("job %s submitted", job.ID)
 
 	select {
-	case r := <-result:
-		if debug_valgrind {
-			return c.JSON(http.StatusOK, r)
-		} else {
-			// Define the regex pattern with the filename "usercode.c"
-			pattern := `usercode(.c|.cpp):(\d+):(\d+):.+?(error:.*)`
+	case res := <-result:
+		status, body, err := executionResponse(logger, er, res)
+		if err != nil {
+			logger.Error().Err(err).Msgf("error building the result of job %s", job.ID)
+			apiErr := unreadableResultError()
+			return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+		}
+		results.put(key, status, body)
+		observeExecution(er.Language, start, status, body)
+		return c.JSON(status, body)
+
+	case <-c.Done():
+		if c.Request().Context().Err() != nil {
+			logger.Debug().Msg("client disconnected before the execution finished")
+			return respondError(c, statusClientClosedRequest, CodeClientDisconnected, "the client went away")
+		}
+		// The engine is terminating and won't report the result anymore
+		logger.Debug().Msg("server shut down before the execution finished")
+		return respondError(c, http.StatusServiceUnavailable, CodeServerShuttingDown, "the server is shutting down")
+	}
+}
+
+// bindJSON decodes the JSON body of the request into v
+func bindJSON(c web.Context, v any) *apiError {
+	if !isJSON(c.Request().Header.Get("Content-Type")) {
+		return &apiError{Status: http.StatusUnsupportedMediaType, Code: CodeUnsupportedMediaType, Message: "the request body must be JSON"}
+	}
+
+	// Limits what's read while binding, so a huge body fails fast instead of being held in memory
+	req := c.Request()
+	if req.ContentLength > int64(config.MaxBodyBytes) {
+		return bodyTooLargeError()
+	}
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, int64(config.MaxBodyBytes))
+
+	switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return invalidGzipError(err)
+		}
+		defer gz.Close()
+		// The decompressed body is limited too, a small compressed body can expand to gigabytes
+		req.Body = http.MaxBytesReader(c.Response(), gz, int64(config.MaxBodyBytes))
+	default:
+		return &apiError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    CodeUnsupportedEncoding,
+			Message: fmt.Sprintf("the request body can't be encoded with %s, only gzip is supported", encoding),
+		}
+	}
+
+	// Unknown fields are ignored, so older servers accept requests of newer clients, unless the server is strict
+	var err error
+	if config.StrictJSON {
+		err = decodeStrict(req.Body, v)
+	} else {
+		err = c.Bind(v)
+	}
+	if err != nil {
+		return bindError(err)
+	}
+	return nil
+}
+
+// bindError returns the error of a request whose body couldn't be decoded
+func bindError(err error) *apiError {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return bodyTooLargeError()
+	}
+	var corruptErr flate.CorruptInputError
+	if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &corruptErr) {
+		return invalidGzipError(err)
+	}
+	if field, ok := strings.CutPrefix(err.Error(), unknownFieldPrefix); ok {
+		return &apiError{Status: http.StatusBadRequest, Code: CodeUnknownField, Message: "unknown field " + field}
+	}
+	return &apiError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: errors.Wrapf(err, "error binding request").Error()}
+}
+
+// unknownFieldPrefix starts the error of encoding/json for a field that isn't in the struct, followed by its quoted
+// name. The package has no typed error for it
+const unknownFieldPrefix = "json: unknown field "
+
+// decodeStrict decodes the JSON body like c.Bind, but fails on fields that aren't in v
+func decodeStrict(body io.Reader, v any) error {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	// An empty body binds nothing, like with c.Bind
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func invalidGzipError(err error) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: CodeInvalidGzip, Message: errors.Wrapf(err, "error decompressing request").Error()}
+}
+
+func bodyTooLargeError() *apiError {
+	return &apiError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    CodeBodyTooLarge,
+		Message: fmt.Sprintf("the request body is larger than %d bytes", config.MaxBodyBytes),
+	}
+}
+
+// checkRequest normalizes the request and checks what can be checked before building its task
+func checkRequest(logger zerolog.Logger, er *ExecRequest) *apiError {
+	// Code pasted on Windows has CRLF line endings, which shift the columns reported by the parser
+	er.Code = normalizeNewlines(er.Code)
+	er.Input = normalizeNewlines(er.Input)
+	for name, content := range er.Files {
+		er.Files[name] = normalizeNewlines(content)
+	}
+
+	// Checked before anything else, so obviously incomplete requests never reach the engine
+	if strings.TrimSpace(er.Code) == "" {
+		return &apiError{Status: http.StatusBadRequest, Code: CodeEmptyCode, Message: "the code is empty"}
+	}
+	if strings.TrimSpace(er.Language) == "" {
+		return &apiError{Status: http.StatusBadRequest, Code: CodeEmptyLanguage, Message: "the language is missing"}
+	}
+
+	// Count bytes, not characters, since that is what reaches the compiler
+	codeBytes := len(er.Code)
+	for _, content := range er.Files {
+		codeBytes += len(content)
+	}
+	if codeBytes > config.MaxCodeBytes {
+		return &apiError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeCodeTooLarge,
+			Message: fmt.Sprintf("the code is larger than %d bytes", config.MaxCodeBytes),
+		}
+	}
+	if inputTooLarge(er.Input) || inputTooLarge(er.Stdin) {
+		return inputTooLargeError()
+	}
+
+	if len(er.Args) > maxArgs || len(programArgs(*er)) > maxArgsBytes {
+		return &apiError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeArgsTooLarge,
+			Message: fmt.Sprintf("the arguments are more than %d or larger than %d bytes", maxArgs, maxArgsBytes),
+		}
+	}
+	for _, arg := range er.Args {
+		// The arguments are passed one per line
+		if strings.ContainsAny(arg, "\n\x00") {
+			return &apiError{Status: http.StatusBadRequest, Code: CodeInvalidArgs, Message: "the arguments can't have newlines"}
+		}
+	}
+
+	if construct, ok := forbiddenConstruct(*er, config); ok {
+		logger.Debug().Msgf("forbidden_construct: %q", construct)
+		return &apiError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeForbiddenConstruct,
+			Message: fmt.Sprintf("the code uses a forbidden construct: %s", construct),
+		}
+	}
+
+	er.Input = strings.TrimSpace(er.Input)
+	if !sanitizeInput(er.Input) {
+		logger.Debug().Msgf("invalid_input: \"%s\"", er.Input)
+		return &apiError{Status: http.StatusBadRequest, Code: CodeInvalidInput, Message: "the input may only have words and numbers"}
+	}
+	return nil
+}
+
+// inputTooLarge reports whether a program input is over the configured limits
+func inputTooLarge(input string) bool {
+	return len(input) > config.MaxInputBytes || (config.MaxInputLines > 0 && countLines(input) > config.MaxInputLines)
+}
+
+// countLines returns the number of lines of s. The last one doesn't need to end with a newline
+func countLines(s string) int {
+	lines := strings.Count(s, "\n")
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		lines++
+	}
+	return lines
+}
+
+func inputTooLargeError() *apiError {
+	message := fmt.Sprintf("the input is larger than %d bytes", config.MaxInputBytes)
+	if config.MaxInputLines > 0 {
+		message += fmt.Sprintf(" or has more than %d lines", config.MaxInputLines)
+	}
+	return &apiError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    CodeInputTooLarge,
+		Message: message,
+	}
+}
+
+// Bounds of the program's arguments, in number and in total bytes
+const (
+	maxArgs      = 32
+	maxArgsBytes = 4 * 1024
+)
+
+// Maximum number of files returned by a request. Each one can be as large as the output
+const maxCaptureFiles = 8
+
+// forbiddenConstruct returns the first match of the forbidden patterns in the code or the extra files
+func forbiddenConstruct(er ExecRequest, cfg Config) (string, bool) {
+	sources := []string{er.Code}
+	for _, content := range er.Files {
+		sources = append(sources, content)
+	}
+	for _, re := range cfg.ForbiddenPatterns {
+		for _, source := range sources {
+			if match := re.FindString(source); match != "" {
+				return match, true
+			}
+		}
+	}
+	return "", false
+}
+
+// engineUnavailableError is the error of a job the engine didn't accept. It's a failure of the server, not of the
+// request, so it may succeed if retried
+func engineUnavailableError() *apiError {
+	return &apiError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeEngineUnavailable,
+		Message: "the code couldn't be executed, try again later",
+	}
+}
+
+// unreadableResultError is the error of an execution whose result couldn't be turned into a response
+func unreadableResultError() *apiError {
+	return &apiError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeUnknownError,
+		Message: "the result of the execution couldn't be read",
+	}
+}
+
+// taskError returns the error of a request whose task couldn't be built
+func taskError(logger zerolog.Logger, err error) *apiError {
+	logger.Debug().Msg(err.Error())
+	code := CodeInvalidRequest
+	switch {
+	case errors.Is(err, errInvalidFilename):
+		code = CodeInvalidFilename
+	case errors.Is(err, errLanguageDisabled):
+		code = CodeLanguageDisabled
+	case errors.Is(err, errInvalidTimeout):
+		code = CodeInvalidTimeout
+	case errors.Is(err, errFlagNotAllowed):
+		code = CodeFlagNotAllowed
+	case errors.Is(err, errUnknownParserVersion):
+		code = CodeUnknownParserVersion
+	case errors.Is(err, errEnvNotAllowed):
+		code = CodeEnvNotAllowed
+	}
+	return &apiError{Status: http.StatusBadRequest, Code: code, Message: err.Error()}
+}
+
+// executionResponse returns the status and body of the response to the result of an execution
+func executionResponse(logger zerolog.Logger, er ExecRequest, res jobResult) (int, any, error) {
+	status, body, err := executionResult(logger, er, res)
+	// The script only reports the command when the server runs with execution.debug, which is never on in production
+	if err == nil && config.Debug {
+		if _, metadata := splitMetadata(res.output); metadata["compile_command"] != "" {
+			debug := map[string]string{"compile_command": sanitizeErrorPaths(metadata["compile_command"])}
+			switch data := body.(type) {
+			case map[string]interface{}:
+				data["debug"] = debug
+			case *traceResult:
+				data.Debug = debug
+			}
+		}
+	}
+	return status, body, err
+}
+
+// executionResult interprets the output of the task
+func executionResult(logger zerolog.Logger, er ExecRequest, res jobResult) (int, any, error) {
+	r := res.output
 
-			// Compile the regular expression
-			re := regexp.MustCompile(pattern)
+	if res.noExecution {
+		logger.Error().Msgf("job finished without an execution: %s", r)
+		return http.StatusInternalServerError,
+			newErrorBody(http.StatusInternalServerError, CodeNoExecutionResult, "the code couldn't be executed"), nil
+	}
+
+	// The task ran longer than its timeout and was stopped by the engine
+	if res.failed && strings.Contains(r, context.DeadlineExceeded.Error()) {
+		logger.Debug().Msg("execution timed out")
+		// Validated when the task was built. The deadline of the request isn't known anymore, so this is the
+		// longest the timeout could have been
+		lang, _ := findLanguage(er.Language)
+		timeout, _ := requestTimeout(context.Background(), er, lang.limits(config))
+		d, _ := time.ParseDuration(timeout)
+		return http.StatusGatewayTimeout, newTimeoutBody(int(d.Seconds()), "", ""), nil
+	}
+
+	// The kernel killed the container for exceeding its memory limit
+	if res.failed && strings.HasPrefix(r, "exit code "+strconv.Itoa(exitCodeKilled)) {
+		logger.Debug().Msg("execution ran out of memory")
+		return http.StatusBadRequest, newOutOfMemoryRet(er.Code), nil
+	}
+
+	if er.valgrindTrace() {
+		return http.StatusOK, r, nil
+	} else {
+		// clang reports errors in the same format as gcc
+		handleCompilerError := handleGccError
 
-			// Check if the regex matches the input string
-			isMatch := re.MatchString(r)
+		lang, _ := findLanguage(er.Language)
+
+		// rustc diagnostics have a different layout ("error[E0425]: ..." followed by " --> file:line:col")
+		if isRust(er.Language) {
+			handleCompilerError = handleRustcError
+		}
 
-			var jsonData map[string]interface{}
-			if !isMatch {
-				if err := json.Unmarshal([]byte(r), &jsonData); err != nil {
-					log.Debug().Msgf("unknown_json_parsing_error: %s", err.Error())
-					log.Debug().Msg(r)
-					return c.JSON(http.StatusBadRequest, map[string]string{"message": "unknown_error"})
+		r, metadata := splitMetadata(r)
+
+		stdoutTruncated, stderrTruncated, traceTruncated := truncatedOutputs(metadata["truncated"])
+		if stdoutTruncated {
+			metadata["stdout"] = trimPartialRune(metadata["stdout"]) + truncationMarker
+		}
+		// The program's own messages, e.g. of perror(). The tracebacks of Python have the paths of the files
+		stderr := sanitizeErrorPaths(metadata["stderr"])
+		if stderrTruncated {
+			stderr = trimPartialRune(stderr) + truncationMarker
+		}
+
+		// The program didn't finish before its deadline, but what it printed until then is kept
+		if metadata["timed_out"] != "" {
+			logger.Debug().Msg("program timed out")
+			// The value is how long the program was allowed to run, in seconds
+			seconds, _ := strconv.Atoi(metadata["timed_out"])
+			return http.StatusGatewayTimeout, newTimeoutBody(seconds, metadata["stdout"], stderr), nil
+		}
+
+		// Only the program was killed for exceeding the memory limit, the rest of the container survived
+		if metadata["exit_code"] == strconv.Itoa(exitCodeKilled) {
+			logger.Debug().Msg("program ran out of memory")
+			ret := newOutOfMemoryRet(er.Code)
+			ret.Stdout = metadata["stdout"]
+			ret.Stderr = stderr
+			return http.StatusBadRequest, ret, nil
+		}
+
+		// The output is the compiler's errors only when the compilation failed, which the script reports. Otherwise
+		// it's the parser's JSON, whatever the exit code of the program was, and what the program printed can't be
+		// mistaken for compiler errors
+		compileFailed := metadata["compile_failed"] != ""
+
+		var jsonData map[string]interface{}
+		// Nothing ran, so the output only has the warnings
+		if !compileFailed && er.assembly() {
+			return http.StatusOK, map[string]interface{}{
+				"event": "assembled",
+				// The directives have the paths of the sources, e.g. .file "/tmp/user_code/job.Ab12Cd/usercode.c"
+				"assembly": sanitizeErrorPaths(metadata["assembly"]),
+				"warnings": parseGccWarnings(er.Code, metadata["warning"]),
+				"phase":    phaseComplete,
+			}, nil
+		}
+		if !compileFailed && er.syntaxOnly() {
+			return http.StatusOK, map[string]interface{}{
+				"event":    "valid",
+				"errors":   []ErrorMsg{},
+				"warnings": parseGccWarnings(er.Code, metadata["warning"]),
+				"phase":    phaseComplete,
+			}, nil
+		}
+		if !compileFailed && er.compileOnly() {
+			return http.StatusOK, map[string]interface{}{
+				"event":    "compiled",
+				"warnings": parseGccWarnings(er.Code, metadata["warning"]),
+				"phase":    phaseComplete,
+			}, nil
+		}
+		// A truncated trace isn't valid JSON, but what the program printed is still worth showing
+		if !compileFailed && traceTruncated {
+			logger.Debug().Msg("trace truncated")
+			body := map[string]interface{}{
+				"code":  er.Code,
+				"trace": []interface{}{},
+				"error": ErrorMsg{
+					Event:        "runtime",
+					ExceptionMsg: fmt.Sprintf("the trace is larger than %d bytes and can't be shown", config.MaxOutputBytes),
+				},
+				"stdout":    metadata["stdout"],
+				"stderr":    stderr,
+				"truncated": true,
+				"phase":     phaseRun,
+			}
+			if len(er.CaptureFiles) > 0 {
+				body["files"] = capturedFiles(er, metadata)
+			}
+			return http.StatusOK, body, nil
+		}
+		if !compileFailed {
+			// The parser crashed, e.g. with a traceback, which is a bug of the server, so its whole output is kept
+			result, err := parseTrace(r)
+			if err != nil {
+				logger.Error().Err(err).Str("output", r).Msg("the parser's output isn't a trace")
+				return http.StatusInternalServerError,
+					newErrorBody(http.StatusInternalServerError, CodeParserError, "the trace of the program couldn't be generated"), nil
+			}
+			result.Warnings = parseGccWarnings(er.Code, metadata["warning"])
+			result.Stdout = metadata["stdout"]
+			result.Stderr = stderr
+			if len(er.CaptureFiles) > 0 {
+				result.Files = capturedFiles(er, metadata)
+			}
+			// The program ran to the end, whatever its exit code was, unless an error is found below
+			result.Phase = phaseComplete
+			result.Truncated = stdoutTruncated || stderrTruncated
+			sanitizeTracePaths(result.Trace)
+			if exitCode, err := strconv.Atoi(metadata["exit_code"]); err == nil {
+				result.ExitCode = &exitCode
+				if signal, ok := exitSignal(exitCode); ok {
+					result.ExitSignal = signal
 				}
-				return c.JSON(http.StatusOK, jsonData)
-			} else {
-				err := json.Unmarshal([]byte(handleGccError(er.Code, r)), &jsonData)
-				if err != nil {
-					return err
+				// The trace is still returned, so the steps up to the crash can be shown
+				if assertion, ok := assertionError(metadata["assertion"]); ok {
+					// Assertions of the extra files have lines of those files
+					if strings.HasPrefix(assertion.File, "usercode.") {
+						assertion = assertion.withSnippet(er.Code)
+					}
+					result.Error = &assertion
+					result.Errors = []ErrorMsg{assertion}
+					result.Phase = phaseRun
+				} else if crash, ok := crashError(exitCode, result.Trace); ok {
+					crash = crash.withSnippet(er.Code)
+					result.Error = &crash
+					result.Errors = []ErrorMsg{crash}
+					result.Phase = phaseRun
 				}
-				return c.JSON(http.StatusBadRequest, jsonData)
 			}
-
+			// Errors of interpreted languages, even syntax errors, are only found when the program runs
+			if lang.interpreted {
+				if uncaught, ok := uncaughtException(result.Trace); ok {
+					uncaught = uncaught.withSnippet(er.Code)
+					result.Error = &uncaught
+					result.Errors = []ErrorMsg{uncaught}
+					// Python is compiled right before it runs, so its syntax errors are still compile errors
+					result.Phase = phaseRun
+					if uncaught.Event == "syntax" {
+						result.Phase = phaseCompile
+					}
+				}
+			}
+			if elapsed, err := strconv.ParseFloat(metadata["elapsed_s"], 64); err == nil {
+				elapsedMs := int(elapsed * 1000)
+				result.ElapsedMs = &elapsedMs
+			}
+			if maxRSS, err := strconv.Atoi(metadata["max_rss_kb"]); err == nil {
+				result.MaxRSSKb = &maxRSS
+			}
+			return http.StatusOK, result, nil
+		} else {
+			err := json.Unmarshal([]byte(handleCompilerError(er.Code, r)), &jsonData)
+			if err != nil {
+				return 0, nil, err
+			}
+			return http.StatusBadRequest, jsonData, nil
 		}
 
-	case <-c.Done():
-		return c.JSON(http.StatusGatewayTimeout, map[string]string{"message": "timeout"})
 	}
 }
 
+// Bytes of the code and outputs that are logged. The rest would flood the logs
+const maxLoggedBytes = 500
+
+// logPrefix returns the start of s to be logged, noting how much was left out
+func logPrefix(s string) string {
+	if len(s) <= maxLoggedBytes {
+		return s
+	}
+	end := maxLoggedBytes
+	// Not in the middle of a character
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + fmt.Sprintf("... (%d more bytes)", len(s)-end)
+}
+
+// normalizeNewlines converts CRLF and lone CR line endings to LF
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+}
+
+// isJSON reports whether the content type is application/json, whatever its parameters (e.g. charset) are
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// Characters never accepted in the input, whatever the configured separators are
+const forbiddenInputChars = "`$;&|<>\\\"'(){}"
+
+// sanitizeInput accepts words and numbers (signed, decimal or in scientific notation, e.g. "-42" or "3.14e5"),
+// separated by whitespace or by one of the configured separators
 func sanitizeInput(input string) bool {
-	re := regexp.MustCompile(`^(([\p{Latin}\p{N}]*|\p{N}+[.,]\p{N}+)[\s\n]*)*$`)
-	return re.MatchString(input)
+	if strings.ContainsAny(input, forbiddenInputChars) {
+		return false
+	}
+	return config.inputPattern.MatchString(input)
 }
 
-func buildTask(er ExecRequest) (input.Task, error) {
-	var image string
-	var run string
-	var filename string
-	var compiler string
-	var language string
+// inputPattern is the pattern of sanitizeInput, compiled once per configuration instead of once per request
+func inputPattern(inputSeparators string) string {
+	separators := ""
+	for _, r := range inputSeparators {
+		separators += `\` + string(r)
+	}
+	return `^(([\p{Latin}\p{N}]*|[+-]?\p{N}+([.,]\p{N}+)?([eE][+-]?\p{N}+)?)[\s\n` + separators + `]*)*$`
+}
 
-	image = "gcc-compiler:latest"
+func isRust(language string) bool {
+	lang, ok := findLanguage(language)
+	return ok && lang.ID == "rust"
+}
 
-	switch strings.TrimSpace(er.Language) {
-	case "":
-		return input.Task{}, errors.Errorf("require: language")
-	case "c++":
-		compiler = "g++"
-		filename = "usercode.cpp"
-		language = "c++"
+func buildTask(ctx context.Context, er ExecRequest, cfg Config) (input.Task, error) {
+	if err := validateLimits(cfg); err != nil {
+		return input.Task{}, err
+	}
 
-	case "c":
-		compiler = "gcc"
-		filename = "usercode.c"
-		language = "c"
+	var run string
 
-	default:
+	if strings.TrimSpace(er.Language) == "" {
+		return input.Task{}, errors.Errorf("require: language")
+	}
+	lang, ok := findLanguage(er.Language)
+	if !ok {
 		return input.Task{}, errors.Errorf("unknown language: %s", er.Language)
 	}
+	if !lang.enabled(cfg) {
+		return input.Task{}, languageDisabledError{language: lang.ID, message: cfg.DisabledMessages[lang.ID]}
+	}
+	cfg = lang.limits(cfg)
+
+	compiler, ok := lang.compiler(strings.TrimSpace(er.Compiler))
+	if !ok {
+		return input.Task{}, errors.Errorf("unknown compiler for %s: %s", lang.ID, er.Compiler)
+	}
+	image := lang.image(cfg, compiler)
+	if action := strings.TrimSpace(er.Action); action != "" && action != actionRun && action != actionCompile &&
+		action != actionValidate {
+		return input.Task{}, errors.Errorf("unknown action: %s", er.Action)
+	}
+	if trace := strings.TrimSpace(er.Trace); trace != "" && trace != traceValgrind {
+		return input.Task{}, errors.Errorf("unknown trace: %s", er.Trace)
+	}
+	if er.valgrindTrace() && (!cfg.ValgrindTrace || er.compileOnly() || lang.interpreted) {
+		return input.Task{}, errors.Errorf("valgrind trace not available")
+	}
+	if er.compileOnly() && lang.interpreted {
+		return input.Task{}, errors.Errorf("%s is not compiled", lang.ID)
+	}
+	filename := "usercode" + lang.Ext
+	parserMode := lang.parser()
+	compileFlags := lang.compileFlags
+	if cfg.FastCompile && !er.traced() {
+		compileFlags = lang.fastCompileFlags
+	}
+	inputFilename := "programInput.txt"
+	argsFilename := "programArgs.txt"
+
+	compilerOutput := workDir + "/compiler_output.txt"
+	timeOutput := workDir + "/time_output.txt"
+	stdoutOutput := workDir + "/stdout.txt"
+	traceOutput := workDir + "/trace.json"
+	stderrOutput := workDir + "/stderr.txt"
+	// Written by the parser, which also writes the program's output to stdoutOutput and stderrOutput
+	exitOutput := workDir + "/exit_code.txt"
+	valgrindLog := workDir + "/valgrind.log"
+
+	timeout, err := requestTimeout(ctx, er, cfg)
+	if err != nil {
+		return input.Task{}, err
+	}
+
+	// Placed after the sources, since libraries must come after the objects that use them
+	extraFlags := ""
+	for _, flag := range er.Flags {
+		flag = strings.TrimSpace(flag)
+		if !lang.extraFlags || !slices.Contains(cfg.AllowedFlags, flag) {
+			return input.Task{}, errors.Wrapf(errFlagNotAllowed, "%s for %s", flag, lang.ID)
+		}
+		extraFlags += " " + flag
+	}
+
+	if standard := strings.TrimSpace(er.Standard); standard != "" {
+		if !lang.supportsStandard(standard) {
+			return input.Task{}, errors.Errorf("unknown standard for %s: %s", lang.ID, standard)
+		}
+		compileFlags += " -std=" + standard
+	}
+	if level := strings.TrimSpace(er.Optimization); level != "" {
+		flag, ok := lang.optimizationFlags[level]
+		if !ok {
+			return input.Task{}, errors.Errorf("unknown optimization for %s: %s", lang.ID, level)
+		}
+		// Placed after the flags of the language, so it replaces their -O0
+		if !er.traced() {
+			compileFlags += " " + flag
+		}
+	}
+	output := workDir + "/usercode"
+	if emit := strings.TrimSpace(er.Emit); emit != "" && emit != emitAsm {
+		return input.Task{}, errors.Errorf("unknown emit: %s", er.Emit)
+	}
+	if er.assembly() {
+		if lang.asmFlags == "" || er.syntaxOnly() {
+			return input.Task{}, errors.Errorf("assembly not available for %s", lang.ID)
+		}
+		compileFlags += " " + lang.asmFlags
+		output = workDir + "/usercode.s"
+	}
+	if er.syntaxOnly() {
+		if lang.syntaxOnlyFlags == "" {
+			return input.Task{}, errors.Errorf("%s has no syntax check", lang.ID)
+		}
+		compileFlags += " " + lang.syntaxOnlyFlags
+	}
+
+	files := map[string]string{
+		filename:      er.Code,
+		inputFilename: programInput(er),
+		argsFilename:  programArgs(er),
+	}
+	if len(er.inputs) > 0 && (er.compileOnly() || er.valgrindTrace() || er.stream) {
+		return input.Task{}, errors.Errorf("inputs can't be run with this action")
+	}
+	for i, in := range er.inputs {
+		files[runInputFilename(i)] = in
+	}
+	sources := workDir + "/" + filename
+
+	// Every job gets a fresh directory, removed however the script ends, so jobs running in the same container never
+	// see each other's files
+	run = "mkdir -p " + cfg.WorkDir + "; workdir=$(mktemp -d " + cfg.WorkDir + "/" + jobDirPrefix + "XXXXXX) || exit 1; " +
+		"trap 'rm -rf " + workDir + "' EXIT; "
 
-	run =
 	// Move file
-		"mv " + filename + " /tmp/user_code/" + filename + "; " +
+	run += "mv " + filename + " " + workDir + "/" + filename + "; "
+
+	// Extra files are sorted, so the command is the same for the same request
+	extraFiles := make([]string, 0, len(er.Files))
+	for name := range er.Files {
+		extraFiles = append(extraFiles, name)
+	}
+	sort.Strings(extraFiles)
 
-			// Create file with the user input in the same directory of the program source file
-			"echo \"" + er.Input + "\" > /tmp/user_code/programInput.txt; " +
+	for _, name := range extraFiles {
+		if err := validateFilename(name); err != nil {
+			return input.Task{}, err
+		}
+		if _, ok := files[name]; ok || strings.HasPrefix(name, "usercode") ||
+			name == path.Base(compilerOutput) || name == path.Base(timeOutput) ||
+			name == path.Base(stdoutOutput) || name == path.Base(traceOutput) || name == path.Base(stderrOutput) ||
+			name == path.Base(exitOutput) || name == path.Base(valgrindLog) {
+			return input.Task{}, errors.Errorf("reserved filename: %s", name)
+		}
+		files[name] = er.Files[name]
+		run += "mv " + name + " " + workDir + "/" + name + "; "
+		// A single assembly file is generated, so only the main file is compiled
+		if lang.multipleSources && strings.HasSuffix(name, lang.Ext) && !er.assembly() {
+			sources += " " + workDir + "/" + name
+		}
+	}
 
-			// Compile user code without warnings (-w). stderr output is passed to TORK_OUTPUT (in case of compiling error)
-			compiler + " -w -ggdb -O0 -fno-omit-frame-pointer -o /tmp/user_code/usercode /tmp/user_code/" + filename + " 2> $TORK_OUTPUT; " +
+	// Every file the task receives must stay inside its directory
+	for name := range files {
+		if err := validateFilename(name); err != nil {
+			return input.Task{}, err
+		}
+	}
+	if len(er.CaptureFiles) > maxCaptureFiles {
+		return input.Task{}, errors.Errorf("more than %d files to capture", maxCaptureFiles)
+	}
+	for _, name := range er.CaptureFiles {
+		if err := validateCapturePath(name); err != nil {
+			return input.Task{}, err
+		}
+	}
 
-			// If the TORK_OUTPUT is not empty, i.e., an error happened, do nothing
-			"[ -s \"${TORK_OUTPUT}\" ] || "
+	// Move the file with the user input to the same directory of the program source file.
+	// It is passed as a file, not through the shell, so its content is never interpreted by the shell
+	run += "mv " + inputFilename + " " + workDir + "/" + inputFilename + "; "
+	for i := range er.inputs {
+		run += "mv " + runInputFilename(i) + " " + workDir + "/" + runInputFilename(i) + "; "
+	}
+	// The arguments are read into the positional parameters, one per line, so "$@" passes them untouched
+	run += "mv " + argsFilename + " " + workDir + "/" + argsFilename + "; " +
+		"set --; while IFS= read -r arg; do set -- \"$@\" \"$arg\"; done < " + workDir + "/" + argsFilename + "; "
 
-	run += "python3 /tmp/parser/wsgi_backend.py " + language + " > $TORK_OUTPUT"
+	program := workDir + "/usercode"
+	if lang.interpreted {
+		program = compiler + " " + workDir + "/" + filename
+	}
+	parserPath := cfg.ParserPath
+	if version := strings.TrimSpace(er.ParserVersion); version != "" {
+		if parserPath, ok = cfg.ParserVersions[version]; !ok {
+			return input.Task{}, errors.Wrap(errUnknownParserVersion, version)
+		}
+	}
+	// Both runs share this deadline, which leaves part of the task's timeout to report what happened
+	runTimeout := strconv.Itoa(programTimeoutSeconds(timeout))
+	maxOutput := strconv.Itoa(cfg.MaxOutputBytes)
+	// The engine ships the task's log while it runs, so following the file streams the output without changing it
+	streamStart, streamStop := "", ""
+	if er.stream {
+		streamStart = ": > " + stdoutOutput + "; tail -n +1 -f " + stdoutOutput + " 2> /dev/null & tailer=$!; "
+		streamStop = "kill $tailer; "
+	}
+	trace := ": > " + stdoutOutput + "; : > " + stderrOutput + "; " + streamStart +
+		// The program runs once, traced by the parser, which writes what it prints to stdoutOutput and stderrOutput as
+		// it goes, so it's kept even if the program crashes or is killed. Time and memory are measured on that run, so
+		// they include the overhead of valgrind
+		"PYTHONUNBUFFERED=1 /usr/bin/time -f \"" + metadataPrefix + "elapsed_s=%e\\n" + metadataPrefix + "max_rss_kb=%M\" -o " +
+		timeOutput + " timeout " + runTimeout + " python3 " + parserPath + " " + parserMode + " " + workDir + " > " + traceOutput +
+		"; ran=$?; " + streamStop +
+		// The parser exits with the exit code of the program, and writes it to exitOutput once the program ended. So
+		// timeout's 124 is only a timeout without it, and not a program that exited with 124
+		"if [ -f " + exitOutput + " ]; then status=$(cat " + exitOutput + "); elif [ $ran -eq 124 ]; then status=timeout; else status=$ran; fi; " +
+		"if [ $status = timeout ]; then echo \"" + metadataPrefix + "timed_out=" + runTimeout + "\" > $TORK_OUTPUT; " +
+		// Only the start of a huge trace is kept, it can't be read anyway. The trace of the parser ends with a newline,
+		// but not a truncated one
+		"else head -c " + maxOutput + " " + traceOutput + " > $TORK_OUTPUT; " +
+		"if [ $(wc -c < " + traceOutput + ") -gt " + maxOutput + " ]; then echo >> $TORK_OUTPUT; " +
+		"echo \"" + metadataPrefix + "truncated=trace\" >> $TORK_OUTPUT; fi; " +
+		"echo \"" + metadataPrefix + "exit_code=$status\" >> $TORK_OUTPUT; " +
+		"grep \"^" + metadataPrefix + "\" " + timeOutput + " >> $TORK_OUTPUT; fi; " +
+		// Failed assertions only print their message to stderr before aborting
+		"grep -m 1 \"Assertion .* failed\" " + stderrOutput + " | cut -c 1-1024 | sed 's/^/" + metadataPrefix + "assertion=/' >> $TORK_OUTPUT; " +
+		"head -c " + maxOutput + " " + stdoutOutput + " | sed 's/^/" + metadataPrefix + "stdout=/' >> $TORK_OUTPUT; " +
+		// The output may not end with a newline, which would join the next metadata to its last line
+		"echo >> $TORK_OUTPUT; " +
+		"if [ $(wc -c < " + stdoutOutput + ") -gt " + maxOutput + " ]; then echo \"" + metadataPrefix + "truncated=stdout\" >> $TORK_OUTPUT; fi; " +
+		"head -c " + maxOutput + " " + stderrOutput + " | sed 's/^/" + metadataPrefix + "stderr=/' >> $TORK_OUTPUT; " +
+		"echo >> $TORK_OUTPUT; " +
+		"if [ $(wc -c < " + stderrOutput + ") -gt " + maxOutput + " ]; then echo \"" + metadataPrefix + "truncated=stderr\" >> $TORK_OUTPUT; fi; "
+	// Checked after the run, so the files are the ones the traced program left
+	for i, name := range er.CaptureFiles {
+		index := strconv.Itoa(i)
+		trace += "if [ -f " + name + " ]; then echo \"" + metadataPrefix + "captured=" + index + "\" >> $TORK_OUTPUT; " +
+			"head -c " + maxOutput + " " + name + " | sed 's/^/" + metadataPrefix + "file." + index + "=/' >> $TORK_OUTPUT; " +
+			"echo >> $TORK_OUTPUT; " +
+			"if [ $(wc -c < " + name + ") -gt " + maxOutput + " ]; then echo \"" + metadataPrefix + "file_truncated=" + index + "\" >> $TORK_OUTPUT; fi; fi; "
+	}
+	if len(er.inputs) > 0 {
+		trace = runsScript(program, len(er.inputs), runTimeout, maxOutput, timeOutput, stdoutOutput, stderrOutput)
+	}
+	// A successful compilation may still have produced warnings
+	warnings := "sed 's/^/" + metadataPrefix + "warning=/' " + compilerOutput + " >> $TORK_OUTPUT; "
+
+	if lang.interpreted {
+		// Nothing to compile, errors in the source are reported by the parser
+		run += trace
+	} else {
+		// Compile user code. stderr output is kept to be reported as errors or warnings
+		compileCommand := compiler + " " + compileFlags + " -o " + output + " " + sources + extraFlags
+		run += "if " + compileCommand + " 2> " + compilerOutput + "; then "
+		if er.assembly() {
+			run += "head -c " + maxOutput + " " + output + " | sed 's/^/" + metadataPrefix + "assembly=/' >> $TORK_OUTPUT; " +
+				"echo >> $TORK_OUTPUT; " + warnings
+		} else if er.compileOnly() {
+			// Only the warnings are reported, the program is neither traced nor run
+			run += warnings
+		} else {
+			run += trace + warnings
+		}
+		// If the compilation failed, its errors are the output, marked so they're never confused with a trace
+		run += "else cat " + compilerOutput + " > $TORK_OUTPUT; echo >> $TORK_OUTPUT; echo \"" + metadataPrefix + "compile_failed=1\" >> $TORK_OUTPUT; fi"
+		// Reported last, since the output is overwritten before. Its parts never have quotes
+		if cfg.Debug {
+			run += "; echo '" + metadataPrefix + "compile_command=" + compileCommand + "' >> $TORK_OUTPUT"
+		}
+	}
+
+	if er.valgrindTrace() {
+		run += "; cat " + workDir + "/usercode.vgtrace > $TORK_OUTPUT"
+	}
 
-	if debug_valgrind {
-		run += "; cat /tmp/user_code/usercode.vgtrace > $TORK_OUTPUT"
+	env, err := programEnv(er, cfg)
+	if err != nil {
+		return input.Task{}, err
 	}
 
 	return input.Task{
 		Name:    "execute code",
 		Image:   image,
 		Run:     run,
-		Timeout: "20s",
+		Timeout: timeout,
 		Limits: &input.Limits{
-			CPUs:   "1",
-			Memory: "1000m",
-		},
-		Files: map[string]string{
-			filename: er.Code,
+			CPUs:   cfg.CPUs,
+			Memory: cfg.Memory,
 		},
+		Files: files,
+		Env:   env,
 	}, nil
 }
 
-// Helper function to safely convert string to integer
+// programEnv returns the environment variables of the task, the configured ones and the allowed ones of the request.
+// They're passed to the container by the engine, never through the shell
+func programEnv(er ExecRequest, cfg Config) (map[string]string, error) {
+	if len(cfg.Env) == 0 && len(er.Env) == 0 {
+		return nil, nil
+	}
+	env := make(map[string]string, len(cfg.Env)+len(er.Env))
+	for name, value := range cfg.Env {
+		env[name] = value
+	}
+	for name, value := range er.Env {
+		if !slices.Contains(cfg.AllowedEnv, name) {
+			return nil, errors.Wrap(errEnvNotAllowed, name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return nil, errors.Wrapf(errEnvNotAllowed, "%s has a NUL character", name)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// runInputFilename is the name of the file with the i-th input of a compiled-once batch
+func runInputFilename(i int) string {
+	return "programInput" + strconv.Itoa(i) + ".txt"
+}
+
+// runsScript returns the commands that run the program against each input, one after the other. The metadata of
+// each run is suffixed with the index of its input, e.g. "stdout.1". The runs share the deadline, and the ones that
+// don't start before it are timed out too
+func runsScript(program string, inputs int, runTimeout, maxOutput, timeOutput, stdoutOutput, stderrOutput string) string {
+	script := "deadline=$(( $(date +%s) + " + runTimeout + " )); "
+	for i := 0; i < inputs; i++ {
+		index := strconv.Itoa(i)
+		script += "remaining=$(( deadline - $(date +%s) )); ran=124; : > " + stdoutOutput + "; : > " + stderrOutput + "; " +
+			"if [ $remaining -gt 0 ]; then timeout $remaining stdbuf -o0 /usr/bin/time -f \"" + metadataPrefix + "elapsed_s." + index +
+			"=%e\\n" + metadataPrefix + "max_rss_kb." + index + "=%M\" -o " + timeOutput + " " + program + " \"$@\" < " + workDir + "/" +
+			runInputFilename(i) + " > " + stdoutOutput + " 2> " + stderrOutput + "; ran=$?; fi; " +
+			"if [ $ran -eq 124 ]; then echo \"" + metadataPrefix + "timed_out." + index + "=" + runTimeout + "\" >> $TORK_OUTPUT; " +
+			"else echo \"" + metadataPrefix + "exit_code." + index + "=$ran\" >> $TORK_OUTPUT; " +
+			"grep \"^" + metadataPrefix + "\" " + timeOutput + " >> $TORK_OUTPUT; fi; " +
+			"grep -m 1 \"Assertion .* failed\" " + stderrOutput + " | cut -c 1-1024 | sed 's/^/" + metadataPrefix + "assertion." + index + "=/' >> $TORK_OUTPUT; " +
+			"head -c " + maxOutput + " " + stdoutOutput + " | sed 's/^/" + metadataPrefix + "stdout." + index + "=/' >> $TORK_OUTPUT; " +
+			"echo >> $TORK_OUTPUT; " +
+			"if [ $(wc -c < " + stdoutOutput + ") -gt " + maxOutput + " ]; then echo \"" + metadataPrefix + "truncated." + index + "=stdout\" >> $TORK_OUTPUT; fi; " +
+			"head -c " + maxOutput + " " + stderrOutput + " | sed 's/^/" + metadataPrefix + "stderr." + index + "=/' >> $TORK_OUTPUT; " +
+			"echo >> $TORK_OUTPUT; " +
+			"if [ $(wc -c < " + stderrOutput + ") -gt " + maxOutput + " ]; then echo \"" + metadataPrefix + "truncated." + index + "=stderr\" >> $TORK_OUTPUT; fi; "
+	}
+	return script
+}
+
+// Names accepted for the files of a task. They're part of the Run command, so only plain names are accepted
+var filenamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+var errInvalidFilename = errors.New("invalid filename")
+
+// validateFilename rejects names that could escape the task's directory, i.e., paths, parent references and hidden
+// files, or that aren't safe to use in the Run command
+func validateFilename(name string) error {
+	if strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") || strings.HasPrefix(name, ".") ||
+		!filenamePattern.MatchString(name) {
+		return errors.Wrapf(errInvalidFilename, "%q", name)
+	}
+	return nil
+}
+
+// validateCapturePath rejects paths of files to capture that could be outside the working directory, i.e. absolute
+// paths and parent references, or that aren't safe to use in the Run command. Every part must be a valid filename
+func validateCapturePath(name string) error {
+	for _, part := range strings.Split(name, "/") {
+		if validateFilename(part) != nil {
+			return errors.Wrapf(errInvalidFilename, "%q", name)
+		}
+	}
+	return nil
+}
+
+// capturedFiles returns the contents of the files of CaptureFiles the program wrote, by path. The ones that don't
+// exist are left out
+func capturedFiles(er ExecRequest, metadata map[string]string) map[string]string {
+	files := make(map[string]string)
+	truncated := strings.Split(metadata["file_truncated"], "\n")
+	for _, index := range strings.Split(metadata["captured"], "\n") {
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(er.CaptureFiles) {
+			continue
+		}
+		content := metadata["file."+index]
+		if slices.Contains(truncated, index) {
+			content = trimPartialRune(content) + truncationMarker
+		}
+		files[er.CaptureFiles[i]] = content
+	}
+	return files
+}
+
+// programInput returns the content of the program's standard input
+func programInput(er ExecRequest) string {
+	if er.Stdin != "" {
+		return er.Stdin
+	}
+	// Keep the trailing newline that "echo" used to add, since scanf-based programs may expect it
+	return er.Input + "\n"
+}
+
+// programArgs returns the content of the file with the program's arguments, one per line
+func programArgs(er ExecRequest) string {
+	var args strings.Builder
+	for _, arg := range er.Args {
+		args.WriteString(arg + "\n")
+	}
+	return args.String()
+}
+
+// Prefix of the lines the Run script appends to the output to report data about the execution
+const metadataPrefix = "#hpw "
+
+// splitMetadata separates the metadata lines appended by the Run script from the actual output
+func splitMetadata(output string) (string, map[string]string) {
+	metadata := make(map[string]string)
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, metadataPrefix) {
+			lines = append(lines, line)
+			continue
+		}
+		key, value, _ := strings.Cut(strings.TrimPrefix(line, metadataPrefix), "=")
+		// A key may span several lines, like the compiler warnings
+		if previous, ok := metadata[key]; ok {
+			value = previous + "\n" + value
+		}
+		metadata[key] = value
+	}
+	return strings.Join(lines, "\n"), metadata
+}
+
+// truncationMarker is appended to the output of the program when it's larger than the configured maximum
+const truncationMarker = "\n[output truncated]"
+
+// trimPartialRune drops the start of a character cut off at the end of s, e.g. by truncating the output to a number
+// of bytes, so it doesn't turn into a replacement character
+func trimPartialRune(s string) string {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return s[:i]
+			}
+			break
+		}
+	}
+	return s
+}
+
+// truncatedOutputs returns which outputs of a run (stdout, stderr, trace) were larger than the configured maximum,
+// from its "truncated" metadata
+func truncatedOutputs(truncated string) (stdout bool, stderr bool, trace bool) {
+	for _, output := range strings.Split(truncated, "\n") {
+		switch output {
+		case "stdout":
+			stdout = true
+		case "stderr":
+			stderr = true
+		case "trace":
+			trace = true
+		}
+	}
+	return stdout, stderr, trace
+}
+
+// programTimeoutSeconds returns how long the program may run in the task, in whole seconds. A tenth of the task's
+// timeout is left to start the container and to report the result
+func programTimeoutSeconds(taskTimeout string) int {
+	d, _ := time.ParseDuration(taskTimeout)
+	return max(1, int(d.Seconds()*0.9))
+}
+
+// Exit code of a process killed with SIGKILL, which is how the kernel stops processes exceeding the memory limit
+const exitCodeKilled = 128 + 9
+
+// outOfMemoryError is the error of a program killed for exceeding the memory limit
+func outOfMemoryError() ErrorMsg {
+	return ErrorMsg{
+		Event:        "runtime",
+		ExceptionMsg: "out of memory",
+	}
+}
+
+var signalNames = map[int]string{
+	4:  "SIGILL",
+	6:  "SIGABRT",
+	7:  "SIGBUS",
+	8:  "SIGFPE",
+	9:  "SIGKILL",
+	11: "SIGSEGV",
+	15: "SIGTERM",
+}
+
+// exitSignal returns the signal that killed the program, following the shell convention of exit code 128+n
+func exitSignal(exitCode int) (string, bool) {
+	if exitCode <= 128 {
+		return "", false
+	}
+	if name, ok := signalNames[exitCode-128]; ok {
+		return name, true
+	}
+	return "signal " + strconv.Itoa(exitCode-128), true
+}
+
+// crashDescriptions are the messages of the signals a program usually crashes with, as printed by the shell
+var crashDescriptions = map[int]string{
+	6:  "Aborted",
+	8:  "Floating point exception",
+	11: "Segmentation fault",
+}
+
+// crashError returns the runtime error of a program that crashed, located at the last line of its trace
+func crashError(exitCode int, trace []traceStep) (ErrorMsg, bool) {
+	description, ok := crashDescriptions[exitCode-128]
+	if !ok {
+		return ErrorMsg{}, false
+	}
+	crash := ErrorMsg{
+		Event:        "runtime",
+		ExceptionMsg: description + " (signal " + strconv.Itoa(exitCode-128) + ")",
+	}
+	if len(trace) > 0 {
+		step := trace[len(trace)-1]
+		if step.Line > 0 {
+			crash.Line = step.Line
+		}
+		// Running out of stack is a segmentation fault too, only valgrind tells them apart
+		if exitCode-128 == signalSegv && stackOverflowRe.MatchString(step.ExceptionMsg) {
+			crash.Event = "stack_overflow"
+			crash.ExceptionMsg = "Stack overflow (signal " + strconv.Itoa(signalSegv) + ")"
+			crash.Hint = "Your program ran out of stack memory — check for recursion that never reaches its base case."
+		}
+	}
+	return crash, true
+}
+
+// signalSegv is the number of SIGSEGV
+const signalSegv = 11
+
+// stackOverflowRe matches the report of valgrind for a program that couldn't grow its stack, e.g.
+// "Stack overflow in thread #1: can't grow stack to 0x1ffe801000". Every invalid access mentions that it may be a
+// stack overflow, so only this line is conclusive
+var stackOverflowRe = regexp.MustCompile(`Stack overflow in thread|can't grow stack`)
+
+// assertionRe matches the message of a failed assert(), e.g.
+// "usercode: /tmp/user_code/usercode.c:5: main: Assertion `p != NULL' failed."
+var assertionRe = regexp.MustCompile("^(?:[^:]*: )?(?P<File>[^:]+):(?P<Line>\\d+): (?P<Function>.+?): Assertion [`'‘](?P<Expression>.*)['’] failed\\.?$")
+
+// assertionError returns the runtime error of a program stopped by a failed assert(), from its message
+func assertionError(msg string) (ErrorMsg, bool) {
+	match := assertionRe.FindStringSubmatch(strings.TrimSpace(msg))
+	if match == nil {
+		return ErrorMsg{}, false
+	}
+	expression := match[assertionRe.SubexpIndex("Expression")]
+	return ErrorMsg{
+		Event:        "assertion",
+		ExceptionMsg: "Assertion `" + expression + "' failed",
+		Line:         position(match[assertionRe.SubexpIndex("Line")]),
+		Expression:   expression,
+		File:         sanitizeErrorPaths(match[assertionRe.SubexpIndex("File")]),
+		Function:     match[assertionRe.SubexpIndex("Function")],
+	}, true
+}
+
+// workDir is the shell variable of the Run command with the directory of the job's files, created under
+// Config.WorkDir
+const workDir = "$workdir"
+
+// jobDirPrefix starts the name of the directory of each job
+const jobDirPrefix = "job."
+
+// sanitizeErrorPaths removes the directory of the user's files from a message, e.g.
+// "/tmp/user_code/job.Ab12Cd/usercode.c" becomes "usercode.c". Students don't have that directory, and it shows the
+// layout of the container
+func sanitizeErrorPaths(msg string) string {
+	prefix := config.WorkDir + "/" + jobDirPrefix
+	var b strings.Builder
+	for {
+		i := strings.Index(msg, prefix)
+		if i < 0 {
+			break
+		}
+		// The rest of the name is random
+		end := strings.IndexByte(msg[i+len(prefix):], '/')
+		if end < 0 {
+			break
+		}
+		b.WriteString(msg[:i])
+		msg = msg[i+len(prefix)+end+1:]
+	}
+	b.WriteString(msg)
+	return b.String()
+}
+
+// sanitizeTracePaths removes the directory of the user's files from the runtime errors of a trace
+func sanitizeTracePaths(trace []traceStep) {
+	for i := range trace {
+		trace[i].ExceptionMsg = sanitizeErrorPaths(trace[i].ExceptionMsg)
+	}
+}
+
+// errLanguageDisabled is returned for supported languages that aren't in Config.EnabledLanguages
+var errLanguageDisabled = errors.New("language disabled")
+
+// languageDisabledError is errLanguageDisabled with the message configured for the language, if any, e.g. where else
+// it can be run
+type languageDisabledError struct {
+	language string
+	message  string
+}
+
+func (e languageDisabledError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	return e.language + ": " + errLanguageDisabled.Error()
+}
+
+func (e languageDisabledError) Is(target error) bool {
+	return target == errLanguageDisabled
+}
+
+// errInvalidTimeout is returned for timeouts that aren't a positive number of milliseconds
+var errInvalidTimeout = errors.New("invalid timeout")
+
+// requestTimeout returns the timeout of the task, the one of the request clamped to [minTimeout, cfg.Timeout]. The
+// deadline of the context, if any, shortens it too, since nobody waits for the result after it
+func requestTimeout(ctx context.Context, er ExecRequest, cfg Config) (string, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if er.TimeoutMs == nil && !hasDeadline {
+		return cfg.Timeout, nil
+	}
+	// Already validated by validateLimits
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	if er.TimeoutMs != nil {
+		if *er.TimeoutMs <= 0 {
+			return "", errors.Wrapf(errInvalidTimeout, "%d ms", *er.TimeoutMs)
+		}
+		timeout = min(time.Duration(*er.TimeoutMs)*time.Millisecond, timeout)
+	}
+	if hasDeadline {
+		timeout = min(time.Until(deadline).Truncate(time.Millisecond), timeout)
+	}
+	return max(timeout, minTimeout).String(), nil
+}
+
+// errUnknownParserVersion is returned for parser versions that aren't configured
+var errUnknownParserVersion = errors.New("unknown parser version")
+
+// errEnvNotAllowed is returned for environment variables that aren't in the allowed ones
+var errEnvNotAllowed = errors.New("environment variable not allowed")
+
+// errFlagNotAllowed is returned for compiler flags that aren't in the allowed ones
+var errFlagNotAllowed = errors.New("compiler flag not allowed")
+
+// uncaughtException returns the error that stopped an interpreted program, from the last step of its trace
+func uncaughtException(trace []traceStep) (ErrorMsg, bool) {
+	if len(trace) == 0 {
+		return ErrorMsg{}, false
+	}
+	step := trace[len(trace)-1]
+	if step.Event != "uncaught_exception" {
+		return ErrorMsg{}, false
+	}
+	uncaught := ErrorMsg{Event: "runtime", ExceptionMsg: step.ExceptionMsg}
+	if step.Line > 0 {
+		uncaught.Line = step.Line
+	}
+	// Only syntax errors have the column
+	if step.Offset != nil {
+		uncaught.Event = "syntax"
+		if *step.Offset > 0 {
+			uncaught.Column = *step.Offset
+		}
+	}
+	return uncaught, true
+}
+
+// Helper function to safely convert string to integer. It returns -1 when s isn't a number
 func toInt(s string) int {
-	val, err := strconv.Atoi(s)
+	val, err := strconv.Atoi(strings.TrimSpace(s))
 	if err != nil {
-		return 0
+		return -1
 	}
 	return val
 }
 
+// position converts a line or column reported by the compiler to the 1-based convention of ErrorMsg,
+// returning unknownPosition when it isn't a valid position
+func position(s string) int {
+	if val := toInt(s); val > 0 {
+		return val
+	}
+	return unknownPosition
+}
+
+// unknownPosition is the line or column of an error whose location is unknown
+const unknownPosition = 0
+
 type ErrorMsg struct {
 	Event        string `json:"event"`
 	ExceptionMsg string `json:"exception_msg"`
-	Line         int    `json:"line"`
-	Column       int    `json:"column"`
+	// 1-based line of the error, unknownPosition (0) when it's unknown
+	Line int `json:"line"`
+	// 1-based column of the error, unknownPosition (0) when it's unknown
+	Column int `json:"column"`
+	// Undefined symbol of a linker error
+	Symbol string `json:"symbol,omitempty"`
+	// Expression, file and function of a failed assertion. Diagnostics of the compilers have the file too, e.g.
+	// "usercode.c" or a header of Files
+	Expression string `json:"expression,omitempty"`
+	File       string `json:"file,omitempty"`
+	Function   string `json:"function,omitempty"`
+	// Lines of the code around the error, when its line in the main file is known
+	Snippet []SnippetLine `json:"snippet,omitempty"`
+	// Notes of the compiler about the error, e.g. the macro it's expanded from or the candidates of a call
+	Notes []ErrorMsg `json:"notes,omitempty"`
+	// Shown to the user, for errors with a usual cause, like a stack overflow
+	Hint string `json:"hint,omitempty"`
+	// Kind of a warning with a hint, pointerHintCategory for the ones about pointers
+	Category string `json:"category,omitempty"`
+}
+
+// SnippetLine is a line of the submitted code
+type SnippetLine struct {
+	// 1-based, like ErrorMsg.Line
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// Lines of context shown before and after the line of an error
+const snippetContext = 1
+
+// withSnippet returns the error with the lines of the code around it. Errors out of the code are left as they are
+func (e ErrorMsg) withSnippet(code string) ErrorMsg {
+	lines := strings.Split(code, "\n")
+	if e.Line < 1 || e.Line > len(lines) {
+		return e
+	}
+	e.Snippet = nil
+	for n := max(1, e.Line-snippetContext); n <= min(len(lines), e.Line+snippetContext); n++ {
+		e.Snippet = append(e.Snippet, SnippetLine{Line: n, Text: lines[n-1]})
+	}
+	return e
 }
 
 type Ret struct {
-	Code     string   `json:"code"`
-	ErrorMsg ErrorMsg `json:"error"`
+	Code string `json:"code"`
+	// First error, kept for clients that only show one. It has the fields of the error envelope too, so clients can
+	// tell these responses apart like any other failure
+	ErrorMsg retError `json:"error"`
+	// All errors, in the order the compiler emitted them
+	Errors []ErrorMsg `json:"errors"`
+	// Whole output of the compiler, including notes and carets, without the paths of the server
+	RawOutput string `json:"raw_output,omitempty"`
+	// Output of the program until it failed, if it ran
+	Stdout string `json:"stdout,omitempty"`
+	// What the program wrote to stderr until it failed, if it ran
+	Stderr string `json:"stderr,omitempty"`
+	// phaseCompile, phaseLink or phaseRun
+	Phase string `json:"phase"`
+}
+
+// retError is the first error of Ret along with the code, message and status of the error envelope
+type retError struct {
+	ErrorMsg
+	apiError
+}
+
+// newRet builds the response of a failed compilation. If no error could be parsed, an unknown error is reported
+func newRet(code string, errs []ErrorMsg) Ret {
+	if len(errs) == 0 {
+		errs = []ErrorMsg{{
+			Event:        "uncaught_exception",
+			ExceptionMsg: "unknown compiler error",
+		}}
+	}
+	for i := range errs {
+		errs[i].ExceptionMsg = sanitizeErrorPaths(errs[i].ExceptionMsg)
+		if isMainSource(errs[i].File) {
+			errs[i] = errs[i].withSnippet(code)
+		}
+	}
+	phase := phaseCompile
+	failure := newErrorBody(http.StatusBadRequest, CodeCompileError, "the code doesn't compile").Error
+	if errs[0].Event == "linker" {
+		phase = phaseLink
+		failure = newErrorBody(http.StatusBadRequest, CodeLinkError, "the code doesn't link").Error
+	}
+	return Ret{
+		Code:     code,
+		ErrorMsg: retError{ErrorMsg: errs[0], apiError: failure},
+		Errors:   errs,
+		Phase:    phase,
+	}
+}
+
+// newOutOfMemoryRet builds the response of a program the kernel killed for exceeding its memory limit
+func newOutOfMemoryRet(code string) Ret {
+	ret := newRet(code, []ErrorMsg{outOfMemoryError()})
+	ret.ErrorMsg.apiError = newErrorBody(http.StatusBadRequest, CodeOutOfMemory, "the program ran out of memory").Error
+	ret.Phase = phaseRun
+	return ret
+}
+
+// gccLocation matches the location of a diagnostic of gcc or clang, e.g. "/tmp/user_code/job.Ab12Cd/usercode.c:5".
+// submittedFile tells whether the file is one of the submitted ones
+const gccLocation = `(?:^|\s)(?P<File>[^\s:]+):(?P<Line>\d+)`
+
+// gccErrorRe matches an error of gcc or clang, e.g.
+// "/tmp/user_code/job.Ab12Cd/usercode.c:5:3: error: 'y' undeclared (first use in this function)"
+var gccErrorRe = regexp.MustCompile(gccLocation + `:(?P<Column>\d+):.+?(?P<Error>error:.*$)`)
+
+// gccUserWarningRe matches a warning of gcc or clang
+var gccUserWarningRe = regexp.MustCompile(gccLocation + `:(?P<Column>\d+):.*?(?P<Warning>warning:.*$)`)
+
+// parseGccWarnings extracts the warnings of a successful compilation in the submitted files
+func parseGccWarnings(code string, gccStderr string) []ErrorMsg {
+	warnings := make([]ErrorMsg, 0)
+
+	for _, line := range strings.Split(gccStderr, "\n") {
+		matches := gccUserWarningRe.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		file, ok := submittedFile(matches[gccUserWarningRe.SubexpIndex("File")])
+		if !ok {
+			continue
+		}
+		line := position(matches[gccUserWarningRe.SubexpIndex("Line")])
+		warning := ErrorMsg{
+			Event:        "warning",
+			ExceptionMsg: sanitizeErrorPaths(strings.TrimSpace(matches[gccUserWarningRe.SubexpIndex("Warning")])),
+			Line:         line,
+			Column:       gccColumn(code, file, line, matches[gccUserWarningRe.SubexpIndex("Column")]),
+			File:         file,
+		}
+		if option := warningOptionRe.FindStringSubmatch(warning.ExceptionMsg); option != nil {
+			if hint, ok := pointerHints[option[1]]; ok {
+				warning.Category = pointerHintCategory
+				warning.Hint = hint
+			}
+		}
+		warnings = append(warnings, warning)
+	}
+
+	return warnings
+}
+
+// warningOptionRe matches the option that enabled a warning, at its end, e.g. "[-Wuninitialized]" or
+// "[-Wformat=]"
+var warningOptionRe = regexp.MustCompile(`\[(-W[\w+-]+)=?\]$`)
+
+// Category of the warnings about pointers and uninitialized variables, which this tool is about
+const pointerHintCategory = "pointer_hint"
+
+const uninitializedHint = "This variable is read before it's given a value, so it holds whatever was left in " +
+	"memory. If it's a pointer, it points to a random address — give it one first, e.g. &x, malloc(...) or NULL."
+
+const localAddressHint = "The local variables of a function stop existing when it returns, so this pointer " +
+	"points to memory that will be reused — return the value itself, or memory from malloc(...)."
+
+// pointerHints explains the warnings of gcc and clang about pointers to students, by their option
+var pointerHints = map[string]string{
+	"-Wuninitialized":           uninitializedHint,
+	"-Wmaybe-uninitialized":     uninitializedHint,
+	"-Wsometimes-uninitialized": uninitializedHint,
+	"-Wreturn-local-addr":       localAddressHint,
+	"-Wreturn-stack-address":    localAddressHint,
+	"-Wint-conversion": "A number is used where an address is expected, or the other way around " +
+		"— check for a missing & or *.",
+	"-Wincompatible-pointer-types": "The pointer points to a different type than the one expected " +
+		"— check the & and * of the expression and the types of the variables.",
+	"-Wfree-nonheap-object": "free() only releases memory that malloc(...), calloc(...) or realloc(...) returned " +
+		"— this pointer points somewhere else, e.g. to a local variable.",
+}
+
+// submittedFile returns the name of a file the compiler reported, relative to the directory of the job, and whether
+// it's one of the submitted files, the only ones students have
+func submittedFile(name string) (string, bool) {
+	file := sanitizeErrorPaths(name)
+	return file, file != name
 }
 
+// isMainSource reports whether the file of a diagnostic is the main file, whose code the server has. Extra files
+// can't be named like it. Diagnostics without a file are about the main file too
+func isMainSource(file string) bool {
+	return file == "" || strings.HasPrefix(file, "usercode.")
+}
+
+// gccColumn returns the column of a diagnostic in the file. Only the main file's is converted by visualColumn, since
+// the server doesn't keep the others
+func gccColumn(code string, file string, line int, column string) int {
+	if !isMainSource(file) {
+		return position(column)
+	}
+	return visualColumn(code, line, position(column), config.TabWidth)
+}
+
+// visualColumn converts the column of a gcc diagnostic, which counts bytes since the code is compiled with
+// -ftabstop=1, to the column an editor shows with tabs tabWidth wide. Unknown columns and the ones out of the line are
+// left as they are
+func visualColumn(code string, line int, column int, tabWidth int) int {
+	lines := strings.Split(code, "\n")
+	if line < 1 || line > len(lines) || column < 1 || column-1 > len(lines[line-1]) {
+		return column
+	}
+	visual := 0
+	for _, r := range lines[line-1][:column-1] {
+		if r == '\t' {
+			visual = (visual/tabWidth + 1) * tabWidth
+		} else {
+			visual++
+		}
+	}
+	return visual + 1
+}
+
+// gccNoteRe matches a note of gcc or clang, e.g. "/tmp/user_code/usercode.cpp:3:6: note: candidate: 'void f(int)'".
+// Notes about other files, like the system headers, have no column, or no line either
+var gccNoteRe = regexp.MustCompile(`^(?:(?P<File>[^:\s]+):(?:(?P<Line>\d+):(?:(?P<Column>\d+):)?)? )?note: (?P<Note>.*)$`)
+
+// gccWarningRe matches a warning of gcc or clang, which may have notes of its own
+var gccWarningRe = regexp.MustCompile(`^[^:\s]+:(\d+:)*\s*warning: `)
+
+// gccNote returns the note matched by gccNoteRe. Only the locations in the submitted files are kept, like for errors
+func gccNote(code string, matches []string) ErrorMsg {
+	note := ErrorMsg{
+		Event:        "note",
+		ExceptionMsg: sanitizeErrorPaths(strings.TrimSpace(matches[gccNoteRe.SubexpIndex("Note")])),
+	}
+	if file, ok := submittedFile(matches[gccNoteRe.SubexpIndex("File")]); ok {
+		note.File = file
+		note.Line = position(matches[gccNoteRe.SubexpIndex("Line")])
+		note.Column = gccColumn(code, file, note.Line, matches[gccNoteRe.SubexpIndex("Column")])
+	}
+	return note
+}
+
+// undefinedReferenceRe matches the errors of ld, quoting the symbol either with `' or, in UTF-8 locales, with ‘’
+var undefinedReferenceRe = regexp.MustCompile("undefined reference to [`'‘](?P<Symbol>[^'’]+)['’]")
+
+// linkerLocationRe matches the location of a linker error in the user's code
+var linkerLocationRe = regexp.MustCompile(gccLocation + `:`)
+
 func handleGccError(code string, gccStderr string) string {
 
-	exceptionMsg := "unknown compiler error"
-	errorType := "uncaught_exception"
-	lineNumber := 0
-	columnNumber := 0
+	var errs []ErrorMsg
 
-	println(gccStderr)
+	// Index of the error the following notes belong to, -1 after anything else the compiler reports
+	noted := -1
 
 	// Split gccStderr into lines and process
 	lines := strings.Split(gccStderr, "\n")
 	for _, line := range lines {
-		// Try to match the error format
-		re := regexp.MustCompile(`usercode(.c|.cpp):(?P<Line>\d+):(?P<Column>\d+):.+?(?P<Error>error:.*$)`)
-		matches := re.FindStringSubmatch(line)
+		if matches := gccNoteRe.FindStringSubmatch(line); matches != nil {
+			if noted >= 0 {
+				errs[noted].Notes = append(errs[noted].Notes, gccNote(code, matches))
+			}
+			continue
+		}
+		if gccWarningRe.MatchString(line) {
+			noted = -1
+			continue
+		}
+
+		// Try to match the error format, in any of the submitted files
+		matches := gccErrorRe.FindStringSubmatch(line)
 		if matches != nil {
-			// Extract the line and column number and the error message
-			lineNumber = toInt(matches[re.SubexpIndex("Line")])
-			columnNumber = toInt(matches[re.SubexpIndex("Column")])
-			exceptionMsg = strings.TrimSpace(matches[re.SubexpIndex("Error")])
-			errorType = "compiler"
-			break
+			if file, ok := submittedFile(matches[gccErrorRe.SubexpIndex("File")]); ok {
+				// Extract the line and column number and the error message
+				line := position(matches[gccErrorRe.SubexpIndex("Line")])
+				errs = append(errs, ErrorMsg{
+					Event:        "compiler",
+					ExceptionMsg: strings.TrimSpace(matches[gccErrorRe.SubexpIndex("Error")]),
+					Line:         line,
+					Column:       gccColumn(code, file, line, matches[gccErrorRe.SubexpIndex("Column")]),
+					File:         file,
+				})
+				noted = len(errs) - 1
+				continue
+			}
 		}
 
 		// Handle custom-defined errors from include path
 		if strings.Contains(line, "#error") {
 			// Extract the error message after '#error'
-			exceptionMsg = strings.TrimSpace(strings.Split(line, "#error")[1])
-			break
+			errs = append(errs, ErrorMsg{
+				Event:        "uncaught_exception",
+				ExceptionMsg: strings.TrimSpace(strings.Split(line, "#error")[1]),
+			})
+			noted = -1
+			continue
 		}
 
-		// Handle linker errors (undefined reference)
-		if strings.Contains(line, "undefined ") {
-			parts := strings.Split(line, ":")
-			exceptionMsg = strings.TrimSpace(parts[len(parts)-1])
-			// Match file path and line number
-			if strings.Contains(parts[0], "usercode.c") || strings.Contains(parts[0], "usercode.cpp") {
-				lineNumber = toInt(parts[1])
+		// Handle linker errors, one per undefined reference. The summary of the linker (e.g. "collect2: error: ld
+		// returned 1 exit status") and the "in function" lines are skipped
+		if matches := undefinedReferenceRe.FindStringSubmatch(line); matches != nil {
+			symbol := matches[undefinedReferenceRe.SubexpIndex("Symbol")]
+			linkerError := ErrorMsg{
+				Event:        "linker",
+				ExceptionMsg: "undefined reference to '" + symbol + "'",
+				Symbol:       symbol,
 			}
-			break
+			// Only present when the object has debug info, e.g.
+			// "/tmp/user_code/job.Ab12Cd/usercode.c:5: undefined reference"
+			if matches := linkerLocationRe.FindStringSubmatch(line); matches != nil {
+				if file, ok := submittedFile(matches[linkerLocationRe.SubexpIndex("File")]); ok {
+					linkerError.File = file
+					linkerError.Line = position(matches[linkerLocationRe.SubexpIndex("Line")])
+				}
+			}
+			errs = append(errs, linkerError)
+			noted = -1
 		}
 	}
 
 	// Prepare the return value
-	ret := Ret{
-		Code: code,
-		ErrorMsg: ErrorMsg{
-			Event:        errorType,
-			ExceptionMsg: exceptionMsg,
-			Line:         lineNumber,
-			Column:       columnNumber,
-		},
-	}
+	ret := newRet(code, errs)
+	ret.RawOutput = sanitizeErrorPaths(gccStderr)
 
 	// Convert to JSON
 	retJson, _ := json.Marshal(ret)
 
 	return string(retJson)
 }
+
+// rustcErrorRe matches the first line of an error of rustc, e.g. "error[E0425]: cannot find value `y` in this scope"
+var rustcErrorRe = regexp.MustCompile(`^error(\[E\d+\])?:\s*(?P<Error>.*)$`)
+
+// rustcLocationRe matches the location of a rustc diagnostic in the main file, e.g. " --> /tmp/user_code/usercode.rs:3:13"
+var rustcLocationRe = regexp.MustCompile(`^\s*-->\s*(?:.*/)?usercode\.rs:(?P<Line>\d+):(?P<Column>\d+)`)
+
+func handleRustcError(code string, rustcStderr string) string {
+
+	var errs []ErrorMsg
+
+	// rustc prints the message first and its location on one of the following lines
+	located := true
+	lines := strings.Split(rustcStderr, "\n")
+	for _, line := range lines {
+		matches := rustcErrorRe.FindStringSubmatch(line)
+		if matches != nil {
+			msg := strings.TrimSpace(matches[rustcErrorRe.SubexpIndex("Error")])
+			// Summary line, e.g. "error: aborting due to 2 previous errors"
+			if strings.HasPrefix(msg, "aborting due to") {
+				continue
+			}
+			errs = append(errs, ErrorMsg{
+				Event:        "compiler",
+				ExceptionMsg: "error: " + msg,
+			})
+			located = false
+			continue
+		}
+
+		if located {
+			continue
+		}
+		matches = rustcLocationRe.FindStringSubmatch(line)
+		if matches != nil {
+			errs[len(errs)-1].Line = position(matches[rustcLocationRe.SubexpIndex("Line")])
+			errs[len(errs)-1].Column = position(matches[rustcLocationRe.SubexpIndex("Column")])
+			located = true
+		}
+	}
+
+	ret := newRet(code, errs)
+	ret.RawOutput = sanitizeErrorPaths(rustcStderr)
+
+	retJson, _ := json.Marshal(ret)
+
+	return string(retJson)
+}
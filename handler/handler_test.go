@@ -0,0 +1,1869 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+func TestHandleGccError(t *testing.T) {
+	code := "int main() {\n\tint x = y;\n}\n"
+	stderr := jobPath("usercode.c") + ":2:10: error: 'y' undeclared (first use in this function)\n" +
+		jobPath("list.h") + ":3:1: error: unknown type name 'node'\n" +
+		"/usr/include/stdio.h:27:1: error: expected ';' before 'typedef'\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError(code, stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 2 {
+		t.Fatalf("errors = %+v, want the 2 in the submitted files", ret.Errors)
+	}
+	main, header := ret.Errors[0], ret.Errors[1]
+	if main.File != "usercode.c" || main.Line != 2 || main.Column != 10 || len(main.Snippet) == 0 {
+		t.Errorf("error in the main file = %+v", main)
+	}
+	if header.File != "list.h" || header.Line != 3 || header.Column != 1 || header.Snippet != nil {
+		t.Errorf("error in the header = %+v", header)
+	}
+	if ret.ErrorMsg.ExceptionMsg != "error: 'y' undeclared (first use in this function)" {
+		t.Errorf("first error = %q", ret.ErrorMsg.ExceptionMsg)
+	}
+	if ret.Phase != phaseCompile {
+		t.Errorf("phase = %q, want %q", ret.Phase, phaseCompile)
+	}
+}
+
+func TestCompileErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   ErrorCode
+	}{
+		{name: "compile", stderr: jobPath("usercode.c") + ":1:1: error: expected ';'", want: CodeCompileError},
+		{name: "link", stderr: jobPath("usercode.c") + ":5: undefined reference to `foo'", want: CodeLinkError},
+		{name: "unknown", stderr: "cc1: out of sorts", want: CodeCompileError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body errorBody
+			if err := json.Unmarshal([]byte(handleGccError("", tt.stderr)), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != tt.want || body.Error.Status != http.StatusBadRequest || body.Error.Message == "" {
+				t.Errorf("envelope = %+v, want code %s", body.Error, tt.want)
+			}
+		})
+	}
+
+	ret := newOutOfMemoryRet("")
+	out, _ := json.Marshal(ret)
+	var body errorBody
+	if err := json.Unmarshal(out, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != CodeOutOfMemory || ret.Phase != phaseRun || ret.ErrorMsg.ExceptionMsg != "out of memory" {
+		t.Errorf("out of memory = %s", out)
+	}
+}
+
+func TestHandleGccErrorNotes(t *testing.T) {
+	code := "void f(int);\nint main() { f(); }\n"
+	stderr := jobPath("usercode.c") + ":2:14: error: too few arguments to function 'f'\n" +
+		jobPath("usercode.c") + ":1:6: note: declared here\n" +
+		"/usr/include/stdlib.h: note: in expansion of macro\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError(code, stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	notes := ret.ErrorMsg.Notes
+	if len(notes) != 2 {
+		t.Fatalf("notes = %+v, want 2", notes)
+	}
+	if notes[0].File != "usercode.c" || notes[0].Line != 1 || notes[0].Column != 6 {
+		t.Errorf("note in the main file = %+v", notes[0])
+	}
+	if notes[1].File != "" || notes[1].Line != unknownPosition {
+		t.Errorf("note in a system header = %+v, want no location", notes[1])
+	}
+}
+
+func TestNotesFollowTheirError(t *testing.T) {
+	stderr := jobPath("usercode.c") + ":3:5: error: conflicting types for 'f'\n" +
+		jobPath("usercode.c") + ":1:6: note: previous declaration of 'f' with type 'void(int)'\n" +
+		jobPath("usercode.c") + ":5:3: error: 'x' undeclared (first use in this function)\n" +
+		jobPath("usercode.c") + ":5:3: note: each undeclared identifier is reported only once\n" +
+		jobPath("usercode.c") + ":5:3: note: for each function it appears in\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 2 {
+		t.Fatalf("errors = %+v, want the notes attached instead of reported as errors", ret.Errors)
+	}
+	if notes := ret.Errors[0].Notes; len(notes) != 1 || notes[0].Line != 1 || notes[0].Event != "note" {
+		t.Errorf("notes of the first error = %+v", notes)
+	}
+	if notes := ret.Errors[1].Notes; len(notes) != 2 || notes[1].ExceptionMsg != "for each function it appears in" {
+		t.Errorf("notes of the second error = %+v", notes)
+	}
+
+	// The notes of a warning aren't the error's
+	stderr = jobPath("usercode.c") + ":5:3: error: 'x' undeclared (first use in this function)\n" +
+		jobPath("usercode.c") + ":2:3: warning: implicit declaration of function 'g'\n" +
+		jobPath("usercode.c") + ":1:1: note: include '<stdlib.h>' or provide a declaration of 'g'\n"
+	ret = Ret{}
+	if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 1 || len(ret.Errors[0].Notes) != 0 {
+		t.Errorf("errors = %+v, want the note of the warning left out", ret.Errors)
+	}
+}
+
+func TestHandleGccErrorLinker(t *testing.T) {
+	stderr := "/usr/bin/ld: " + jobPath("usercode.o") + ": in function `main':\n" +
+		jobPath("usercode.c") + ":5: undefined reference to `foo'\n" +
+		"collect2: error: ld returned 1 exit status\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 1 {
+		t.Fatalf("errors = %+v, want 1", ret.Errors)
+	}
+	e := ret.ErrorMsg
+	if e.Event != "linker" || e.Symbol != "foo" || e.File != "usercode.c" || e.Line != 5 {
+		t.Errorf("linker error = %+v", e)
+	}
+	if ret.Phase != phaseLink {
+		t.Errorf("phase = %q, want %q", ret.Phase, phaseLink)
+	}
+}
+
+func TestHandleGccErrorUndefinedReferences(t *testing.T) {
+	stderr := "/usr/bin/ld: " + jobPath("usercode.o") + ": in function `main':\n" +
+		jobPath("usercode.c") + ":5: undefined reference to `foo'\n" +
+		"/usr/bin/ld: " + jobPath("usercode.c") + ":6: undefined reference to ‘bar’\n" +
+		"/usr/bin/ld: " + jobPath("usercode.o") + ":(.text+0x1e): undefined reference to `baz'\n" +
+		"collect2: error: ld returned 1 exit status\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	want := []ErrorMsg{
+		{Event: "linker", Symbol: "foo", ExceptionMsg: "undefined reference to 'foo'", File: "usercode.c", Line: 5},
+		{Event: "linker", Symbol: "bar", ExceptionMsg: "undefined reference to 'bar'", File: "usercode.c", Line: 6},
+		{Event: "linker", Symbol: "baz", ExceptionMsg: "undefined reference to 'baz'"},
+	}
+	if len(ret.Errors) != len(want) {
+		t.Fatalf("errors = %+v, want one per undefined reference", ret.Errors)
+	}
+	for i, e := range ret.Errors {
+		if e.Event != want[i].Event || e.Symbol != want[i].Symbol || e.ExceptionMsg != want[i].ExceptionMsg ||
+			e.File != want[i].File || e.Line != want[i].Line {
+			t.Errorf("error %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestHandleGccErrorRawOutput(t *testing.T) {
+	stderr := jobPath("usercode.c") + ": In function 'main':\n" +
+		jobPath("usercode.c") + ":1:13: error: expected ';' before '}' token\n" +
+		" int main() { return 0 }\n" +
+		"             ^\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	want := "usercode.c: In function 'main':\n" +
+		"usercode.c:1:13: error: expected ';' before '}' token\n" +
+		" int main() { return 0 }\n" +
+		"             ^\n"
+	if ret.RawOutput != want {
+		t.Errorf("raw output = %q, want the whole stderr %q", ret.RawOutput, want)
+	}
+}
+
+func TestParseGccWarnings(t *testing.T) {
+	code := "int main() {\n\tint *p;\n\treturn *p;\n}\n"
+	stderr := jobPath("usercode.c") + ":3:9: warning: 'p' is used uninitialized [-Wuninitialized]\n" +
+		jobPath("util.c") + ":7:2: warning: unused variable 'n' [-Wunused-variable]\n" +
+		"/usr/include/string.h:1:1: warning: something in a system header\n"
+
+	warnings := parseGccWarnings(code, stderr)
+	if len(warnings) != 2 {
+		t.Fatalf("warnings = %+v, want the 2 in the submitted files", warnings)
+	}
+	w := warnings[0]
+	// The tab before return is one column wide with the default tab width
+	if w.File != "usercode.c" || w.Line != 3 || w.Column != 9 {
+		t.Errorf("warning in the main file = %+v", w)
+	}
+	if w.Category != pointerHintCategory || w.Hint != uninitializedHint {
+		t.Errorf("warning about a pointer has no hint: %+v", w)
+	}
+	if w := warnings[1]; w.File != "util.c" || w.Line != 7 || w.Category != "" {
+		t.Errorf("warning in another file = %+v", w)
+	}
+}
+
+func TestVisualColumn(t *testing.T) {
+	code := "\t\tx;\nab\tc;"
+	tests := []struct {
+		line, column, tabWidth, want int
+	}{
+		{line: 1, column: 3, tabWidth: 1, want: 3},
+		{line: 1, column: 3, tabWidth: 4, want: 9},
+		{line: 2, column: 4, tabWidth: 4, want: 5},
+		{line: 3, column: 1, tabWidth: 4, want: 1},
+		{line: 1, column: unknownPosition, tabWidth: 4, want: unknownPosition},
+	}
+	for _, tt := range tests {
+		if got := visualColumn(code, tt.line, tt.column, tt.tabWidth); got != tt.want {
+			t.Errorf("visualColumn(%d, %d, %d) = %d, want %d", tt.line, tt.column, tt.tabWidth, got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	trace := `{"code":"int main() {}","trace":[{"event":"step_line","line":1}]}`
+	tests := []struct {
+		name   string
+		job    *tork.Job
+		status int
+		check  func(t *testing.T, body map[string]any)
+	}{
+		{
+			name: "success",
+			job: completedJob(trace + "\n" + metadataPrefix + "exit_code=0\n" + metadataPrefix + "stdout=hi\n" +
+				metadataPrefix + "elapsed_s=0.25\n"),
+			status: http.StatusOK,
+			check: func(t *testing.T, body map[string]any) {
+				steps, _ := body["trace"].([]any)
+				if len(steps) != 1 || body["stdout"] != "hi" || body["phase"] != phaseComplete ||
+					body["exit_code"] != 0.0 || body["elapsed_ms"] != 250.0 || body["error"] != nil {
+					t.Errorf("body = %v", body)
+				}
+			},
+		},
+		{
+			name:   "compile error",
+			job:    compileFailedJob(jobPath("usercode.c") + ":1:13: error: expected ';' before '}' token\n"),
+			status: http.StatusBadRequest,
+			check: func(t *testing.T, body map[string]any) {
+				e := errorOf(body)
+				errs, _ := body["errors"].([]any)
+				if e["code"] != string(CodeCompileError) || e["line"] != 1.0 || len(errs) != 1 || body["phase"] != phaseCompile {
+					t.Errorf("body = %v", body)
+				}
+			},
+		},
+		{
+			name:   "timeout",
+			job:    completedJob(metadataPrefix + "timed_out=18\n" + metadataPrefix + "stdout=partial\n"),
+			status: http.StatusGatewayTimeout,
+			check: func(t *testing.T, body map[string]any) {
+				e := errorOf(body)
+				if e["code"] != string(CodeExecutionTimeout) || body["stdout"] != "partial" || body["phase"] != phaseRun ||
+					!strings.Contains(body["hint"].(string), "18s") {
+					t.Errorf("body = %v", body)
+				}
+			},
+		},
+		{
+			name:   "task deadline",
+			job:    failedJob("context deadline exceeded"),
+			status: http.StatusGatewayTimeout,
+			check: func(t *testing.T, body map[string]any) {
+				e := errorOf(body)
+				if e["code"] != string(CodeExecutionTimeout) || body["event"] != "timeout" {
+					t.Errorf("body = %v", body)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := withFakeEngine(t, func(*input.Job) *tork.Job { return tt.job })
+
+			c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}"}`)))
+			if err := Handler(c); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(fake.submitted()); n != 1 {
+				t.Fatalf("submitted %d jobs, want 1", n)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var body map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, body)
+		})
+	}
+}
+
+func TestBuildTaskRust(t *testing.T) {
+	cfg := defaultConfig()
+	for _, language := range []string{"rust", "Rust", " rs "} {
+		task, err := buildTask(context.Background(), ExecRequest{Language: language, Code: "fn main() {}"}, cfg)
+		if err != nil {
+			t.Fatalf("%q: %v", language, err)
+		}
+		if task.Image != cfg.RustImage {
+			t.Errorf("%q: image = %s, want %s", language, task.Image, cfg.RustImage)
+		}
+		if !strings.Contains(task.Run, "rustc ") || !strings.Contains(task.Run, workDir+"/usercode.rs") {
+			t.Errorf("%q: the code isn't compiled by rustc: %s", language, task.Run)
+		}
+		if _, ok := task.Files["usercode.rs"]; !ok {
+			t.Errorf("%q: files = %v, want usercode.rs", language, task.Files)
+		}
+	}
+}
+
+func TestHandleRustcError(t *testing.T) {
+	code := "fn main() {\n    let x = y;\n}\n"
+	stderr := "error[E0425]: cannot find value `y` in this scope\n" +
+		" --> " + jobPath("usercode.rs") + ":2:13\n" +
+		"  |\n" +
+		"2 |     let x = y;\n" +
+		"  |             ^ not found in this scope\n" +
+		"\n" +
+		"error: aborting due to previous error\n"
+
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleRustcError(code, stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 1 {
+		t.Fatalf("errors = %+v, want 1 without the summary", ret.Errors)
+	}
+	e := ret.ErrorMsg
+	if e.ExceptionMsg != "error: cannot find value `y` in this scope" || e.Line != 2 || e.Column != 13 {
+		t.Errorf("error = %+v", e)
+	}
+	if strings.Contains(ret.RawOutput, config.WorkDir) {
+		t.Errorf("raw output has the paths of the server: %s", ret.RawOutput)
+	}
+}
+
+func TestInputNeverReachesTheShell(t *testing.T) {
+	for _, input := range []string{"1; rm -rf /", "$(reboot)", "`id`", "a | b", "x > /etc/passwd", "\"quoted\""} {
+		if sanitizeInput(input) {
+			t.Errorf("sanitizeInput(%q) accepted shell syntax", input)
+		}
+	}
+
+	er := ExecRequest{Language: "c", Code: "int main() {}", Input: "1 2 3", Stdin: "$(reboot)\n"}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(task.Run, "reboot") || strings.Contains(task.Run, "1 2 3") {
+		t.Errorf("the input is in the command: %s", task.Run)
+	}
+	if task.Files["programInput.txt"] != er.Stdin {
+		t.Errorf("program input = %q, want the stdin in a file", task.Files["programInput.txt"])
+	}
+}
+
+func TestProgramInput(t *testing.T) {
+	tests := []struct {
+		name string
+		er   ExecRequest
+		want string
+	}{
+		{name: "input", er: ExecRequest{Input: "1 2"}, want: "1 2\n"},
+		{name: "no input", er: ExecRequest{}, want: "\n"},
+		{name: "stdin", er: ExecRequest{Input: "1 2", Stdin: "line one\nline two"}, want: "line one\nline two"},
+	}
+	for _, tt := range tests {
+		if got := programInput(tt.er); got != tt.want {
+			t.Errorf("%s: programInput() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeInput(t *testing.T) {
+	accepted := []string{"", "42", "-42 +7", "3.14 2,5", "6.02e23 1E-9", "1, 2, 3", "hello world", "ação 12", "1\n2\n3"}
+	for _, input := range accepted {
+		if !sanitizeInput(input) {
+			t.Errorf("sanitizeInput(%q) = false, want true", input)
+		}
+	}
+	rejected := []string{"1; 2", "a&b", "x=1", "(1)", "{1}", "'a'", "1\\n"}
+	for _, input := range rejected {
+		if sanitizeInput(input) {
+			t.Errorf("sanitizeInput(%q) = true, want false", input)
+		}
+	}
+}
+
+func TestSplitMetadata(t *testing.T) {
+	output := emptyTrace +
+		metadataPrefix + "exit_code=3\n" +
+		metadataPrefix + "stdout=first line\n" +
+		metadataPrefix + "stdout=second=line\n" +
+		"#hpwx not metadata\n"
+
+	rest, metadata := splitMetadata(output)
+	if rest != `{"code":"","trace":[]}`+"\n#hpwx not metadata\n" {
+		t.Errorf("output = %q", rest)
+	}
+	want := map[string]string{"exit_code": "3", "stdout": "first line\nsecond=line"}
+	if len(metadata) != len(want) {
+		t.Fatalf("metadata = %v, want %v", metadata, want)
+	}
+	for key, value := range want {
+		if metadata[key] != value {
+			t.Errorf("metadata[%s] = %q, want %q", key, metadata[key], value)
+		}
+	}
+}
+
+func TestWarningsOfSuccessfulCompilation(t *testing.T) {
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, " -Wall ") || strings.Contains(task.Run, " -w ") {
+		t.Errorf("warnings aren't enabled: %s", task.Run)
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {\n  int n;\n}"}`, completedJob(
+		emptyTrace+metadataPrefix+"warning="+jobPath("usercode.c")+
+			":2:7: warning: unused variable 'n' [-Wunused-variable]\n"+metadataPrefix+"exit_code=0\n"))
+	warnings, _ := body["warnings"].([]any)
+	if status != http.StatusOK || len(warnings) != 1 {
+		t.Fatalf("response = %d %v, want 1 warning", status, body)
+	}
+	if w := warnings[0].(map[string]any); w["line"] != 2.0 || w["column"] != 7.0 || w["event"] != "warning" {
+		t.Errorf("warning = %v", w)
+	}
+}
+
+func TestHandleGccErrorKeepsEveryError(t *testing.T) {
+	var stderr strings.Builder
+	for line := 1; line <= 3; line++ {
+		stderr.WriteString(jobPath("usercode.c") + ":" + strconv.Itoa(line) + ":1: error: error " + strconv.Itoa(line) + "\n")
+	}
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError("a\nb\nc\n", stderr.String())), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 3 {
+		t.Fatalf("errors = %+v, want 3", ret.Errors)
+	}
+	for i, e := range ret.Errors {
+		if e.Line != i+1 || e.ExceptionMsg != "error: error "+strconv.Itoa(i+1) {
+			t.Errorf("error %d = %+v, want the errors in the order of the compiler", i, e)
+		}
+	}
+
+	ret = Ret{}
+	if err := json.Unmarshal([]byte(handleGccError("", "cc1: internal compiler error\n")), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 1 || ret.ErrorMsg.ExceptionMsg != "unknown compiler error" {
+		t.Errorf("errors of unknown output = %+v, want an unknown error", ret.Errors)
+	}
+}
+
+// checkRequestCode returns the code of the error of checkRequest, empty when the request is valid
+func checkRequestCode(er ExecRequest) ErrorCode {
+	if apiErr := checkRequest(zerolog.Nop(), &er); apiErr != nil {
+		return apiErr.Code
+	}
+	return ""
+}
+
+func TestCheckRequestCodeSize(t *testing.T) {
+	tests := []struct {
+		name string
+		er   ExecRequest
+		want ErrorCode
+	}{
+		{name: "valid", er: ExecRequest{Language: "c", Code: "int main() {}"}},
+		{name: "at the limit", er: ExecRequest{Language: "c", Code: strings.Repeat("x", defaultMaxCodeBytes)}},
+		{name: "code too large", er: ExecRequest{Language: "c", Code: strings.Repeat("x", defaultMaxCodeBytes+1)}, want: CodeCodeTooLarge},
+		{
+			name: "files too large",
+			er: ExecRequest{Language: "c", Code: "int main() {}",
+				Files: map[string]string{"big.h": strings.Repeat("x", defaultMaxCodeBytes)}},
+			want: CodeCodeTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		if got := checkRequestCode(tt.er); got != tt.want {
+			t.Errorf("%s: checkRequest() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildTaskStandard(t *testing.T) {
+	tests := []struct {
+		language, standard string
+		want               string
+	}{
+		{language: "c", standard: "c11", want: " -std=c11"},
+		{language: "c++", standard: "c++17", want: " -std=c++17"},
+		{language: "c", standard: "c++17"},
+		{language: "c", standard: "c11; reboot"},
+		{language: "rust", standard: "c11"},
+	}
+	for _, tt := range tests {
+		er := ExecRequest{Language: tt.language, Code: "int main() {}", Standard: tt.standard}
+		task, err := buildTask(context.Background(), er, defaultConfig())
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("standard %s of %s was accepted", tt.standard, tt.language)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("standard %s of %s: %v", tt.standard, tt.language, err)
+		} else if !strings.Contains(task.Run, tt.want+" ") {
+			t.Errorf("standard %s of %s isn't passed to the compiler: %s", tt.standard, tt.language, task.Run)
+		}
+	}
+}
+
+func TestMeasures(t *testing.T) {
+	_, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, tracedJob("elapsed_s=1.5", "max_rss_kb=2048"))
+	if body["elapsed_ms"] != 1500.0 || body["max_rss_kb"] != 2048.0 {
+		t.Errorf("measures = %v, %v, want 1500, 2048", body["elapsed_ms"], body["max_rss_kb"])
+	}
+
+	_, body = executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, tracedJob())
+	if _, ok := body["elapsed_ms"]; ok {
+		t.Errorf("elapsed_ms = %v, want it omitted when time didn't report it", body["elapsed_ms"])
+	}
+	if _, ok := body["max_rss_kb"]; ok {
+		t.Errorf("max_rss_kb = %v, want it omitted when time didn't report it", body["max_rss_kb"])
+	}
+}
+
+func TestTaskTimeout(t *testing.T) {
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Timeout != defaultTimeout {
+		t.Errorf("task timeout = %s, want %s", task.Timeout, defaultTimeout)
+	}
+	// The program gets most of it, the rest is left to report what happened
+	if !strings.Contains(task.Run, "timeout 18 ") {
+		t.Errorf("the program isn't stopped before the task: %s", task.Run)
+	}
+	for timeout, want := range map[string]int{"20s": 18, "1s": 1, "500ms": 1, "2m": 108} {
+		if got := programTimeoutSeconds(timeout); got != want {
+			t.Errorf("programTimeoutSeconds(%s) = %d, want %d", timeout, got, want)
+		}
+	}
+}
+
+func TestJobListenerNeverBlocks(t *testing.T) {
+	result := make(chan jobResult, 1)
+	listener := newJobListener(result)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Nobody reads the result anymore, e.g. the client went away, and the event is delivered twice
+		listener(completedJob("first"))
+		listener(completedJob("second"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the listener blocked")
+	}
+	if r := <-result; r.output != "first" {
+		t.Errorf("result = %q, want the first one", r.output)
+	}
+}
+
+func TestHandlerReturnsWhenTheClientGoesAway(t *testing.T) {
+	withFakeEngine(t, func(*input.Job) *tork.Job { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}"}`)).WithContext(ctx)
+	c, rec := newTestContext(req)
+	go func() {
+		cancel()
+		close(c.(testContext).done)
+	}()
+
+	returned := make(chan error, 1)
+	go func() { returned <- Handler(c) }()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the handler is still waiting for the job")
+	}
+	if rec.Code != statusClientClosedRequest {
+		t.Errorf("status = %d, want %d", rec.Code, statusClientClosedRequest)
+	}
+}
+
+func TestJobWithoutExecution(t *testing.T) {
+	job := &tork.Job{ID: "job", State: tork.JobStateFailed, Error: "no worker for the queue"}
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, job)
+	e := errorOf(body)
+	if status != http.StatusInternalServerError || e["code"] != string(CodeNoExecutionResult) {
+		t.Errorf("response = %d %v, want %s", status, body, CodeNoExecutionResult)
+	}
+}
+
+func TestValidateFilename(t *testing.T) {
+	for _, name := range []string{"list.h", "list.c", "data_1.txt", "Makefile", "a-b.cpp"} {
+		if err := validateFilename(name); err != nil {
+			t.Errorf("validateFilename(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "../etc/passwd", "/etc/passwd", "dir/file.h", "dir\\file.h", ".hidden", "..",
+		"a..b", "file name.h", "x;rm -rf", "$(id).h", "-rf"} {
+		if err := validateFilename(name); !errors.Is(err, errInvalidFilename) {
+			t.Errorf("validateFilename(%q) = %v, want %v", name, err, errInvalidFilename)
+		}
+	}
+}
+
+func TestBuildTaskRejectsFilenames(t *testing.T) {
+	for _, name := range []string{"../list.h", "usercode.c", "usercode.h", "stdout.txt", "programInput.txt"} {
+		er := ExecRequest{Language: "c", Code: "int main() {}", Files: map[string]string{name: ""}}
+		if _, err := buildTask(context.Background(), er, defaultConfig()); err == nil {
+			t.Errorf("file %q was accepted", name)
+		}
+	}
+}
+
+func TestOutOfMemory(t *testing.T) {
+	tests := []struct {
+		name   string
+		job    *tork.Job
+		stdout string
+	}{
+		{name: "program killed", job: completedJob(metadataPrefix + "exit_code=137\n" + metadataPrefix + "stdout=before\n"), stdout: "before"},
+		{name: "container killed", job: failedJob("exit code 137")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, tt.job)
+			e := errorOf(body)
+			if status != http.StatusBadRequest || e["code"] != string(CodeOutOfMemory) || e["exception_msg"] != "out of memory" ||
+				body["phase"] != phaseRun {
+				t.Errorf("response = %d %v", status, body)
+			}
+			if stdout, _ := body["stdout"].(string); stdout != tt.stdout {
+				t.Errorf("stdout = %q, want %q", stdout, tt.stdout)
+			}
+		})
+	}
+
+	// Timeouts aren't mistaken for it
+	status, _ := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, completedJob(metadataPrefix+"timed_out=18\n"))
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("timeout = %d, want %d", status, http.StatusGatewayTimeout)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	for s, want := range map[string]int{"1": 1, " 42 ": 42, "0": unknownPosition, "-3": unknownPosition, "": unknownPosition, "x": unknownPosition} {
+		if got := position(s); got != want {
+			t.Errorf("position(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
+
+func TestCrashError(t *testing.T) {
+	trace := []traceStep{{Event: "step_line", Line: 2}, {Event: "step_line", Line: 4}}
+	tests := []struct {
+		exitCode int
+		message  string
+	}{
+		{exitCode: 139, message: "Segmentation fault (signal 11)"},
+		{exitCode: 134, message: "Aborted (signal 6)"},
+		{exitCode: 136, message: "Floating point exception (signal 8)"},
+	}
+	for _, tt := range tests {
+		crash, ok := crashError(tt.exitCode, trace)
+		if !ok || crash.Event != "runtime" || crash.ExceptionMsg != tt.message || crash.Line != 4 {
+			t.Errorf("crashError(%d) = %+v, %v", tt.exitCode, crash, ok)
+		}
+	}
+	for _, exitCode := range []int{0, 1, 137, 143} {
+		if crash, ok := crashError(exitCode, trace); ok {
+			t.Errorf("crashError(%d) = %+v, want no crash", exitCode, crash)
+		}
+	}
+	if crash, ok := crashError(139, nil); !ok || crash.Line != 0 {
+		t.Errorf("crash without a trace = %+v, %v", crash, ok)
+	}
+}
+
+func TestCrashResponse(t *testing.T) {
+	trace := `{"code":"int main() {}","trace":[{"event":"step_line","line":1}]}`
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(trace+"\n"+metadataPrefix+"exit_code=139\n"))
+	e := errorOf(body)
+	if status != http.StatusOK || e["exception_msg"] != "Segmentation fault (signal 11)" || e["line"] != 1.0 ||
+		body["phase"] != phaseRun {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestCompileOnly(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Action: actionCompile}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(task.Run, defaultConfig().ParserPath) {
+		t.Errorf("compiling only traces the program: %s", task.Run)
+	}
+	er.Language = "python"
+	if _, err := buildTask(context.Background(), er, defaultConfig()); err == nil {
+		t.Error("compiling Python only was accepted")
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {\n  int n;\n}","action":"compile"}`,
+		completedJob(metadataPrefix+"warning="+jobPath("usercode.c")+":2:7: warning: unused variable 'n' [-Wunused-variable]\n"))
+	warnings, _ := body["warnings"].([]any)
+	if status != http.StatusOK || body["event"] != "compiled" || body["phase"] != phaseComplete || len(warnings) != 1 ||
+		body["trace"] != nil {
+		t.Errorf("response = %d %v", status, body)
+	}
+
+	status, body = executeWith(t, Handler, `{"language":"c","code":"int main() {","action":"compile"}`,
+		compileFailedJob(jobPath("usercode.c")+":1:13: error: expected declaration or statement at end of input\n"))
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeCompileError) {
+		t.Errorf("compile error = %d %v", status, body)
+	}
+}
+
+func TestEmptyRequestsAreRejectedEarly(t *testing.T) {
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job { return completedJob("") })
+	tests := []struct {
+		body string
+		want ErrorCode
+	}{
+		{body: `{"language":"c"}`, want: CodeEmptyCode},
+		{body: `{"language":"c","code":" \n\t"}`, want: CodeEmptyCode},
+		{body: `{"code":"int main() {}"}`, want: CodeEmptyLanguage},
+		{body: `{"language":" ","code":"int main() {}"}`, want: CodeEmptyLanguage},
+	}
+	for _, tt := range tests {
+		c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(tt.body)))
+		if err := Handler(c); err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]any
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		if e := errorOf(body); rec.Code != http.StatusBadRequest || e["code"] != string(tt.want) {
+			t.Errorf("%s = %d %v, want %s", tt.body, rec.Code, body, tt.want)
+		}
+	}
+	if n := len(fake.submitted()); n != 0 {
+		t.Errorf("submitted %d jobs", n)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/json":                  true,
+		"Application/JSON; charset=utf-8":   true,
+		"":                                  false,
+		"text/plain":                        false,
+		"application/x-www-form-urlencoded": false,
+		"application/json;;":                false,
+	} {
+		if got := isJSON(contentType); got != want {
+			t.Errorf("isJSON(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+
+	req := newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	c, rec := newTestContext(req)
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), string(CodeUnsupportedMediaType)) {
+		t.Errorf("response = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestBuildTaskFlags(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowedFlags = []string{"-lm", "-pthread"}
+
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}", Flags: []string{" -lm", "-pthread"}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, "usercode.c -lm -pthread") {
+		t.Errorf("the flags don't follow the sources: %s", task.Run)
+	}
+
+	for _, er := range []ExecRequest{
+		{Language: "c", Code: "int main() {}", Flags: []string{"-O2"}},
+		{Language: "c", Code: "int main() {}", Flags: []string{"-lm; reboot"}},
+		{Language: "rust", Code: "fn main() {}", Flags: []string{"-lm"}},
+	} {
+		if _, err := buildTask(context.Background(), er, cfg); !errors.Is(err, errFlagNotAllowed) {
+			t.Errorf("flags %v of %s = %v, want %v", er.Flags, er.Language, err, errFlagNotAllowed)
+		}
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}","flags":["-fplugin=evil.so"]}`, nil)
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeFlagNotAllowed) {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	for s, want := range map[string]string{"a\r\nb\r\n": "a\nb\n", "a\rb": "a\nb", "a\nb": "a\nb", "\r\r\n": "\n\n"} {
+		if got := normalizeNewlines(s); got != want {
+			t.Errorf("normalizeNewlines(%q) = %q, want %q", s, got, want)
+		}
+	}
+
+	er := ExecRequest{Language: "c", Code: "int main() {\r\n}\r\n", Input: "1\r\n2", Files: map[string]string{"a.h": "#pragma once\r\n"}}
+	if apiErr := checkRequest(zerolog.Nop(), &er); apiErr != nil {
+		t.Fatal(apiErr.Message)
+	}
+	if er.Code != "int main() {\n}\n" || er.Input != "1\n2" || er.Files["a.h"] != "#pragma once\n" {
+		t.Errorf("request = %+v, want its line endings normalized", er)
+	}
+}
+
+func TestSanitizeErrorPaths(t *testing.T) {
+	withConfig(t, func(c *Config) { c.WorkDir = "/srv/code" })
+	tests := map[string]string{
+		"/srv/code/job.Ab12Cd/usercode.c:3:1: error":               "usercode.c:3:1: error",
+		"/srv/code/job.Ab12Cd/lib/util.h and /srv/code/job.Xy/a.c": "lib/util.h and a.c",
+		"/tmp/user_code/job.Ab12Cd/usercode.c":                     "/tmp/user_code/job.Ab12Cd/usercode.c",
+		"/usr/include/stdio.h:1: note":                             "/usr/include/stdio.h:1: note",
+		"ends in /srv/code/job.Ab12Cd":                             "ends in /srv/code/job.Ab12Cd",
+	}
+	for msg, want := range tests {
+		if got := sanitizeErrorPaths(msg); got != want {
+			t.Errorf("sanitizeErrorPaths(%q) = %q, want %q", msg, got, want)
+		}
+	}
+
+	trace := []traceStep{{Event: "exception", ExceptionMsg: "Invalid read in /srv/code/job.Ab12Cd/usercode.c"}}
+	sanitizeTracePaths(trace)
+	if trace[0].ExceptionMsg != "Invalid read in usercode.c" {
+		t.Errorf("trace error = %q", trace[0].ExceptionMsg)
+	}
+
+	var ret Ret
+	stderr := "/srv/code/job.Ab12Cd/usercode.c:1:1: error: '/srv/code/job.Ab12Cd/missing.h' not found\n"
+	if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ret.ErrorMsg.ExceptionMsg, "/srv/code") || strings.Contains(ret.RawOutput, "/srv/code") {
+		t.Errorf("compile error = %q, raw output %q", ret.ErrorMsg.ExceptionMsg, ret.RawOutput)
+	}
+}
+
+func TestValgrindTrace(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Trace: traceValgrind}
+	cfg := defaultConfig()
+	if _, err := buildTask(context.Background(), er, cfg); err == nil {
+		t.Error("the valgrind trace was accepted while it's disabled")
+	}
+	cfg.ValgrindTrace = true
+	task, err := buildTask(context.Background(), er, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, "usercode.vgtrace > $TORK_OUTPUT") {
+		t.Errorf("the valgrind trace isn't the output: %s", task.Run)
+	}
+	task, err = buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(task.Run, "usercode.vgtrace") {
+		t.Errorf("the valgrind trace is the output of a request that didn't ask for it: %s", task.Run)
+	}
+	for _, er := range []ExecRequest{
+		{Language: "python", Code: "pass", Trace: traceValgrind},
+		{Language: "c", Code: "int main() {}", Trace: traceValgrind, Action: actionCompile},
+		{Language: "c", Code: "int main() {}", Trace: "gdb"},
+	} {
+		if _, err := buildTask(context.Background(), er, cfg); err == nil {
+			t.Errorf("trace %s of %+v was accepted", er.Trace, er)
+		}
+	}
+
+	// The raw trace is returned as it is, a parsed one as an object
+	withConfig(t, func(c *Config) { c.ValgrindTrace = true })
+	withFakeEngine(t, func(*input.Job) *tork.Job { return completedJob("==1== raw valgrind trace\n") })
+	c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}","trace":"valgrind"}`)))
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	var raw string
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil || rec.Code != http.StatusOK || raw != "==1== raw valgrind trace\n" {
+		t.Errorf("valgrind trace = %d %s", rec.Code, rec.Body)
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(`{"code":"int main() {}","trace":[]}`+"\n"+metadataPrefix+"exit_code=0\n"))
+	if _, ok := body["trace"].([]any); status != http.StatusOK || !ok {
+		t.Errorf("parsed trace = %d %v", status, body)
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxBodyBytes = 64 })
+	body := `{"language":"c","code":"` + strings.Repeat("x", 128) + `"}`
+
+	for _, chunked := range []bool{false, true} {
+		req := newJSONRequest("/execute", strings.NewReader(body))
+		if chunked {
+			// Without a Content-Length, only reading the body finds out
+			req.ContentLength = -1
+		}
+		c, rec := newTestContext(req)
+		if err := Handler(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunked %v: status = %d, want %d", chunked, rec.Code, http.StatusRequestEntityTooLarge)
+		}
+		checkEnvelope(t, http.StatusRequestEntityTooLarge, rec.Body.Bytes(), CodeBodyTooLarge)
+	}
+}
+
+func TestBuildTaskPython(t *testing.T) {
+	task, err := buildTask(context.Background(), ExecRequest{Language: "python", Code: "print(1)"}, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := task.Files["usercode.py"]; !ok {
+		t.Errorf("files = %v, want usercode.py", task.Files)
+	}
+	// The parser runs the program, there's nothing to compile
+	if strings.Contains(task.Run, "gcc") || !strings.Contains(task.Run, defaultParserPath+" python "+workDir) {
+		t.Errorf("python isn't interpreted by the parser: %s", task.Run)
+	}
+}
+
+func TestPythonErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  string
+		event string
+		phase string
+	}{
+		{
+			name:  "uncaught exception",
+			step:  `{"event":"uncaught_exception","line":2,"exception_msg":"ZeroDivisionError: division by zero"}`,
+			event: "runtime",
+			phase: phaseRun,
+		},
+		{
+			name:  "syntax error",
+			step:  `{"event":"uncaught_exception","line":1,"offset":7,"exception_msg":"SyntaxError: invalid syntax"}`,
+			event: "syntax",
+			phase: phaseCompile,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace := `{"code":"x = 1\nprint(x / 0)","trace":[` + tt.step + `]}`
+			status, body := executeWith(t, Handler, `{"language":"python","code":"x = 1\nprint(x / 0)"}`,
+				completedJob(trace+"\n"+metadataPrefix+"exit_code=1\n"))
+			e := errorOf(body)
+			if status != http.StatusOK || e["event"] != tt.event || body["phase"] != tt.phase {
+				t.Errorf("response = %d %v", status, body)
+			}
+		})
+	}
+}
+
+func TestRequestedTimeout(t *testing.T) {
+	ms := func(n int) *int { return &n }
+	tests := []struct {
+		name      string
+		timeoutMs *int
+		want      string
+	}{
+		{name: "absent", want: defaultTimeout},
+		{name: "shorter", timeoutMs: ms(5000), want: "5s"},
+		{name: "below the minimum", timeoutMs: ms(10), want: minTimeout.String()},
+		{name: "above the maximum", timeoutMs: ms(600000), want: defaultTimeout},
+	}
+	for _, tt := range tests {
+		er := ExecRequest{Language: "c", Code: "int main() {}", TimeoutMs: tt.timeoutMs}
+		task, err := buildTask(context.Background(), er, defaultConfig())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if task.Timeout != tt.want {
+			t.Errorf("%s: task timeout = %s, want %s", tt.name, task.Timeout, tt.want)
+		}
+	}
+
+	for _, body := range []string{`"timeout_ms":0`, `"timeout_ms":-100`} {
+		status, resp := executeWith(t, Handler, `{"language":"c","code":"int main() {}",`+body+`}`, nil)
+		if e := errorOf(resp); status != http.StatusBadRequest || e["code"] != string(CodeInvalidTimeout) {
+			t.Errorf("%s = %d %v", body, status, resp)
+		}
+	}
+	status, resp := executeWith(t, Handler, `{"language":"c","code":"int main() {}","timeout_ms":1.5}`, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("fractional timeout = %d %v", status, resp)
+	}
+}
+
+func TestPartialOutput(t *testing.T) {
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Running it twice could print something else the second time
+	if n := strings.Count(task.Run, defaultParserPath); n != 1 {
+		t.Errorf("the program runs %d times: %s", n, task.Run)
+	}
+
+	trace := `{"code":"int main() {}","trace":[{"event":"step_line","line":1}]}`
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(trace+"\n"+metadataPrefix+"exit_code=139\n"+metadataPrefix+"stdout=before the crash\n"))
+	if status != http.StatusOK || body["stdout"] != "before the crash" || body["error"] == nil {
+		t.Errorf("crash = %d %v", status, body)
+	}
+	status, body = executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(metadataPrefix+"timed_out=18\n"+metadataPrefix+"stdout=1\n"+metadataPrefix+"stdout=2\n"+metadataPrefix+"stderr=oops\n"))
+	if status != http.StatusGatewayTimeout || body["stdout"] != "1\n2" || body["stderr"] != "oops" {
+		t.Errorf("timeout = %d %v", status, body)
+	}
+}
+
+func TestParserPath(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ParserPath = "/opt/parser/v2/wsgi_backend.py"
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, " python3 /opt/parser/v2/wsgi_backend.py ") || strings.Contains(task.Run, defaultParserPath) {
+		t.Errorf("the configured parser isn't run: %s", task.Run)
+	}
+}
+
+func TestExitCode124IsNotATimeout(t *testing.T) {
+	trace := `{"code":"int main() { return 124; }","trace":[]}`
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() { return 124; }"}`,
+		completedJob(trace+"\n"+metadataPrefix+"exit_code=124\n"))
+	if status != http.StatusOK || body["exit_code"] != 124.0 || body["event"] == "timeout" {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestOutputTruncation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxOutputBytes = 4096
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The outputs are cut in the task, so they're never read whole
+	if n := strings.Count(task.Run, "head -c 4096 "); n < 3 {
+		t.Errorf("the trace, stdout and stderr aren't all truncated: %s", task.Run)
+	}
+
+	for s, want := range map[string]string{"abc": "abc", "ab\xc3": "ab", "a\xe2\x82": "a", "é": "é", "": ""} {
+		if got := trimPartialRune(s); got != want {
+			t.Errorf("trimPartialRune(%q) = %q, want %q", s, got, want)
+		}
+	}
+
+	trace := `{"code":"int main() {}","trace":[]}`
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(trace+"\n"+metadataPrefix+"exit_code=0\n"+metadataPrefix+"stdout=aaaa\xc3\n"+metadataPrefix+"truncated=stdout\n"))
+	if status != http.StatusOK || body["stdout"] != "aaaa"+truncationMarker || body["truncated"] != true {
+		t.Errorf("truncated stdout = %d %v", status, body)
+	}
+
+	status, body = executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(`{"code":"int main() {}","tra`+"\n"+metadataPrefix+"truncated=trace\n"+metadataPrefix+"exit_code=0\n"))
+	if trace, _ := body["trace"].([]any); status != http.StatusOK || body["truncated"] != true || len(trace) != 0 || body["error"] == nil {
+		t.Errorf("truncated trace = %d %v", status, body)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	task, err := buildTask(ctx, er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout, _ := time.ParseDuration(task.Timeout); timeout > 5*time.Second || timeout < 4*time.Second {
+		t.Errorf("task timeout = %s, want the deadline of the request", task.Timeout)
+	}
+
+	// The shortest of the deadline and the requested timeout wins
+	timeoutMs := 2000
+	er.TimeoutMs = &timeoutMs
+	if task, err = buildTask(ctx, er, defaultConfig()); err != nil || task.Timeout != "2s" {
+		t.Errorf("task timeout = %s, %v, want 2s", task.Timeout, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if task, err = buildTask(ctx, ExecRequest{Language: "c", Code: "int main() {}"}, defaultConfig()); err != nil || task.Timeout != defaultTimeout {
+		t.Errorf("task timeout = %s, %v, want the configured %s", task.Timeout, err, defaultTimeout)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Action: actionValidate}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, " -fsyntax-only ") || strings.Contains(task.Run, defaultParserPath) {
+		t.Errorf("validating runs more than the syntax check: %s", task.Run)
+	}
+	er.Language = "python"
+	if _, err := buildTask(context.Background(), er, defaultConfig()); err == nil {
+		t.Error("validating Python was accepted")
+	}
+
+	status, body := executeWith(t, Validate, `{"language":"c","code":"int main() {}"}`, completedJob(""))
+	if errs, _ := body["errors"].([]any); status != http.StatusOK || body["event"] != "valid" || errs == nil || len(errs) != 0 {
+		t.Errorf("valid code = %d %v", status, body)
+	}
+
+	status, body = executeWith(t, Validate, `{"language":"c","code":"int main() {"}`,
+		compileFailedJob(jobPath("usercode.c")+":1:13: error: expected declaration or statement at end of input\n"))
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeCompileError) || e["line"] != 1.0 {
+		t.Errorf("invalid code = %d %v", status, body)
+	}
+}
+
+func TestWithSnippet(t *testing.T) {
+	code := "int main() {\n\tint *p = 0;\n\t*p = 1;\n\treturn 0;\n}"
+	tests := []struct {
+		line  int
+		lines []int
+	}{
+		{line: 1, lines: []int{1, 2}},
+		{line: 3, lines: []int{2, 3, 4}},
+		{line: 5, lines: []int{4, 5}},
+		{line: 0},
+		{line: 6},
+	}
+	for _, tt := range tests {
+		e := ErrorMsg{Line: tt.line}.withSnippet(code)
+		if len(e.Snippet) != len(tt.lines) {
+			t.Errorf("snippet of line %d = %+v, want lines %v", tt.line, e.Snippet, tt.lines)
+			continue
+		}
+		for i, l := range e.Snippet {
+			if l.Line != tt.lines[i] || l.Text != strings.Split(code, "\n")[l.Line-1] {
+				t.Errorf("snippet of line %d = %+v, want lines %v", tt.line, e.Snippet, tt.lines)
+			}
+		}
+	}
+}
+
+func TestForbiddenConstruct(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ForbiddenPatterns = []*regexp.Regexp{regexp.MustCompile(`#\s*include\s*<sys/socket\.h>`), regexp.MustCompile(`\bfork\s*\(`)}
+	})
+
+	tests := []struct {
+		er   ExecRequest
+		want string
+	}{
+		{er: ExecRequest{Code: "#include <stdio.h>\nint main() {}"}},
+		{er: ExecRequest{Code: "#include  <sys/socket.h>\nint main() {}"}, want: "#include  <sys/socket.h>"},
+		{er: ExecRequest{Code: "int main() { fork (); }"}, want: "fork ("},
+		{er: ExecRequest{Code: "int main() {}", Files: map[string]string{"net.h": "#include <sys/socket.h>"}}, want: "#include <sys/socket.h>"},
+		{er: ExecRequest{Code: "int forklift() {}"}},
+	}
+	for _, tt := range tests {
+		construct, ok := forbiddenConstruct(tt.er, config)
+		if ok != (tt.want != "") || construct != tt.want {
+			t.Errorf("forbiddenConstruct(%q) = %q, %v, want %q", tt.er.Code, construct, ok, tt.want)
+		}
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() { fork(); }"}`, nil)
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeForbiddenConstruct) {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestGzipBody(t *testing.T) {
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job {
+		return tracedJob()
+	})
+	request := func(body io.Reader, encoding string) *httptest.ResponseRecorder {
+		req := newJSONRequest("/execute", body)
+		req.Header.Set("Content-Encoding", encoding)
+		c, rec := newTestContext(req)
+		if err := Handler(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	if rec := request(gzipped(t, `{"language":"c","code":"int main() {}"}`), "GZIP"); rec.Code != http.StatusOK {
+		t.Errorf("gzipped body = %d %s", rec.Code, rec.Body)
+	}
+	if n := len(fake.submitted()); n != 1 {
+		t.Fatalf("submitted %d jobs, want 1", n)
+	}
+	if code := fake.submitted()[0].Tasks[0].Files["usercode.c"]; code != "int main() {}" {
+		t.Errorf("code = %q", code)
+	}
+
+	rec := request(strings.NewReader(`{"language":"c","code":"int main() {}"}`), "gzip")
+	checkEnvelope(t, http.StatusBadRequest, rec.Body.Bytes(), CodeInvalidGzip)
+	rec = request(strings.NewReader(`{"language":"c","code":"int main() {}"}`), "br")
+	checkEnvelope(t, http.StatusUnsupportedMediaType, rec.Body.Bytes(), CodeUnsupportedEncoding)
+
+	// The limit applies to the decompressed body
+	withConfig(t, func(c *Config) { c.MaxBodyBytes = 256 })
+	rec = request(gzipped(t, `{"language":"c","code":"`+strings.Repeat("x", 4096)+`"}`), "gzip")
+	checkEnvelope(t, http.StatusRequestEntityTooLarge, rec.Body.Bytes(), CodeBodyTooLarge)
+}
+
+func TestAssertionError(t *testing.T) {
+	e, ok := assertionError("usercode: " + jobPath("usercode.c") + ":5: main: Assertion `p != NULL' failed.\n")
+	if !ok || e.Event != "assertion" || e.Line != 5 || e.File != "usercode.c" || e.Function != "main" ||
+		e.Expression != "p != NULL" || e.ExceptionMsg != "Assertion `p != NULL' failed" {
+		t.Errorf("assertion = %+v, %v", e, ok)
+	}
+	// glibc quotes with ‘’ in UTF-8 locales, and the function can have its signature
+	e, ok = assertionError(jobPath("usercode.c") + ":12: int find(int*, int): Assertion ‘n > 0’ failed.")
+	if !ok || e.Line != 12 || e.Function != "int find(int*, int)" || e.Expression != "n > 0" {
+		t.Errorf("assertion = %+v, %v", e, ok)
+	}
+	for _, msg := range []string{"", "Segmentation fault", "usercode.c:5: error: expected ';'"} {
+		if e, ok := assertionError(msg); ok {
+			t.Errorf("assertionError(%q) = %+v", msg, e)
+		}
+	}
+
+	trace := `{"code":"","trace":[{"event":"step_line","line":5}]}`
+	status, body := executeWith(t, Handler, `{"language":"c","code":"#include <assert.h>\nint main() {\n\tint *p = 0;\n\n\tassert(p != NULL);\n}"}`,
+		completedJob(trace+"\n"+metadataPrefix+"exit_code=134\n"+metadataPrefix+"assertion=usercode: "+jobPath("usercode.c")+
+			":5: main: Assertion `p != NULL' failed.\n"))
+	e2 := errorOf(body)
+	snippet, _ := e2["snippet"].([]any)
+	if status != http.StatusOK || e2["event"] != "assertion" || e2["line"] != 5.0 || len(snippet) == 0 || body["phase"] != phaseRun {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestProgramArgs(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Args: []string{"two words", "$(reboot)", ""}}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := task.Files["programArgs.txt"]; args != "two words\n$(reboot)\n\n" {
+		t.Errorf("arguments file = %q", args)
+	}
+	if strings.Contains(task.Run, "reboot") {
+		t.Errorf("the arguments reach the shell: %s", task.Run)
+	}
+
+	tests := []struct {
+		args []string
+		want ErrorCode
+	}{
+		{args: []string{"a\nb"}, want: CodeInvalidArgs},
+		{args: []string{"a\x00"}, want: CodeInvalidArgs},
+		{args: make([]string, maxArgs+1), want: CodeArgsTooLarge},
+		{args: []string{strings.Repeat("x", maxArgsBytes)}, want: CodeArgsTooLarge},
+		{args: make([]string, maxArgs)},
+	}
+	for _, tt := range tests {
+		if got := checkRequestCode(ExecRequest{Language: "c", Code: "int main() {}", Args: tt.args}); got != tt.want {
+			t.Errorf("%d arguments: checkRequest() = %q, want %q", len(tt.args), got, tt.want)
+		}
+	}
+}
+
+func TestTabIndentedColumn(t *testing.T) {
+	withConfig(t, func(c *Config) { c.TabWidth = 4 })
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gcc counts a tab as one column only with it
+	if !strings.Contains(task.Run, " -ftabstop=1 ") {
+		t.Errorf("the columns of gcc aren't bytes: %s", task.Run)
+	}
+
+	code := "int main() {\n\tint x = y;\n}"
+	stderr := jobPath("usercode.c") + ":2:10: error: 'y' undeclared (first use in this function)\n" +
+		jobPath("util.h") + ":1:3: error: unknown type name 'foo'\n"
+	var ret Ret
+	if err := json.Unmarshal([]byte(handleGccError(code, stderr)), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Errors) != 2 {
+		t.Fatalf("errors = %+v", ret.Errors)
+	}
+	if ret.Errors[0].Column != 13 {
+		t.Errorf("column in the code = %d, want 13", ret.Errors[0].Column)
+	}
+	// Only the code is known, so the columns of other files are left as they are
+	if ret.Errors[1].Column != 3 {
+		t.Errorf("column in a header = %d, want 3", ret.Errors[1].Column)
+	}
+}
+
+func TestAssembly(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Emit: emitAsm}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, " -S -o "+workDir+"/usercode.s ") || strings.Contains(task.Run, defaultParserPath) {
+		t.Errorf("the assembly isn't generated without running the program: %s", task.Run)
+	}
+	for _, er := range []ExecRequest{
+		{Language: "python", Code: "pass", Emit: emitAsm},
+		{Language: "c", Code: "int main() {}", Emit: emitAsm, Action: actionValidate},
+		{Language: "c", Code: "int main() {}", Emit: "llvm"},
+	} {
+		if _, err := buildTask(context.Background(), er, defaultConfig()); err == nil {
+			t.Errorf("emit %s of %+v was accepted", er.Emit, er)
+		}
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}","emit":"asm"}`,
+		completedJob(metadataPrefix+"assembly=\t.file\t\""+jobPath("usercode.c")+"\"\n"+metadataPrefix+"assembly=main:\n"))
+	if status != http.StatusOK || body["event"] != "assembled" || body["assembly"] != "\t.file\t\"usercode.c\"\nmain:" {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestNonZeroExitWithTrace(t *testing.T) {
+	trace := `{"code":"int main() { return 1; }","trace":[{"event":"step_line","line":1},{"event":"return","line":1}]}`
+	tests := []struct {
+		name string
+		job  *tork.Job
+	}{
+		{name: "completed", job: completedJob(trace + "\n" + metadataPrefix + "exit_code=1\n")},
+		// The engine may report the task as failed when the program exited with an error
+		{name: "failed", job: failedJob(trace + "\n" + metadataPrefix + "exit_code=1\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := executeWith(t, Handler, `{"language":"c","code":"int main() { return 1; }"}`, tt.job)
+			steps, _ := body["trace"].([]any)
+			if status != http.StatusOK || body["exit_code"] != 1.0 || len(steps) != 2 || body["error"] != nil ||
+				body["phase"] != phaseComplete {
+				t.Errorf("response = %d %v", status, body)
+			}
+		})
+	}
+}
+
+func TestParserVersion(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ParserVersions = map[string]string{"v2": "/opt/parser/v2/wsgi_backend.py"} })
+
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}", ParserVersion: " v2 "}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, " python3 /opt/parser/v2/wsgi_backend.py ") {
+		t.Errorf("the parser of the version isn't run: %s", task.Run)
+	}
+	task, err = buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, " python3 "+config.ParserPath+" ") {
+		t.Errorf("the default parser isn't run without a version: %s", task.Run)
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}","parser_version":"v3"}`, nil)
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeUnknownParserVersion) {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestDiagnosticsOfCAndCPP(t *testing.T) {
+	for _, name := range []string{"usercode.c", "usercode.cpp"} {
+		stderr := jobPath(name) + ":2:5: warning: unused variable 'n' [-Wunused-variable]\n" +
+			jobPath(name) + ":3:1: error: expected ';' before '}' token\n"
+
+		warnings := parseGccWarnings("", stderr)
+		if len(warnings) != 1 || warnings[0].File != name || warnings[0].Line != 2 || warnings[0].Column != 5 {
+			t.Errorf("warnings of %s = %+v", name, warnings)
+		}
+		var ret Ret
+		if err := json.Unmarshal([]byte(handleGccError("", stderr)), &ret); err != nil {
+			t.Fatal(err)
+		}
+		if len(ret.Errors) != 1 || ret.Errors[0].File != name || ret.Errors[0].Line != 3 || ret.Errors[0].Column != 1 {
+			t.Errorf("errors of %s = %+v", name, ret.Errors)
+		}
+	}
+}
+
+func TestProgramEnv(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Env = map[string]string{"LANG": "C.UTF-8", "TZ": "UTC"}
+	cfg.AllowedEnv = []string{"TZ", "SEED"}
+
+	env, err := programEnv(ExecRequest{Env: map[string]string{"TZ": "America/Recife", "SEED": "$(id)"}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"LANG": "C.UTF-8", "TZ": "America/Recife", "SEED": "$(id)"}
+	if len(env) != len(want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+	for name, value := range want {
+		if env[name] != value {
+			t.Errorf("%s = %q, want %q", name, env[name], value)
+		}
+	}
+
+	for _, requested := range []map[string]string{{"LD_PRELOAD": "/tmp/evil.so"}, {"LANG": "C"}, {"TZ": "UTC\x00"}} {
+		if _, err := programEnv(ExecRequest{Env: requested}, cfg); !errors.Is(err, errEnvNotAllowed) {
+			t.Errorf("env %q = %v, want %v", requested, err, errEnvNotAllowed)
+		}
+	}
+
+	// The values are passed to the engine, never through the shell
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}", Env: map[string]string{"SEED": "$(id)"}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Env["SEED"] != "$(id)" || strings.Contains(task.Run, "$(id)") {
+		t.Errorf("env = %v, run %s", task.Env, task.Run)
+	}
+}
+
+func TestDebugCompileCommand(t *testing.T) {
+	cfg := defaultConfig()
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(task.Run, "compile_command") {
+		t.Errorf("the compile command is reported without debug: %s", task.Run)
+	}
+	cfg.Debug = true
+	if task, err = buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, metadataPrefix+"compile_command=gcc ") {
+		t.Errorf("the compile command isn't reported with debug: %s", task.Run)
+	}
+
+	job := tracedJob("compile_command=gcc -o " + jobPath("usercode") + " " + jobPath("usercode.c"))
+	_, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, job)
+	if body["debug"] != nil {
+		t.Errorf("the compile command is returned without debug: %v", body["debug"])
+	}
+	withConfig(t, func(c *Config) { c.Debug = true })
+	_, body = executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, job)
+	if debug, _ := body["debug"].(map[string]any); debug["compile_command"] != "gcc -o usercode usercode.c" {
+		t.Errorf("debug = %v", body["debug"])
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	job := tracedJob()
+	body := `{"language":"c","code":"int main() {}","theme":"dark"}`
+	if status, resp := executeWith(t, Handler, body, job); status != http.StatusOK {
+		t.Errorf("unknown field = %d %v, want it ignored", status, resp)
+	}
+
+	withConfig(t, func(c *Config) { c.StrictJSON = true })
+	status, resp := executeWith(t, Handler, body, job)
+	e := errorOf(resp)
+	if status != http.StatusBadRequest || e["code"] != string(CodeUnknownField) || e["message"] != `unknown field "theme"` {
+		t.Errorf("unknown field of a strict server = %d %v", status, resp)
+	}
+	if status, resp := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, job); status != http.StatusOK {
+		t.Errorf("known fields of a strict server = %d %v", status, resp)
+	}
+	if status, resp := executeWith(t, Handler, `{"language":"c","code":`, job); status != http.StatusBadRequest {
+		t.Errorf("invalid JSON of a strict server = %d %v", status, resp)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	overflow := []traceStep{{Event: "exception", Line: 3,
+		ExceptionMsg: "Stack overflow in thread #1: can't grow stack to 0x1ffe801000"}}
+	crash, ok := crashError(139, overflow)
+	if !ok || crash.Event != "stack_overflow" || crash.ExceptionMsg != "Stack overflow (signal 11)" || crash.Hint == "" || crash.Line != 3 {
+		t.Errorf("stack overflow = %+v, %v", crash, ok)
+	}
+
+	// Every invalid access mentions the stack, so only the report of valgrind counts
+	invalid := []traceStep{{Event: "exception", Line: 3,
+		ExceptionMsg: "Invalid write of size 4. Address 0x0 is not stack'd, malloc'd or (recently) free'd. This may be a stack overflow"}}
+	if crash, ok := crashError(139, invalid); !ok || crash.Event != "runtime" {
+		t.Errorf("invalid access = %+v, %v", crash, ok)
+	}
+	// Only segmentation faults
+	if crash, ok := crashError(134, overflow); !ok || crash.Event != "runtime" {
+		t.Errorf("abort = %+v, %v", crash, ok)
+	}
+}
+
+func TestInputLimits(t *testing.T) {
+	for s, want := range map[string]int{"": 0, "1": 1, "1\n": 1, "1\n2": 2, "\n\n": 2} {
+		if got := countLines(s); got != want {
+			t.Errorf("countLines(%q) = %d, want %d", s, got, want)
+		}
+	}
+
+	withConfig(t, func(c *Config) {
+		c.MaxInputBytes = 16
+		c.MaxInputLines = 3
+	})
+	tests := []struct {
+		er   ExecRequest
+		want ErrorCode
+	}{
+		{er: ExecRequest{Input: "1 2 3"}},
+		{er: ExecRequest{Stdin: "1\n2\n3\n"}},
+		{er: ExecRequest{Stdin: "1\n2\n3\n4"}, want: CodeInputTooLarge},
+		{er: ExecRequest{Input: strings.Repeat("1", 17)}, want: CodeInputTooLarge},
+		{er: ExecRequest{Stdin: strings.Repeat("1", 17)}, want: CodeInputTooLarge},
+	}
+	for _, tt := range tests {
+		tt.er.Language, tt.er.Code = "c", "int main() {}"
+		if got := checkRequestCode(tt.er); got != tt.want {
+			t.Errorf("input %q, stdin %q: checkRequest() = %q, want %q", tt.er.Input, tt.er.Stdin, got, tt.want)
+		}
+	}
+
+	// Without a limit of lines, only the bytes count
+	config.MaxInputLines = 0
+	if got := checkRequestCode(ExecRequest{Language: "c", Code: "int main() {}", Stdin: "1\n2\n3\n4\n5\n"}); got != "" {
+		t.Errorf("lines without a limit: checkRequest() = %q", got)
+	}
+}
+
+func TestPhase(t *testing.T) {
+	trace := `{"code":"int main() {}","trace":[{"event":"step_line","line":1}]}` + "\n"
+	tests := []struct {
+		name string
+		job  *tork.Job
+		want string
+	}{
+		{name: "success", job: completedJob(trace + metadataPrefix + "exit_code=0\n"), want: phaseComplete},
+		{name: "compile error", job: compileFailedJob(jobPath("usercode.c") + ":1:13: error: expected ';'\n"), want: phaseCompile},
+		{name: "link error", job: completedJob("/usr/bin/ld: " + jobPath("usercode.c") + ":1: undefined reference to `f'\n" +
+			metadataPrefix + "compile_failed=1\n"), want: phaseLink},
+		{name: "crash", job: completedJob(trace + metadataPrefix + "exit_code=139\n"), want: phaseRun},
+		{name: "timeout", job: completedJob(metadataPrefix + "timed_out=18\n"), want: phaseRun},
+		{name: "out of memory", job: completedJob(metadataPrefix + "exit_code=137\n"), want: phaseRun},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`, tt.job)
+			if body["phase"] != tt.want {
+				t.Errorf("phase = %v, want %s", body["phase"], tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggedCode(t *testing.T) {
+	buf := withLogger(t, zerolog.DebugLevel)
+
+	code := "int main() {} /* " + strings.Repeat("x", 2*maxLoggedBytes) + " */"
+	executeWith(t, Handler, `{"language":"c","code":`+jsonString(code)+`}`, completedJob(`{"code":"","trace":[]}`))
+	logged := buf.String()
+	if strings.Contains(logged, code) {
+		t.Error("the whole code is logged")
+	}
+	if !strings.Contains(logged, code[:maxLoggedBytes]) || !strings.Contains(logged, "more bytes") {
+		t.Errorf("the start of the code isn't logged: %s", logged)
+	}
+
+	buf = withLogger(t, zerolog.InfoLevel)
+	executeWith(t, Handler, `{"language":"c","code":`+jsonString(code)+`}`, completedJob(`{"code":"","trace":[]}`))
+	if strings.Contains(buf.String(), "int main") {
+		t.Errorf("the code is logged without debug logging: %s", buf.String())
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	if got := logPrefix("short"); got != "short" {
+		t.Errorf("logPrefix(short) = %q", got)
+	}
+	// The cut falls inside the 2-byte é, which is left out whole
+	s := strings.Repeat("x", maxLoggedBytes-1) + "é" + "tail"
+	want := strings.Repeat("x", maxLoggedBytes-1) + "... (6 more bytes)"
+	if got := logPrefix(s); got != want {
+		t.Errorf("logPrefix() = %q, want %q", got, want)
+	}
+}
+
+func TestParserError(t *testing.T) {
+	buf := withLogger(t, zerolog.ErrorLevel)
+	traceback := "Traceback (most recent call last):\n  File \"wsgi_backend.py\", line 1\nKeyError: 'frame'"
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}"}`,
+		completedJob(traceback+"\n"+metadataPrefix+"exit_code=0\n"))
+	if status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+	if e := errorOf(body); e["code"] != string(CodeParserError) {
+		t.Errorf("body = %v, want %s", body, CodeParserError)
+	}
+
+	var entry struct {
+		Level     string `json:"level"`
+		RequestID string `json:"request_id"`
+		Output    string `json:"output"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, buf)
+	}
+	if entry.Level != "error" || entry.RequestID == "" || !strings.Contains(entry.Output, "KeyError: 'frame'") {
+		t.Errorf("logged %s, want the parser's output with the request id", buf)
+	}
+}
+
+func TestFastCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		fast  bool
+		er    ExecRequest
+		debug bool
+	}{
+		{name: "traced", fast: true, er: ExecRequest{Language: "c", Code: "int main() {}"}, debug: true},
+		{name: "compile only", fast: true, er: ExecRequest{Language: "c", Code: "int main() {}", Action: actionCompile}},
+		{name: "runs of a batch", fast: true, er: ExecRequest{Language: "c", Code: "int main() {}", inputs: []string{"1"}}},
+		{name: "disabled", er: ExecRequest{Language: "c", Code: "int main() {}", Action: actionCompile}, debug: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.FastCompile = tt.fast
+			task, err := buildTask(context.Background(), tt.er, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if debug := strings.Contains(task.Run, " -ggdb "); debug != tt.debug {
+				t.Errorf("-ggdb passed = %v, want %v: %s", debug, tt.debug, task.Run)
+			}
+		})
+	}
+}
+
+func TestUTF8Code(t *testing.T) {
+	code := "#include <stdio.h>\n// привет, 世界\nint main() { printf(\"héllo 🌍\\n\"); }"
+	er := ExecRequest{Language: "c", Code: code, Input: "ñandú", Args: []string{"café"}}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Files["usercode.c"] != code || task.Files["programInput.txt"] != "ñandú\n" || task.Files["programArgs.txt"] != "café\n" {
+		t.Errorf("files = %q, want the bytes of the request", task.Files)
+	}
+
+	trace, _ := json.Marshal(map[string]any{"code": code, "trace": []any{}})
+	status, body := executeWith(t, Handler, `{"language":"c","code":`+jsonString(code)+`}`,
+		completedJob(string(trace)+"\n"+metadataPrefix+"exit_code=0\n"+metadataPrefix+"stdout=héllo 🌍\n"))
+	if status != http.StatusOK || body["stdout"] != "héllo 🌍" || body["code"] != code {
+		t.Errorf("response = %d %v, want the UTF-8 code and output", status, body)
+	}
+}
+
+func TestPointerHints(t *testing.T) {
+	code := "int *f() {\n  int x = 1;\n  return &x;\n}\nint main() {\n  int *p;\n  printf(\"%d\", p);\n  return *p + *f();\n}"
+	warnings := []string{
+		":3:10: warning: function returns address of local variable [-Wreturn-local-addr]",
+		":7:12: warning: format '%d' expects argument of type 'int', but argument 2 has type 'int *' [-Wformat=]",
+		":8:10: warning: 'p' may be used uninitialized in this function [-Wmaybe-uninitialized]",
+	}
+	var output string
+	for _, w := range warnings {
+		output += metadataPrefix + "warning=" + jobPath("usercode.c") + w + "\n"
+	}
+	status, body := executeWith(t, Handler, `{"language":"c","code":`+jsonString(code)+`}`,
+		completedJob(emptyTrace+output+metadataPrefix+"exit_code=0\n"))
+	got, _ := body["warnings"].([]any)
+	if status != http.StatusOK || len(got) != len(warnings) {
+		t.Fatalf("response = %d %v, want %d warnings", status, body, len(warnings))
+	}
+
+	want := []string{localAddressHint, "", uninitializedHint}
+	for i, w := range got {
+		w := w.(map[string]any)
+		category, _ := w["category"].(string)
+		hint, _ := w["hint"].(string)
+		if hint != want[i] || (hint != "") != (category == pointerHintCategory) {
+			t.Errorf("warning %d = %v, want the hint %q", i, w, want[i])
+		}
+		// The hint comes with the warning of the compiler, not instead of it
+		if msg, _ := w["exception_msg"].(string); !strings.HasPrefix(msg, "warning: ") {
+			t.Errorf("warning %d lost the compiler's message: %v", i, w)
+		}
+	}
+}
+
+func TestOptimization(t *testing.T) {
+	tests := []struct {
+		name string
+		er   ExecRequest
+		want string
+	}{
+		{name: "compile only", er: ExecRequest{Language: "c", Code: "int main() {}", Action: actionCompile, Optimization: "O2"}, want: " -O2"},
+		{name: "assembly", er: ExecRequest{Language: "c++", Code: "int main() {}", Emit: emitAsm, Optimization: "Os"}, want: " -Os"},
+		{name: "rust", er: ExecRequest{Language: "rust", Code: "fn main() {}", Action: actionCompile, Optimization: "O3"}, want: "opt-level=3"},
+		// The trace needs the variables the optimizer removes
+		{name: "traced", er: ExecRequest{Language: "c", Code: "int main() {}", Optimization: "O2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task, err := buildTask(context.Background(), tt.er, defaultConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != "" && !strings.Contains(task.Run, tt.want) {
+				t.Errorf("%s isn't passed: %s", tt.want, task.Run)
+			}
+			if tt.want == "" && strings.Contains(task.Run, " -O2") {
+				t.Errorf("a traced program is optimized: %s", task.Run)
+			}
+		})
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}","optimization":"O9"}`, nil)
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeInvalidRequest) {
+		t.Errorf("unknown level = %d %v", status, body)
+	}
+}
+
+func TestCaptureFiles(t *testing.T) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", CaptureFiles: []string{"out.txt", "data/log.txt"}}
+	task, err := buildTask(context.Background(), er, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, "if [ -f out.txt ]") || !strings.Contains(task.Run, "if [ -f data/log.txt ]") {
+		t.Errorf("the files aren't read back: %s", task.Run)
+	}
+
+	for _, path := range []string{"../out.txt", "/etc/passwd", "data/../../out.txt", "out file.txt", "out.txt; reboot"} {
+		status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}","capture_files":[`+jsonString(path)+`]}`, nil)
+		if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeInvalidFilename) {
+			t.Errorf("%q = %d %v, want %s", path, status, body, CodeInvalidFilename)
+		}
+	}
+
+	// data/log.txt wasn't written
+	status, body := executeWith(t, Handler, `{"language":"c","code":"int main() {}","capture_files":["out.txt","data/log.txt"]}`,
+		tracedJob("captured=0", "file.0=line 1", "file.0=line 2"))
+	files, _ := body["files"].(map[string]any)
+	if status != http.StatusOK || len(files) != 1 || files["out.txt"] != "line 1\nline 2" {
+		t.Errorf("response = %d %v, want only out.txt", status, body)
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.WorkDir = t.TempDir()
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(task.Run, defaultWorkDir) {
+		t.Errorf("the default work dir is used: %s", task.Run)
+	}
+	setup, _, ok := strings.Cut(task.Run, "EXIT; ")
+	if !ok || !strings.Contains(setup, "mktemp -d "+cfg.WorkDir+"/"+jobDirPrefix) {
+		t.Fatalf("the job doesn't get a directory of its own: %s", task.Run)
+	}
+
+	// Two jobs get different directories, which are gone once they end
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		out, err := exec.Command("sh", "-c", setup+"EXIT; touch "+workDir+"/usercode; echo "+workDir).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := strings.TrimSpace(string(out))
+		if _, err := os.Stat(dir); !strings.HasPrefix(dir, cfg.WorkDir+"/"+jobDirPrefix) || !os.IsNotExist(err) {
+			t.Errorf("directory of job %d = %q, stat = %v, want removed", i, dir, err)
+		}
+		dirs = append(dirs, dir)
+	}
+	if dirs[0] == dirs[1] {
+		t.Errorf("both jobs ran in %s", dirs[0])
+	}
+}
+
+func TestProgramStderr(t *testing.T) {
+	cfg := defaultConfig()
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, "sed 's/^/"+metadataPrefix+"stderr=/'") {
+		t.Errorf("stderr isn't reported: %s", task.Run)
+	}
+
+	code := `#include <stdio.h>\nint main() { fputs(\"a\\nb\", stderr); perror(\"open\"); }`
+	status, body := executeWith(t, Handler, `{"language":"c","code":"`+code+`"}`,
+		tracedJob("stdout=out", "stderr=a", "stderr=bopen: No such file or directory"))
+	if status != http.StatusOK || body["stdout"] != "out" || body["stderr"] != "a\nbopen: No such file or directory" {
+		t.Errorf("response = %d %v, want stderr apart from stdout", status, body)
+	}
+
+	status, body = executeWith(t, Handler, `{"language":"c","code":"`+code+`"}`,
+		tracedJob("stdout=out", "stderr=aaaa\xc3", "truncated=stderr"))
+	if status != http.StatusOK || body["stderr"] != "aaaa"+truncationMarker || body["truncated"] != true || body["stdout"] != "out" {
+		t.Errorf("truncated stderr = %d %v", status, body)
+	}
+
+	// The compiler's messages are still parsed into the errors, not returned as the program's stderr
+	status, body = executeWith(t, Handler, `{"language":"c","code":"int main() { return 0 }"}`, compileFailedJob(
+		jobPath("usercode.c")+":1:23: error: expected ';' before '}' token\n"))
+	if _, ok := body["stderr"]; status != http.StatusBadRequest || ok || body["phase"] != phaseCompile {
+		t.Errorf("compile error = %d %v", status, body)
+	}
+}
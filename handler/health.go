@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/runabol/tork/engine"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Health is a liveness probe. It doesn't touch the engine, so it is cheap enough for load balancers
+func Health(c web.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Ready is a readiness probe. It checks that the engine was started and that its broker and datastore are reachable,
+// i.e., that jobs can be submitted
+func Ready(c web.Context) error {
+	ctx := c.Request().Context()
+	if err := engine.Broker().HealthCheck(ctx); err != nil {
+		log.Debug().Msgf("broker not ready: %s", err.Error())
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+	if err := engine.Datastore().HealthCheck(ctx); err != nil {
+		log.Debug().Msgf("datastore not ready: %s", err.Error())
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	c, rec := newTestContext(httptest.NewRequest(http.MethodGet, "/health", nil))
+	if err := Health(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("health = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/engine"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// testContext is the web.Context of a request in the tests, backed by echo like the engine's
+type testContext struct {
+	echo.Context
+	done chan any
+}
+
+func (c testContext) Get(key any) any {
+	return c.Context.Get(key.(string))
+}
+
+func (c testContext) Set(key, val any) {
+	c.Context.Set(key.(string), val)
+}
+
+func (c testContext) Response() http.ResponseWriter {
+	return c.Context.Response()
+}
+
+func (c testContext) Error(code int, err error) {
+	c.Context.Error(echo.NewHTTPError(code, err.Error()))
+}
+
+func (c testContext) Done() <-chan any {
+	return c.done
+}
+
+// newTestContext returns the context of a request and the recorder of its response
+func newTestContext(req *http.Request) (web.Context, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	return testContext{Context: echo.New().NewContext(req, rec), done: make(chan any)}, rec
+}
+
+// newJSONRequest returns a POST request with the body as JSON
+func newJSONRequest(target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, body)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+// withConfig replaces the configuration for the test, restoring it when the test ends
+func withConfig(t *testing.T, set func(c *Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	set(&config)
+}
+
+// withLogger makes the logs of the test go to the returned buffer, from the level on
+func withLogger(t *testing.T, level zerolog.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := log.Logger
+	t.Cleanup(func() { log.Logger = saved })
+	log.Logger = zerolog.New(&buf).Level(level)
+	return &buf
+}
+
+// fakeEngine replaces the submission of jobs for the test. finish returns the job as the engine would have finished
+// it, and is passed to the listeners, as the engine would, once the submission returned. Jobs that never finish are
+// nil. The test waits for its async jobs when it ends
+type fakeEngine struct {
+	sync.Mutex
+	jobs   []*input.Job
+	finish func(job *input.Job) *tork.Job
+}
+
+func withFakeEngine(t *testing.T, finish func(job *input.Job) *tork.Job) *fakeEngine {
+	t.Helper()
+	f := &fakeEngine{finish: finish}
+	saved := engineSubmitJob
+	t.Cleanup(func() {
+		drain.inFlight.Wait()
+		engineSubmitJob = saved
+	})
+	engineSubmitJob = f.submit
+	return f
+}
+
+func (f *fakeEngine) submit(_ context.Context, job *input.Job, listeners ...engine.JobListener) (*tork.Job, error) {
+	f.Lock()
+	f.jobs = append(f.jobs, job)
+	f.Unlock()
+
+	j := f.finish(job)
+	if j == nil {
+		return &tork.Job{ID: "job", State: tork.JobStatePending}, nil
+	}
+	go func() {
+		for _, l := range listeners {
+			l(j)
+		}
+	}()
+	return &tork.Job{ID: "job", State: tork.JobStatePending}, nil
+}
+
+func (f *fakeEngine) submitted() []*input.Job {
+	f.Lock()
+	defer f.Unlock()
+	return append([]*input.Job(nil), f.jobs...)
+}
+
+// completedJob is a job whose task completed with the result
+func completedJob(result string) *tork.Job {
+	return &tork.Job{
+		ID:        "job",
+		State:     tork.JobStateCompleted,
+		Execution: []*tork.Task{{State: tork.TaskStateCompleted, Result: result}},
+	}
+}
+
+// failedJob is a job whose task failed with the error
+func failedJob(err string) *tork.Job {
+	return &tork.Job{
+		ID:        "job",
+		State:     tork.JobStateFailed,
+		Execution: []*tork.Task{{State: tork.TaskStateFailed, Error: err}},
+	}
+}
+
+// emptyTrace is the line the parser prints for a program without steps
+const emptyTrace = `{"code":"","trace":[]}` + "\n"
+
+// tracedJob is a job whose program was traced and exited with 0, with the metadata lines after the trace, e.g.
+// "stdout=hi"
+func tracedJob(metadata ...string) *tork.Job {
+	result := emptyTrace + metadataPrefix + "exit_code=0\n"
+	for _, line := range metadata {
+		result += metadataPrefix + line + "\n"
+	}
+	return completedJob(result)
+}
+
+// compileFailedJob is a job whose compilation failed with the compiler's output
+func compileFailedJob(output string) *tork.Job {
+	return completedJob(output + metadataPrefix + "compile_failed=1\n")
+}
+
+// errorOf is the error of a decoded response, nil when it has none
+func errorOf(body map[string]any) map[string]any {
+	e, _ := body["error"].(map[string]any)
+	return e
+}
+
+// jobPath is the path of a submitted file in the directory of a job, as the compilers report it
+func jobPath(name string) string {
+	return config.WorkDir + "/" + jobDirPrefix + "Ab12Cd/" + name
+}
+
+// executeWith sends the request body to the handler, with the engine finishing the job as given, and returns the response
+func executeWith(t *testing.T, handler func(c web.Context) error, body string, job *tork.Job) (int, map[string]any) {
+	t.Helper()
+	withFakeEngine(t, func(*input.Job) *tork.Job { return job })
+	c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(body)))
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	return rec.Code, resp
+}
+
+// checkEnvelope fails the test unless the body is the error envelope with the status and code
+func checkEnvelope(t *testing.T, status int, data []byte, code ErrorCode) {
+	t.Helper()
+	var body struct {
+		Error *apiError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	if body.Error == nil || body.Error.Code != code || body.Error.Status != status || body.Error.Message == "" {
+		t.Errorf("body = %s, want the envelope of %s with status %d", data, code, status)
+	}
+}
+
+// jsonString encodes s as a JSON string
+func jsonString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// gzipped compresses s
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// withIdempotencyStore gives the test stores of its own for the Idempotency-Key calls and the async jobs
+func withIdempotencyStore(t *testing.T) {
+	t.Helper()
+	savedCalls, savedJobs := idempotency, jobs
+	t.Cleanup(func() { idempotency, jobs = savedCalls, savedJobs })
+	idempotency = &idempotencyStore{calls: make(map[string]*idempotentCall)}
+	jobs = &jobStore{jobs: make(map[string]*asyncJob), expired: make(map[string]time.Time)}
+}
+
+// batchRequest sends the body to /batch and decodes the response
+func batchRequest(t *testing.T, body string) (int, map[string]any) {
+	t.Helper()
+	c, rec := newTestContext(newJSONRequest("/batch", strings.NewReader(body)))
+	if err := Batch(c); err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	return rec.Code, resp
+}
+
+// resetCompilerVersions empties the cache of versions for the test
+func resetCompilerVersions(t *testing.T) {
+	t.Helper()
+	empty := func() {
+		compilerVersions.Lock()
+		compilerVersions.images = nil
+		compilerVersions.Unlock()
+	}
+	empty()
+	t.Cleanup(empty)
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// idempotentCall is an execution sent with an Idempotency-Key header. Requests with the same key get its response
+// instead of starting another execution, e.g. when the run button is clicked twice
+type idempotentCall struct {
+	// cacheKey of the request, so a key reused for another request is caught
+	request string
+	// Closed once the response is known
+	done   chan struct{}
+	status int
+	body   any
+	// Location header of the response, e.g. of an async job
+	location string
+	// When the key is forgotten, once the response is known
+	expires time.Time
+}
+
+// idempotencyStore keeps the calls of every key, scoped by client
+type idempotencyStore struct {
+	sync.Mutex
+	calls     map[string]*idempotentCall
+	lastSweep time.Time
+}
+
+var idempotency = &idempotencyStore{calls: make(map[string]*idempotentCall)}
+
+// idempotencyKey scopes the key sent by the client to its IP, so clients can't get each other's responses. It's
+// hashed, since keys can be as long as the client wants
+func idempotencyKey(c web.Context, key string) string {
+	sum := sha256.Sum256([]byte(clientIP(c.Request()) + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// begin returns the call of the key, and whether it was started by this request, which must then finish it
+func (s *idempotencyStore) begin(key string, request string) (*idempotentCall, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > config.IdempotencyTTL {
+		for k, call := range s.calls {
+			if !call.expires.IsZero() && now.After(call.expires) {
+				delete(s.calls, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if call, ok := s.calls[key]; ok && (call.expires.IsZero() || now.Before(call.expires)) {
+		return call, false
+	}
+	call := &idempotentCall{request: request, done: make(chan struct{})}
+	s.calls[key] = call
+	return call, true
+}
+
+// finish stores the response of the call and wakes up the requests waiting for it. Responses that can't be served
+// again, e.g. timeouts, aren't kept, so a retry with the same key executes again
+func (s *idempotencyStore) finish(key string, call *idempotentCall, responded *respondedContext) {
+	s.Lock()
+	defer s.Unlock()
+
+	call.status, call.body, call.location = responded.status, responded.body, responded.location
+	call.expires = time.Now().Add(config.IdempotencyTTL)
+	if !reusable(call.status) && s.calls[key] == call {
+		delete(s.calls, key)
+	}
+	close(call.done)
+}
+
+// reusable reports whether a response can be given to the requests with the same Idempotency-Key. Besides the ones
+// that can be cached, an accepted async job is, so a retry polls the same job
+func reusable(status int) bool {
+	return cacheable(status) || status == http.StatusAccepted
+}
+
+// beginIdempotentCall handles the Idempotency-Key of the request, whose cacheKey is request. When the key was used
+// before, it responds with what the first request got and ok is false. Otherwise, the request executes, responding
+// through the returned context, and must call finish once it responded
+func beginIdempotentCall(c web.Context, logger zerolog.Logger, request string) (rc web.Context, finish func(), ok bool, err error) {
+	header := c.Request().Header.Get("Idempotency-Key")
+	if header == "" || config.IdempotencyTTL <= 0 {
+		return c, func() {}, true, nil
+	}
+
+	key := idempotencyKey(c, header)
+	call, first := idempotency.begin(key, request)
+	if first {
+		responded := &respondedContext{Context: c}
+		return responded, func() { idempotency.finish(key, call, responded) }, true, nil
+	}
+
+	if call.request != request {
+		return c, nil, false, respondError(c, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+			"the Idempotency-Key was already used for another request")
+	}
+	select {
+	case <-call.done:
+	case <-c.Done():
+		return c, nil, false, respondError(c, statusClientClosedRequest, CodeClientDisconnected, "the client went away")
+	}
+	// Otherwise the first request failed in a way that may not happen again, so this one executes too
+	if !reusable(call.status) {
+		return c, func() {}, true, nil
+	}
+	logger.Debug().Msg("serving the result of a request with the same Idempotency-Key")
+	if call.location != "" {
+		c.Response().Header().Set("Location", call.location)
+	}
+	return c, nil, false, c.JSON(call.status, call.body)
+}
+
+// respondedContext remembers the response of the handler, so it can be given to the requests with the same
+// Idempotency-Key
+type respondedContext struct {
+	web.Context
+	status   int
+	body     any
+	location string
+}
+
+func (c *respondedContext) JSON(code int, data any) error {
+	c.status, c.body = code, data
+	c.location = c.Response().Header().Get("Location")
+	return c.Context.JSON(code, data)
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	withIdempotencyStore(t)
+
+	call, first := idempotency.begin("key", "request")
+	if !first {
+		t.Fatal("the first call of the key isn't first")
+	}
+	if again, first := idempotency.begin("key", "request"); first || again != call {
+		t.Fatal("a running call of the key wasn't returned")
+	}
+	idempotency.finish("key", call, &respondedContext{status: http.StatusOK, body: "ok"})
+	select {
+	case <-call.done:
+	default:
+		t.Fatal("finishing the call didn't wake up the requests waiting for it")
+	}
+	if again, first := idempotency.begin("key", "request"); first || again.body != "ok" {
+		t.Error("the response of the call isn't reused")
+	}
+
+	timedOut, _ := idempotency.begin("timeout", "request")
+	idempotency.finish("timeout", timedOut, &respondedContext{status: http.StatusGatewayTimeout})
+	if _, first := idempotency.begin("timeout", "request"); !first {
+		t.Error("a timeout is reused")
+	}
+}
+
+// idempotentRequest sends the code to /execute with the Idempotency-Key
+func idempotentRequest(t *testing.T, target string, code string) (int, map[string]string, string) {
+	t.Helper()
+	body := `{"language":"c","code":` + jsonString(code) + `}`
+	req := newJSONRequest(target, strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", "run-1")
+	c, rec := newTestContext(req)
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp, rec.Header().Get("Location")
+}
+
+func TestAsyncIdempotencyKey(t *testing.T) {
+	withIdempotencyStore(t)
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job { return failedJob("stopped") })
+
+	status, first, location := idempotentRequest(t, "/execute?async=true", "int main() {}")
+	if status != http.StatusAccepted || first["id"] == "" {
+		t.Fatalf("async execution = %d %v", status, first)
+	}
+	status, retry, retryLocation := idempotentRequest(t, "/execute?async=true", "int main() {}")
+	if status != http.StatusAccepted || retry["id"] != first["id"] || retryLocation != location {
+		t.Errorf("retry = %d %v at %q, want the job %s at %q", status, retry, retryLocation, first["id"], location)
+	}
+	if n := len(fake.submitted()); n != 1 {
+		t.Errorf("submitted %d jobs, want 1", n)
+	}
+
+	status, _, _ = idempotentRequest(t, "/execute?async=true", "int main() { return 1; }")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for other code = %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	status, _, _ = idempotentRequest(t, "/execute", "int main() {}")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("key reused synchronously = %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// asyncJob is an execution submitted with async=true
+type asyncJob struct {
+	done bool
+	// Response to the execution, once it's done
+	status  int
+	body    any
+	expires time.Time
+	// Closed when the job is cancelled while it's pending
+	cancelled chan struct{}
+}
+
+// IDs of expired jobs are remembered for this long, so polling them gets a clearer response than an unknown ID
+const expiredJobRetention = time.Hour
+
+// jobStore keeps the async executions until their TTL expires
+type jobStore struct {
+	sync.Mutex
+	jobs map[string]*asyncJob
+	// When each expired job is forgotten
+	expired   map[string]time.Time
+	lastSweep time.Time
+}
+
+var jobs = &jobStore{jobs: make(map[string]*asyncJob), expired: make(map[string]time.Time)}
+
+// add stores a pending job, and returns the channel closed if it's cancelled
+func (s *jobStore) add(id string) <-chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > config.JobTTL {
+		s.sweep(now)
+	}
+
+	cancelled := make(chan struct{})
+	s.jobs[id] = &asyncJob{expires: now.Add(config.JobTTL), cancelled: cancelled}
+	return cancelled
+}
+
+// sweep discards the expired jobs, remembering only their IDs. The lock must be held
+func (s *jobStore) sweep(now time.Time) {
+	for id, j := range s.jobs {
+		if now.After(j.expires) {
+			delete(s.jobs, id)
+			s.expired[id] = now.Add(expiredJobRetention)
+		}
+	}
+	for id, forget := range s.expired {
+		if now.After(forget) {
+			delete(s.expired, id)
+		}
+	}
+	s.lastSweep = now
+}
+
+// finish stores the response of a job. The TTL starts again, so the result is kept for that long after it's ready. A
+// job that was cancelled keeps its response
+func (s *jobStore) finish(id string, status int, body any) {
+	s.Lock()
+	defer s.Unlock()
+
+	if j, ok := s.jobs[id]; ok && j.done {
+		return
+	}
+	s.jobs[id] = &asyncJob{done: true, status: status, body: body, expires: time.Now().Add(config.JobTTL)}
+}
+
+// cancel finishes a pending job with cancelledJobBody and signals its execution to stop. It reports whether the job
+// was pending
+func (s *jobStore) cancel(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || j.done || time.Now().After(j.expires) {
+		return false
+	}
+	close(j.cancelled)
+	s.jobs[id] = &asyncJob{done: true, status: http.StatusOK, body: cancelledJobBody(id), expires: time.Now().Add(config.JobTTL)}
+	return true
+}
+
+// cancelledJobBody is the response to a cancelled job
+func cancelledJobBody(id string) map[string]string {
+	return map[string]string{"id": id, "state": "cancelled"}
+}
+
+// remove deletes a job
+func (s *jobStore) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.jobs, id)
+}
+
+// get returns a copy of the job, if it exists and hasn't expired. expired reports whether it existed, but expired
+func (s *jobStore) get(id string) (j asyncJob, found bool, expired bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.jobs[id]
+	if ok && time.Now().After(stored.expires) {
+		return asyncJob{}, false, true
+	}
+	if !ok {
+		_, expired = s.expired[id]
+		return asyncJob{}, false, expired
+	}
+	return *stored, true, false
+}
+
+// submitAsync submits the job and responds right away with its ID, which is polled at /jobs/{id}
+func submitAsync(c web.Context, logger zerolog.Logger, er ExecRequest, key string, job *input.Job, start time.Time) error {
+	id := job.ID()
+	// Stored before submitting, so the result can't arrive before the job exists
+	cancelled := jobs.add(id)
+
+	c.Response().Header().Set("Location", "/jobs/"+id)
+
+	if status, body, ok := results.get(key); ok {
+		logger.Debug().Msg("serving a cached result")
+		observeExecution(er.Language, start, status, body)
+		jobs.finish(id, status, body)
+		return c.JSON(http.StatusAccepted, map[string]string{"id": id, "state": "completed"})
+	}
+
+	release, ok := acquireExecution(er.Language)
+	if !ok {
+		jobs.remove(id)
+		c.Response().Header().Set("Retry-After", "1")
+		apiErr := serverBusyError()
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+
+	result := make(chan jobResult, 1)
+	// The response is sent right away, and the engine ends the subscription to the job's events with the context it's
+	// submitted with, so the job can't be bound to this request
+	if _, err := submitJob(context.Background(), job, newJobListener(result)); err != nil {
+		release()
+		jobs.remove(id)
+		logger.Error().Err(err).Msg("error submitting the job")
+		apiErr := engineUnavailableError()
+		return respondError(c, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+
+	logger.Debug().Msgf("async job %s submitted", id)
+
+	// The request is still tracked by Drain here, so shutting down waits for this execution too
+	drain.inFlight.Add(1)
+	go func() {
+		defer drain.inFlight.Done()
+		defer release()
+		// Recover only covers the handler, a panic here would take the whole server down
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error().Str("stack", string(debug.Stack())).Msgf("panic in job %s: %v", id, r)
+				jobs.finish(id, http.StatusInternalServerError,
+					newErrorBody(http.StatusInternalServerError, CodeInternalError, "something went wrong on the server"))
+			}
+		}()
+
+		select {
+		case res := <-result:
+			status, body, err := executionResponse(logger, er, res)
+			if err != nil {
+				logger.Error().Err(err).Msgf("error building the result of job %s", id)
+				apiErr := unreadableResultError()
+				status, body = apiErr.Status, newErrorBody(apiErr.Status, apiErr.Code, apiErr.Message)
+			}
+			results.put(key, status, body)
+			observeExecution(er.Language, start, status, body)
+			jobs.finish(id, status, body)
+		case <-cancelled:
+			// The slot is released right away, the engine stops the task on its own
+			logger.Debug().Msgf("async job %s cancelled", id)
+			if err := cancelJob(context.Background(), id); err != nil {
+				logger.Error().Err(err).Msgf("error cancelling job %s", id)
+			}
+		case <-time.After(config.JobTTL):
+			// Nobody can fetch the result anymore
+			logger.Debug().Msgf("async job %s didn't finish before its TTL", id)
+		}
+	}()
+
+	return c.JSON(http.StatusAccepted, map[string]string{"id": id, "state": "pending"})
+}
+
+// Job returns the state of an async execution and, once it's done, the same response a synchronous execution gets
+func Job(c web.Context) error {
+	req := struct {
+		ID string `param:"id"`
+	}{}
+	if err := c.Bind(&req); err != nil {
+		return respondError(c, http.StatusBadRequest, CodeInvalidRequest, errors.Wrapf(err, "error binding request").Error())
+	}
+
+	j, found, expired := jobs.get(req.ID)
+	if expired {
+		return respondError(c, http.StatusGone, CodeJobExpired, "the result of the job expired")
+	}
+	if !found {
+		return respondError(c, http.StatusNotFound, CodeJobNotFound, "there's no job with this id")
+	}
+	if !j.done {
+		return c.JSON(http.StatusAccepted, map[string]string{"id": req.ID, "state": "pending"})
+	}
+	return c.JSON(j.status, j.body)
+}
+
+// CancelJob stops a pending async execution, whose result is then a cancelled state. Jobs that are already done can't
+// be cancelled
+func CancelJob(c web.Context) error {
+	req := struct {
+		ID string `param:"id"`
+	}{}
+	if err := c.Bind(&req); err != nil {
+		return respondError(c, http.StatusBadRequest, CodeInvalidRequest, errors.Wrapf(err, "error binding request").Error())
+	}
+
+	j, found, expired := jobs.get(req.ID)
+	if expired {
+		return respondError(c, http.StatusGone, CodeJobExpired, "the result of the job expired")
+	}
+	if !found {
+		return respondError(c, http.StatusNotFound, CodeJobNotFound, "there's no job with this id")
+	}
+	// It may also finish between both checks
+	if j.done || !jobs.cancel(req.ID) {
+		return respondError(c, http.StatusConflict, CodeJobFinished, "the job already finished")
+	}
+	logger := requestLogger(c)
+	logger.Debug().Msgf("async job %s cancelled by the client", req.ID)
+	return c.JSON(http.StatusOK, cancelledJobBody(req.ID))
+}
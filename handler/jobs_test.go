@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// jobRequest calls the handler of a job, e.g. Job or CancelJob, with the ID
+func jobRequest(t *testing.T, handler func(c web.Context) error, method string, id string) (int, map[string]any) {
+	t.Helper()
+	c, rec := newTestContext(httptest.NewRequest(method, "/jobs/"+id, nil))
+	c.(testContext).SetParamNames("id")
+	c.(testContext).SetParamValues(id)
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	return rec.Code, body
+}
+
+// submitAsyncRequest starts an async execution of the code and returns its ID
+func submitAsyncRequest(t *testing.T, code string) string {
+	t.Helper()
+	body := `{"language":"c","code":` + jsonString(code) + `}`
+	c, rec := newTestContext(newJSONRequest("/execute?async=true", strings.NewReader(body)))
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusAccepted || resp["state"] != "pending" || rec.Header().Get("Location") != "/jobs/"+resp["id"] {
+		t.Fatalf("async execution = %d %v, location %q", rec.Code, resp, rec.Header().Get("Location"))
+	}
+	return resp["id"]
+}
+
+func TestAsyncExecution(t *testing.T) {
+	withIdempotencyStore(t)
+	withConfig(t, func(c *Config) { c.JobTTL = 200 * time.Millisecond })
+	withFakeEngine(t, func(job *input.Job) *tork.Job {
+		for _, code := range job.Tasks[0].Files {
+			if strings.Contains(code, "pending") {
+				return nil
+			}
+		}
+		return completedJob(metadataPrefix + "timed_out=1\n")
+	})
+
+	pending := submitAsyncRequest(t, "int main() { /* pending */ }")
+	if status, body := jobRequest(t, Job, http.MethodGet, pending); status != http.StatusAccepted || body["state"] != "pending" {
+		t.Errorf("unfinished job = %d %v", status, body)
+	}
+
+	id := submitAsyncRequest(t, "int main() {}")
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, body := jobRequest(t, Job, http.MethodGet, id)
+		if status == http.StatusAccepted && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		e := errorOf(body)
+		if status != http.StatusGatewayTimeout || e["code"] != string(CodeExecutionTimeout) {
+			t.Errorf("finished job = %d %v, want the response of a synchronous execution", status, body)
+		}
+		break
+	}
+}
+
+func TestUnknownAndExpiredJobs(t *testing.T) {
+	withIdempotencyStore(t)
+	withConfig(t, func(c *Config) { c.JobTTL = time.Millisecond })
+
+	status, body := jobRequest(t, Job, http.MethodGet, "unknown")
+	if e := errorOf(body); status != http.StatusNotFound || e["code"] != string(CodeJobNotFound) {
+		t.Errorf("unknown job = %d %v", status, body)
+	}
+
+	jobs.add("old")
+	time.Sleep(5 * time.Millisecond)
+	status, body = jobRequest(t, Job, http.MethodGet, "old")
+	if e := errorOf(body); status != http.StatusGone || e["code"] != string(CodeJobExpired) {
+		t.Errorf("expired job = %d %v", status, body)
+	}
+	// Still told apart once it's swept
+	jobs.add("new")
+	status, _ = jobRequest(t, Job, http.MethodGet, "old")
+	if status != http.StatusGone {
+		t.Errorf("swept job = %d, want %d", status, http.StatusGone)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	withIdempotencyStore(t)
+	withConfig(t, func(c *Config) {
+		c.JobTTL = time.Second
+		c.MaxConcurrent = 1
+	})
+	cancelled := make(chan string, 1)
+	saved := cancelJob
+	t.Cleanup(func() { cancelJob = saved })
+	cancelJob = func(_ context.Context, id string) error {
+		cancelled <- id
+		return nil
+	}
+	withFakeEngine(t, func(job *input.Job) *tork.Job {
+		if strings.Contains(job.Tasks[0].Files["usercode.c"], "pending") {
+			return nil
+		}
+		return completedJob(metadataPrefix + "timed_out=1\n")
+	})
+
+	id := submitAsyncRequest(t, "int main() { /* pending */ }")
+	if status, body := jobRequest(t, CancelJob, http.MethodPost, id); status != http.StatusOK || body["state"] != "cancelled" {
+		t.Fatalf("cancelling a pending job = %d %v", status, body)
+	}
+	select {
+	case got := <-cancelled:
+		if got != id {
+			t.Errorf("the engine cancelled job %s, want %s", got, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the job wasn't cancelled in the engine")
+	}
+	// Its slot is given back, so another execution can run
+	drain.inFlight.Wait()
+	if n := running.Load(); n != 0 {
+		t.Errorf("%d executions still running", n)
+	}
+	if status, body := jobRequest(t, Job, http.MethodGet, id); status != http.StatusOK || body["state"] != "cancelled" {
+		t.Errorf("cancelled job = %d %v", status, body)
+	}
+	if status, body := jobRequest(t, CancelJob, http.MethodPost, id); status != http.StatusConflict {
+		t.Errorf("cancelling a cancelled job = %d %v", status, body)
+	}
+
+	finished := submitAsyncRequest(t, "int main() {}")
+	drain.inFlight.Wait()
+	status, body := jobRequest(t, CancelJob, http.MethodPost, finished)
+	if e := errorOf(body); status != http.StatusConflict || e["code"] != string(CodeJobFinished) {
+		t.Errorf("cancelling a finished job = %d %v", status, body)
+	}
+	if status, _ := jobRequest(t, Job, http.MethodGet, finished); status != http.StatusGatewayTimeout {
+		t.Errorf("the result of a finished job changed to %d after cancelling it", status)
+	}
+
+	status, body = jobRequest(t, CancelJob, http.MethodPost, "unknown")
+	if e := errorOf(body); status != http.StatusNotFound || e["code"] != string(CodeJobNotFound) {
+		t.Errorf("cancelling an unknown job = %d %v", status, body)
+	}
+}
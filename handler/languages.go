@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Language describes a supported language and how its code is compiled
+type Language struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Compiler string `json:"compiler"`
+	Ext      string `json:"ext"`
+
+	// Other names accepted in the request's language field
+	aliases []string
+	// Flags passed to the compiler. Debug info and frame pointers are kept for valgrind. Tabs are one column wide in
+	// the diagnostics of gcc and clang, so visualColumn can convert them. -Wall warns about uninitialized variables,
+	// the usual mistake with pointers
+	compileFlags string
+	// Flags passed instead of compileFlags when the program isn't traced and Config.FastCompile is set, without what
+	// only valgrind needs
+	fastCompileFlags string
+	// Flags of each level accepted in the request's optimization field. Empty when the language isn't compiled
+	optimizationFlags map[string]string
+	// Values accepted in the request's standard field, passed to the compiler as -std=
+	standards []string
+	// Compiler binaries by the name accepted in the request's compiler field. Compiler is used when it's empty
+	compilers map[string]string
+	// Whether all the submitted sources are passed to the compiler. Otherwise, only the main file is, and it finds
+	// the others by itself (e.g. Rust modules)
+	multipleSources bool
+	// Whether the compiler accepts the gcc style flags of Config.AllowedFlags
+	extraFlags bool
+	// Flags that make the compiler only check the code, without generating or linking the program. Empty when the
+	// compiler has none
+	syntaxOnlyFlags string
+	// Flags that make the compiler generate assembly instead of the program. Empty when it's not supported
+	asmFlags string
+	// Mode in which the parser reads the trace of the language. ID is used when it's empty
+	parserMode string
+	// Limits of the tasks of the language, in the format of Config, unless Config sets others for the language. The
+	// ones of Config are used when they're empty and are the maximum otherwise, so a language can only ask for less
+	timeout string
+	cpus    string
+	memory  string
+	// Whether the source is run by the interpreter (Compiler) without a compile step. Its errors are runtime errors
+	interpreted bool
+}
+
+// languages is the single source of the supported languages, used both to build tasks and to list them
+var languages = []Language{
+	{
+		ID:                "c",
+		Name:              "C",
+		Compiler:          "gcc",
+		Ext:               ".c",
+		compileFlags:      "-Wall -ggdb -O0 -fno-omit-frame-pointer -ftabstop=1",
+		fastCompileFlags:  "-Wall -ftabstop=1",
+		optimizationFlags: gccOptimizationFlags,
+		standards:         []string{"c89", "c90", "c99", "c11", "gnu89", "gnu90", "gnu99", "gnu11"},
+		compilers:         map[string]string{"gcc": "gcc", "clang": "clang"},
+
+		multipleSources: true,
+		extraFlags:      true,
+		syntaxOnlyFlags: "-fsyntax-only",
+		asmFlags:        "-S",
+	},
+	{
+		ID:                "c++",
+		Name:              "C++",
+		Compiler:          "g++",
+		Ext:               ".cpp",
+		aliases:           []string{"cpp", "cplusplus", "cxx"},
+		compileFlags:      "-Wall -ggdb -O0 -fno-omit-frame-pointer -ftabstop=1",
+		fastCompileFlags:  "-Wall -ftabstop=1",
+		optimizationFlags: gccOptimizationFlags,
+		standards:         []string{"c++98", "c++03", "c++11", "c++14", "c++17", "gnu++98", "gnu++03", "gnu++11", "gnu++14", "gnu++17"},
+		compilers:         map[string]string{"gcc": "g++", "clang": "clang++"},
+
+		multipleSources: true,
+		extraFlags:      true,
+		syntaxOnlyFlags: "-fsyntax-only",
+		asmFlags:        "-S",
+	},
+	{
+		ID:       "rust",
+		Name:     "Rust",
+		Compiler: "rustc",
+		Ext:      ".rs",
+		aliases:  []string{"rs"},
+		// rustc equivalent of gcc's "-ggdb -O0 -fno-omit-frame-pointer". Warnings are not parsed for Rust, so they're
+		// suppressed
+		compileFlags:     "-A warnings -g -C opt-level=0 -C force-frame-pointers=yes",
+		fastCompileFlags: "-A warnings",
+		optimizationFlags: map[string]string{
+			"O0": "-C opt-level=0",
+			"O1": "-C opt-level=1",
+			"O2": "-C opt-level=2",
+			"O3": "-C opt-level=3",
+			"Os": "-C opt-level=s",
+		},
+		// Type and borrow checking still run, only the code generation is skipped
+		syntaxOnlyFlags: "--emit=metadata",
+		asmFlags:        "--emit=asm",
+	},
+	{
+		ID:       "python",
+		Name:     "Python",
+		Compiler: "python3",
+		Ext:      ".py",
+		aliases:  []string{"py", "python3"},
+		// Nothing is compiled, and the tracer runs in the interpreter instead of valgrind
+		timeout: "10s",
+		memory:  "500m",
+
+		interpreted: true,
+	},
+}
+
+// gccOptimizationFlags are the optimization levels of gcc and clang
+var gccOptimizationFlags = map[string]string{"O0": "-O0", "O1": "-O1", "O2": "-O2", "O3": "-O3", "Os": "-Os"}
+
+// findLanguage looks up a language by its ID or one of its aliases, ignoring case and surrounding whitespace.
+// Compilers (e.g. "gcc" or "clang") are not languages, so they're not aliases
+func findLanguage(name string) (Language, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, l := range languages {
+		if l.ID == name {
+			return l, true
+		}
+		for _, alias := range l.aliases {
+			if alias == name {
+				return l, true
+			}
+		}
+	}
+	return Language{}, false
+}
+
+// limits returns the configuration with the task limits of the language, clamped to the configured ones
+func (l Language) limits(cfg Config) Config {
+	limit := func(configured map[string]string, builtIn string) string {
+		if value, ok := configured[l.ID]; ok {
+			return value
+		}
+		return builtIn
+	}
+	timeout, cpus, memory := limit(cfg.LanguageTimeouts, l.timeout), limit(cfg.LanguageCPUs, l.cpus),
+		limit(cfg.LanguageMemory, l.memory)
+
+	if t, err := time.ParseDuration(timeout); err == nil {
+		if maxTimeout, _ := time.ParseDuration(cfg.Timeout); t < maxTimeout {
+			cfg.Timeout = timeout
+		}
+	}
+	if c, err := strconv.ParseFloat(cpus, 64); err == nil && c > 0 {
+		if maxCPUs, _ := strconv.ParseFloat(cfg.CPUs, 64); c < maxCPUs {
+			cfg.CPUs = cpus
+		}
+	}
+	if m, err := units.RAMInBytes(memory); err == nil {
+		if maxMemory, _ := units.RAMInBytes(cfg.Memory); m < maxMemory {
+			cfg.Memory = memory
+		}
+	}
+	return cfg
+}
+
+// parser returns the mode passed to the parser for the language
+func (l Language) parser() string {
+	if l.parserMode != "" {
+		return l.parserMode
+	}
+	return l.ID
+}
+
+// supportsStandard reports whether the compiler of the language accepts the standard
+func (l Language) supportsStandard(standard string) bool {
+	for _, s := range l.standards {
+		if s == standard {
+			return true
+		}
+	}
+	return false
+}
+
+// compiler returns the compiler binary for the requested compiler name
+func (l Language) compiler(name string) (string, bool) {
+	if name == "" {
+		return l.Compiler, true
+	}
+	compiler, ok := l.compilers[name]
+	return compiler, ok
+}
+
+// image returns the image in which code of the language is compiled and run with the given compiler
+func (l Language) image(cfg Config, compiler string) string {
+	if l.ID == "rust" {
+		return cfg.RustImage
+	}
+	if strings.HasPrefix(compiler, "clang") && cfg.ClangImage != "" {
+		return cfg.ClangImage
+	}
+	return cfg.Image
+}
+
+// enabled reports whether the language can be used. All languages are enabled when none are configured
+func (l Language) enabled(cfg Config) bool {
+	return len(cfg.EnabledLanguages) == 0 || slices.Contains(cfg.EnabledLanguages, l.ID)
+}
+
+// Languages lists the supported languages that are enabled
+func Languages(c web.Context) error {
+	enabled := make([]Language, 0, len(languages))
+	for _, l := range languages {
+		if l.enabled(config) {
+			enabled = append(enabled, l)
+		}
+	}
+	return c.JSON(http.StatusOK, enabled)
+}
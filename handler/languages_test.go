@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLanguageLimits(t *testing.T) {
+	python, _ := findLanguage("python")
+	c, _ := findLanguage("c")
+	tests := []struct {
+		name   string
+		lang   Language
+		config func(c *Config)
+		want   [3]string // timeout, cpus, memory
+	}{
+		{name: "config", lang: c, want: [3]string{"20s", "1", "1000m"}},
+		{name: "built in", lang: python, want: [3]string{"10s", "1", "500m"}},
+		{
+			name: "configured",
+			lang: python,
+			config: func(c *Config) {
+				c.LanguageTimeouts = map[string]string{"python": "5s"}
+				c.LanguageCPUs = map[string]string{"python": "0.5"}
+				c.LanguageMemory = map[string]string{"python": "256m"}
+			},
+			want: [3]string{"5s", "0.5", "256m"},
+		},
+		{
+			name: "clamped",
+			lang: c,
+			config: func(c *Config) {
+				c.LanguageTimeouts = map[string]string{"c": "1m"}
+				c.LanguageCPUs = map[string]string{"c": "4"}
+				c.LanguageMemory = map[string]string{"c": "8g"}
+			},
+			want: [3]string{"20s", "1", "1000m"},
+		},
+		{
+			name:   "other language",
+			lang:   python,
+			config: func(c *Config) { c.LanguageTimeouts = map[string]string{"c": "5s"} },
+			want:   [3]string{"10s", "1", "500m"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			if tt.config != nil {
+				tt.config(&cfg)
+			}
+			got := tt.lang.limits(cfg)
+			if [3]string{got.Timeout, got.CPUs, got.Memory} != tt.want {
+				t.Errorf("limits() = %s, %s, %s, want %v", got.Timeout, got.CPUs, got.Memory, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltInLanguageLimitsAreValid(t *testing.T) {
+	for _, l := range languages {
+		if (l.timeout != "" && !validTimeout(l.timeout)) || (l.cpus != "" && !validCPUs(l.cpus)) ||
+			(l.memory != "" && !validMemory(l.memory)) {
+			t.Errorf("invalid limits of %s: %q, %q, %q", l.ID, l.timeout, l.cpus, l.memory)
+		}
+	}
+}
+
+// listLanguages returns the IDs of the languages listed by /languages
+func listLanguages(t *testing.T) []string {
+	t.Helper()
+	c, rec := newTestContext(httptest.NewRequest(http.MethodGet, "/languages", nil))
+	if err := Languages(c); err != nil {
+		t.Fatal(err)
+	}
+	var listed []Language
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(listed))
+	for _, l := range listed {
+		ids = append(ids, l.ID)
+	}
+	return ids
+}
+
+func TestLanguages(t *testing.T) {
+	withConfig(t, func(c *Config) { c.EnabledLanguages = nil })
+	if got, want := listLanguages(t), []string{"c", "c++", "rust", "python"}; !slices.Equal(got, want) {
+		t.Errorf("languages = %v, want %v", got, want)
+	}
+}
+
+func TestClangCompiler(t *testing.T) {
+	c, _ := findLanguage("c")
+	cpp, _ := findLanguage("c++")
+	if compiler, ok := c.compiler("clang"); !ok || compiler != "clang" {
+		t.Errorf("clang of C = %q, %v", compiler, ok)
+	}
+	if compiler, ok := cpp.compiler("clang"); !ok || compiler != "clang++" {
+		t.Errorf("clang of C++ = %q, %v", compiler, ok)
+	}
+	if _, ok := c.compiler("tcc"); ok {
+		t.Error("an unknown compiler was accepted")
+	}
+
+	cfg := defaultConfig()
+	if image := c.image(cfg, "clang"); image != cfg.Image {
+		t.Errorf("image of clang without clang_image = %s, want %s", image, cfg.Image)
+	}
+	cfg.ClangImage = "clang-compiler:latest"
+	if image := cpp.image(cfg, "clang++"); image != cfg.ClangImage {
+		t.Errorf("image of clang++ = %s, want %s", image, cfg.ClangImage)
+	}
+	if image := cpp.image(cfg, "g++"); image != cfg.Image {
+		t.Errorf("image of g++ = %s, want %s", image, cfg.Image)
+	}
+}
+
+func TestFindLanguage(t *testing.T) {
+	for name, want := range map[string]string{"c": "c", "C": "c", " C++ ": "c++", "CPP": "c++", "cxx": "c++", "Python3": "python"} {
+		if l, ok := findLanguage(name); !ok || l.ID != want {
+			t.Errorf("findLanguage(%q) = %q, %v, want %q", name, l.ID, ok, want)
+		}
+	}
+	for _, name := range []string{"", "gcc", "clang", "java", "c ++"} {
+		if l, ok := findLanguage(name); ok {
+			t.Errorf("findLanguage(%q) = %q, want no language", name, l.ID)
+		}
+	}
+}
+
+func TestEnabledLanguages(t *testing.T) {
+	withConfig(t, func(c *Config) { c.EnabledLanguages = []string{"c", "python"} })
+	if got, want := listLanguages(t), []string{"c", "python"}; !slices.Equal(got, want) {
+		t.Errorf("languages = %v, want %v", got, want)
+	}
+
+	_, err := buildTask(context.Background(), ExecRequest{Language: "CPP", Code: "int main() {}"}, config)
+	if !errors.Is(err, errLanguageDisabled) {
+		t.Fatalf("disabled language = %v, want %v", err, errLanguageDisabled)
+	}
+	if _, err := buildTask(context.Background(), ExecRequest{Language: "c", Code: "int main() {}"}, config); err != nil {
+		t.Errorf("enabled language: %v", err)
+	}
+
+	status, body := executeWith(t, Handler, `{"language":"rust","code":"fn main() {}"}`, nil)
+	if e := errorOf(body); status != http.StatusBadRequest || e["code"] != string(CodeLanguageDisabled) {
+		t.Errorf("response = %d %v", status, body)
+	}
+}
+
+func TestParserMode(t *testing.T) {
+	for id, want := range map[string]string{"c": "c", "c++": "c++", "python": "python"} {
+		if l, _ := findLanguage(id); l.parser() != want {
+			t.Errorf("parser mode of %s = %q, want %q", id, l.parser(), want)
+		}
+	}
+
+	saved := languages
+	t.Cleanup(func() { languages = saved })
+	c, _ := findLanguage("c")
+	dialect := c
+	dialect.ID, dialect.aliases, dialect.parserMode = "c-dialect", nil, "c"
+	languages = append(slices.Clone(saved), dialect)
+
+	task, err := buildTask(context.Background(), ExecRequest{Language: "c-dialect", Code: "int main() {}"}, defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(task.Run, defaultParserPath+" c "+workDir) {
+		t.Errorf("the parser isn't run in the mode of the language: %s", task.Run)
+	}
+}
+
+func TestDisabledMessage(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.EnabledLanguages = []string{"c"}
+		c.DisabledMessages = map[string]string{"rust": "Rust runs on the lab machines this semester"}
+	})
+
+	status, body := executeWith(t, Handler, `{"language":"rs","code":"fn main() {}"}`, nil)
+	e := errorOf(body)
+	if status != http.StatusBadRequest || e["code"] != string(CodeLanguageDisabled) || e["message"] != "Rust runs on the lab machines this semester" {
+		t.Errorf("response = %d %v", status, body)
+	}
+	_, body = executeWith(t, Handler, `{"language":"python","code":"pass"}`, nil)
+	if e := errorOf(body); e["message"] != "python: language disabled" {
+		t.Errorf("message without a configured one = %v", e["message"])
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Outcomes of an execution
+const (
+	outcomeSuccess      = "success"
+	outcomeCompileError = "compile_error"
+	outcomeRuntimeError = "runtime_error"
+	outcomeTimeout      = "timeout"
+	outcomeError        = "error"
+)
+
+var (
+	executionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hpw_executions_total",
+		Help: "Executions by language and outcome (success, compile_error, runtime_error, timeout, error)",
+	}, []string{"language", "outcome"})
+
+	executionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "hpw_execution_duration_seconds",
+		Help: "End-to-end duration of the executions, from the request to the result",
+		// Executions take from a few hundred milliseconds to the task timeout
+		Buckets: []float64{0.25, 0.5, 1, 2, 3, 5, 8, 13, 20, 30, 60},
+	}, []string{"language"})
+)
+
+var metricsHandler = promhttp.Handler()
+
+// Metrics exposes the metrics in the Prometheus format
+func Metrics(c web.Context) error {
+	metricsHandler.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// observeExecution records the outcome of an execution that started at start
+func observeExecution(language string, start time.Time, status int, body any) {
+	if lang, ok := findLanguage(language); ok {
+		language = lang.ID
+	}
+	executionsTotal.WithLabelValues(language, executionOutcome(status, body)).Inc()
+	executionDuration.WithLabelValues(language).Observe(time.Since(start).Seconds())
+}
+
+// executionOutcome classifies the response built by executionResponse
+func executionOutcome(status int, body any) string {
+	switch status {
+	case http.StatusOK:
+		// Programs that crashed still have their trace, along with the error
+		if data, ok := body.(*traceResult); ok && data.Error != nil {
+			return outcomeRuntimeError
+		}
+		// Built as a map, e.g. when the trace was truncated or for the runs of a batch with CompileOnce
+		if data, ok := body.(map[string]interface{}); ok && data["error"] != nil {
+			return outcomeRuntimeError
+		}
+		return outcomeSuccess
+	case http.StatusBadRequest:
+		switch body.(type) {
+		// Built by newRet, e.g. when the program ran out of memory
+		case Ret:
+			return outcomeRuntimeError
+		// Parsed compiler errors
+		case map[string]interface{}:
+			return outcomeCompileError
+		}
+	case http.StatusGatewayTimeout:
+		return outcomeTimeout
+	}
+	return outcomeError
+}
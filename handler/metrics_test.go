@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutionOutcome(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   any
+		want   string
+	}{
+		{name: "success", status: http.StatusOK, body: &traceResult{}, want: outcomeSuccess},
+		{name: "crash", status: http.StatusOK, body: &traceResult{Error: &ErrorMsg{}}, want: outcomeRuntimeError},
+		{name: "truncated crash", status: http.StatusOK, body: map[string]interface{}{"error": "crash"}, want: outcomeRuntimeError},
+		{name: "truncated", status: http.StatusOK, body: map[string]interface{}{}, want: outcomeSuccess},
+		{name: "compile error", status: http.StatusBadRequest, body: map[string]interface{}{"error": "error"}, want: outcomeCompileError},
+		{name: "out of memory", status: http.StatusBadRequest, body: newOutOfMemoryRet(""), want: outcomeRuntimeError},
+		{name: "timeout", status: http.StatusGatewayTimeout, want: outcomeTimeout},
+		{name: "server error", status: http.StatusInternalServerError, want: outcomeError},
+	}
+	for _, tt := range tests {
+		if got := executionOutcome(tt.status, tt.body); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	observeExecution("CPP", time.Now(), http.StatusGatewayTimeout, nil)
+
+	c, rec := newTestContext(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if err := Metrics(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`hpw_executions_total{language="c++",outcome="timeout"}`,
+		`hpw_execution_duration_seconds_count{language="c++"}`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("the metrics don't have %s", want)
+		}
+	}
+}
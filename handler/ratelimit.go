@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runabol/tork/middleware/web"
+	"golang.org/x/time/rate"
+)
+
+// Limiters of clients that haven't made requests for this long are discarded
+const limiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipLimiters holds a token bucket per client IP
+type ipLimiters struct {
+	sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+var limiters = &ipLimiters{clients: make(map[string]*clientLimiter)}
+
+// get returns the limiter of the IP, allowing perMinute requests per minute
+func (l *ipLimiters) get(ip string, perMinute int) *rate.Limiter {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for client, cl := range l.clients {
+			if now.Sub(cl.lastSeen) > limiterIdleTimeout {
+				delete(l.clients, client)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	cl, ok := l.clients[ip]
+	if !ok {
+		cl = &clientLimiter{limiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)}
+		l.clients[ip] = cl
+	}
+	cl.lastSeen = now
+	return cl.limiter
+}
+
+// RateLimit limits the requests per minute of each client IP. Each execution starts a container, so a single client
+// could otherwise exhaust the server
+func RateLimit(next web.HandlerFunc) web.HandlerFunc {
+	return func(c web.Context) error {
+		if config.RateLimit <= 0 {
+			return next(c)
+		}
+
+		reservation := limiters.get(clientIP(c.Request()), config.RateLimit).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			// The request is rejected, so its token is given back
+			reservation.Cancel()
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			return respondError(c, http.StatusTooManyRequests, CodeRateLimited, "too many executions, try again later")
+		}
+
+		return next(c)
+	}
+}
+
+// clientIP returns the IP of the client. Proxy headers are only used when configured, since clients can forge them.
+// Of X-Forwarded-For, only the rightmost entry is used, the one the proxy added: the others come from the client
+func clientIP(r *http.Request) string {
+	if config.TrustProxyHeaders {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
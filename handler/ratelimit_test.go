@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     bool
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{name: "remote address", want: "192.0.2.1"},
+		{name: "untrusted headers", forwarded: []string{"203.0.113.7"}, realIP: "203.0.113.8", want: "192.0.2.1"},
+		{name: "forwarded", trust: true, forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "forged entries", trust: true, forwarded: []string{"10.0.0.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "repeated header", trust: true, forwarded: []string{"10.0.0.1", "203.0.113.7"}, want: "203.0.113.7"},
+		{name: "real IP", trust: true, realIP: "203.0.113.8", want: "203.0.113.8"},
+		{name: "empty entry", trust: true, forwarded: []string{"10.0.0.1, "}, realIP: "203.0.113.8", want: "203.0.113.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.TrustProxyHeaders = tt.trust })
+			r := httptest.NewRequest(http.MethodPost, "/exec", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	withConfig(t, func(c *Config) { c.RateLimit = 2 })
+	saved := limiters
+	t.Cleanup(func() { limiters = saved })
+	limiters = &ipLimiters{clients: make(map[string]*clientLimiter)}
+
+	next := func(c web.Context) error { return c.String(http.StatusOK, "ok") }
+	request := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/exec", nil)
+		r.RemoteAddr = remote
+		c, rec := newTestContext(r)
+		if err := RateLimit(next)(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := request("192.0.2.1:1"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	rec := request("192.0.2.1:2")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+	if rec := request("192.0.2.2:1"); rec.Code != http.StatusOK {
+		t.Errorf("request of another client = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
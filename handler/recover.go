@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Recover turns a panic of the handler into a 500, instead of letting it take the server down. Errors returned by
+// the handler become a 500 too, since the engine would respond with its own body instead of the error envelope
+func Recover(next web.HandlerFunc) web.HandlerFunc {
+	return func(c web.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logger := requestLogger(c)
+				logger.Error().Str("stack", string(debug.Stack())).Msgf("panic: %v", r)
+				err = respondError(c, http.StatusInternalServerError, CodeInternalError, "something went wrong on the server")
+			}
+		}()
+		if handlerErr := next(c); handlerErr != nil {
+			logger := requestLogger(c)
+			logger.Error().Err(handlerErr).Msg("error handling the request")
+			return respondError(c, http.StatusInternalServerError, CodeInternalError, "something went wrong on the server")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/runabol/tork/middleware/web"
+)
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler web.HandlerFunc
+		status  int
+	}{
+		{name: "panic", handler: func(web.Context) error { panic("nil map") }, status: http.StatusInternalServerError},
+		{name: "error", handler: func(web.Context) error { return errors.New("broken") }, status: http.StatusInternalServerError},
+		{name: "success", handler: func(c web.Context) error { return c.String(http.StatusOK, "ok") }, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newTestContext(httptest.NewRequest(http.MethodPost, "/execute", nil))
+			if err := Recover(tt.handler)(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusInternalServerError {
+				checkEnvelope(t, tt.status, rec.Body.Bytes(), CodeInternalError)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Functions that run once, when the server starts, so they may compile the configured patterns
+var startupFuncs = map[string]bool{"defaultConfig": true, "LoadConfig": true}
+
+func TestRegexpsAreCompiledOnce(t *testing.T) {
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".go") || strings.HasSuffix(entry.Name(), "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, entry.Name(), nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil || startupFuncs[fn.Name.Name] {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+					if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "regexp" && strings.Contains(sel.Sel.Name, "Compile") {
+						t.Errorf("%s: %s compiles a regexp on every call", fset.Position(call.Pos()), fn.Name.Name)
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+// The benchmarks run the paths of every request, whose allocations grow with each pattern compiled on the way
+
+func BenchmarkHandleGccError(b *testing.B) {
+	stderr := jobPath("usercode.c") + ": In function 'main':\n" +
+		jobPath("usercode.c") + ":3:5: error: 'y' undeclared (first use in this function)\n" +
+		jobPath("usercode.c") + ":4:12: warning: unused variable 'n' [-Wunused-variable]\n" +
+		jobPath("usercode.c") + ":5:1: error: expected ';' before '}' token\n"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handleGccError("int main() {\n\tint x;\n\ty = 1;\n\tint n;\n}", stderr)
+	}
+}
+
+func BenchmarkBuildTask(b *testing.B) {
+	er := ExecRequest{Language: "c", Code: "int main() {}", Input: "1 2 3"}
+	cfg := defaultConfig()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := buildTask(context.Background(), er, cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSanitizeInput(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sanitizeInput("3 14 hello world")
+	}
+}
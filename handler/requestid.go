@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/runabol/tork/middleware/web"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Longer client-supplied IDs are replaced, so they can't flood the logs
+const maxRequestIDLength = 128
+
+// requestLogger reads the request ID from the X-Request-ID header, or generates one, echoes it back in the response
+// and returns a logger that tags every entry with it
+func requestLogger(c web.Context) zerolog.Logger {
+	// Already chosen when a logger was built earlier for the same request
+	if id := c.Response().Header().Get(requestIDHeader); id != "" {
+		return log.With().Str("request_id", id).Logger()
+	}
+	id := c.Request().Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = uuid.NewString()
+	}
+	c.Response().Header().Set(requestIDHeader, id)
+	return log.With().Str("request_id", id).Logger()
+}
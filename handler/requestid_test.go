@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "client id", header: "abc-123", keep: true},
+		{name: "no id"},
+		{name: "too long", header: strings.Repeat("x", maxRequestIDLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/execute", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+			c, rec := newTestContext(r)
+			requestLogger(c)
+			id := rec.Header().Get(requestIDHeader)
+			if tt.keep && id != tt.header {
+				t.Errorf("id = %q, want the client's %q", id, tt.header)
+			}
+			if !tt.keep && (id == "" || id == tt.header) {
+				t.Errorf("id = %q, want a generated one", id)
+			}
+			// Loggers built later for the same request share the id
+			requestLogger(c)
+			if again := rec.Header().Get(requestIDHeader); again != id {
+				t.Errorf("id changed from %q to %q", id, again)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+// drainer tracks the executions in flight, so the server can wait for them before shutting down
+type drainer struct {
+	sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+var drain = &drainer{}
+
+// Drain rejects executions once the server is shutting down and tracks the running ones
+func Drain(next web.HandlerFunc) web.HandlerFunc {
+	return func(c web.Context) error {
+		drain.Lock()
+		if drain.draining {
+			drain.Unlock()
+			return respondError(c, http.StatusServiceUnavailable, CodeServerShuttingDown, "the server is shutting down")
+		}
+		drain.inFlight.Add(1)
+		drain.Unlock()
+		defer drain.inFlight.Done()
+
+		return next(c)
+	}
+}
+
+// Shutdown stops accepting executions and waits for the running ones to finish, or for ctx to be done
+func Shutdown(ctx context.Context) error {
+	drain.Lock()
+	drain.draining = true
+	drain.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		drain.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/runabol/tork/middleware/web"
+)
+
+func TestShutdownDrainsExecutions(t *testing.T) {
+	saved := drain
+	t.Cleanup(func() { drain = saved })
+	drain = &drainer{}
+
+	running, finish := make(chan struct{}), make(chan struct{})
+	slow := Drain(func(c web.Context) error {
+		close(running)
+		<-finish
+		return c.JSON(http.StatusOK, "done")
+	})
+	c, _ := newTestContext(httptest.NewRequest(http.MethodPost, "/execute", nil))
+	go func() { _ = slow(c) }()
+	<-running
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err == nil {
+		t.Fatal("shutdown didn't wait for the running execution")
+	}
+
+	c, rec := newTestContext(httptest.NewRequest(http.MethodPost, "/execute", nil))
+	if err := Drain(func(c web.Context) error { return c.JSON(http.StatusOK, "done") })(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("execution while shutting down = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	close(finish)
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown = %v once the execution finished", err)
+	}
+}
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/datastore"
+	"github.com/runabol/tork/engine"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+	"golang.org/x/net/websocket"
+)
+
+// streamFrame is a message sent by Stream. What the program prints arrives in "stdout" frames, one per line, and the
+// execution ends with a "result" frame, with the same status and body a request to /execute gets
+type streamFrame struct {
+	Event  string `json:"event"`
+	Line   string `json:"line,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Result any    `json:"result,omitempty"`
+}
+
+// How often the log of a running execution is checked for new output. The engine ships it every second
+const streamPollInterval = 500 * time.Millisecond
+
+// Parts of the log read at once
+const logPartsPageSize = 100
+
+// jobLogParts returns a page of the log of a job, the newest parts first. It's a variable, so the engine can be
+// replaced, e.g. by a fake one
+var jobLogParts = func(ctx context.Context, jobID string, page int) (*datastore.Page[*tork.TaskLogPart], error) {
+	return engine.Datastore().GetJobLogParts(ctx, jobID, "", page, logPartsPageSize)
+}
+
+// cancelJob stops a job that is still running, like the cancel endpoint of the engine. It's a variable, so the
+// engine can be replaced
+var cancelJob = func(ctx context.Context, jobID string) error {
+	j, err := engine.Datastore().GetJobByID(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if j.State != tork.JobStateRunning && j.State != tork.JobStateScheduled {
+		return nil
+	}
+	j.State = tork.JobStateCancelled
+	return engine.Broker().PublishJob(ctx, j)
+}
+
+// Stream executes the request sent in the first message of a WebSocket, and sends what the program prints while it
+// runs, followed by the result
+func Stream(c web.Context) error {
+	start := time.Now()
+	logger := requestLogger(c)
+
+	server := websocket.Server{
+		// Browsers don't apply CORS to WebSockets, so the origin is checked here
+		Handshake: func(_ *websocket.Config, req *http.Request) error {
+			if origin := req.Header.Get("Origin"); origin != "" && !corsAllowed(config.CORSOrigins, origin) {
+				return errors.Errorf("origin not allowed: %s", origin)
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			stream(c, ws, logger, start)
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+func stream(c web.Context, ws *websocket.Conn, logger zerolog.Logger, start time.Time) {
+	send := func(frame streamFrame) bool {
+		if err := websocket.JSON.Send(ws, frame); err != nil {
+			logger.Debug().Err(err).Msg("error sending a frame")
+			return false
+		}
+		return true
+	}
+	fail := func(apiErr *apiError) {
+		send(streamFrame{Event: "result", Status: apiErr.Status, Result: newErrorBody(apiErr.Status, apiErr.Code, apiErr.Message)})
+	}
+
+	ws.MaxPayloadBytes = config.MaxBodyBytes
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		if errors.Is(err, websocket.ErrFrameTooLarge) {
+			fail(bodyTooLargeError())
+		}
+		return
+	}
+
+	er := ExecRequest{}
+	var err error
+	if config.StrictJSON {
+		err = decodeStrict(bytes.NewReader(data), &er)
+	} else {
+		err = json.Unmarshal(data, &er)
+	}
+	if err != nil {
+		fail(bindError(err))
+		return
+	}
+	c.Set(languageKey, er.Language)
+	if apiErr := checkRequest(logger, &er); apiErr != nil {
+		fail(apiErr)
+		return
+	}
+
+	er.stream = true
+	task, err := buildTask(c.Request().Context(), er, config)
+	if err != nil {
+		fail(taskError(logger, err))
+		return
+	}
+
+	release, ok := acquireExecution(er.Language)
+	if !ok {
+		fail(serverBusyError())
+		return
+	}
+	defer release()
+
+	job := &input.Job{
+		Name:  "code execution",
+		Tasks: []input.Task{task},
+	}
+	result := make(chan jobResult, 1)
+	if _, err := submitJob(c.Request().Context(), job, newJobListener(result)); err != nil {
+		logger.Error().Err(err).Msg("error submitting the job")
+		fail(engineUnavailableError())
+		return
+	}
+	logger.Debug().Msgf("streamed job %s submitted", job.ID())
+
+	// Nothing else is expected from the client, so reading only finds out when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	follower := &logFollower{jobID: job.ID()}
+	done := c.Done()
+	for {
+		select {
+		case res := <-result:
+			// The log may lag behind, but the result has the whole output anyway
+			status, body, err := executionResponse(logger, er, res)
+			if err != nil {
+				logger.Error().Err(err).Msgf("error building the result of job %s", job.ID())
+				apiErr := unreadableResultError()
+				status, body = apiErr.Status, newErrorBody(apiErr.Status, apiErr.Code, apiErr.Message)
+			}
+			observeExecution(er.Language, start, status, body)
+			send(streamFrame{Event: "result", Status: status, Result: body})
+			return
+
+		case <-ticker.C:
+			lines, err := follower.next(context.Background())
+			if err != nil {
+				logger.Debug().Err(err).Msgf("error reading the log of job %s", job.ID())
+				continue
+			}
+			for _, line := range lines {
+				if !send(streamFrame{Event: "stdout", Line: line}) {
+					break
+				}
+			}
+
+		case <-gone:
+			logger.Debug().Msg("client disconnected before the execution finished")
+			if err := cancelJob(context.Background(), job.ID()); err != nil {
+				logger.Error().Err(err).Msgf("error cancelling job %s", job.ID())
+			}
+			return
+
+		case <-done:
+			logger.Debug().Msg("server shut down before the execution finished")
+			fail(&apiError{Status: http.StatusServiceUnavailable, Code: CodeServerShuttingDown, Message: "the server is shutting down"})
+			return
+		}
+	}
+}
+
+// logFollower splits the log of a job into lines. The engine ships whatever was written in parts, which may end in
+// the middle of a line
+type logFollower struct {
+	jobID string
+	// Number of the last part read
+	last int
+	// Start of a line whose end wasn't shipped yet
+	partial string
+	// Bytes read so far. The log isn't followed past Config.MaxOutputBytes, like the output in the result
+	read int
+}
+
+// next returns the lines completed since the last call
+func (f *logFollower) next(ctx context.Context) ([]string, error) {
+	if f.read > config.MaxOutputBytes {
+		return nil, nil
+	}
+	var parts []*tork.TaskLogPart
+	for page := 1; ; page++ {
+		p, err := jobLogParts(ctx, f.jobID, page)
+		if err != nil {
+			return nil, err
+		}
+		seen := false
+		for _, part := range p.Items {
+			if part.Number <= f.last {
+				seen = true
+				break
+			}
+			parts = append(parts, part)
+		}
+		if seen || page >= p.TotalPages {
+			break
+		}
+	}
+	slices.Reverse(parts)
+
+	text := f.partial
+	for _, part := range parts {
+		text += part.Contents
+		f.read += len(part.Contents)
+		f.last = part.Number
+	}
+	lines := strings.Split(text, "\n")
+	f.partial = lines[len(lines)-1]
+	return lines[:len(lines)-1], nil
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/datastore"
+	"github.com/runabol/tork/input"
+	"golang.org/x/net/websocket"
+)
+
+// withLog replaces the log of the jobs for the test with the parts, oldest first, served in pages of the size
+func withLog(t *testing.T, parts *[]string, size int) {
+	t.Helper()
+	saved := jobLogParts
+	t.Cleanup(func() { jobLogParts = saved })
+	jobLogParts = func(_ context.Context, _ string, page int) (*datastore.Page[*tork.TaskLogPart], error) {
+		var newest []*tork.TaskLogPart
+		for i := len(*parts) - 1; i >= 0; i-- {
+			newest = append(newest, &tork.TaskLogPart{Number: i + 1, Contents: (*parts)[i]})
+		}
+		totalPages := (len(newest) + size - 1) / size
+		start, end := min((page-1)*size, len(newest)), min(page*size, len(newest))
+		return &datastore.Page[*tork.TaskLogPart]{Items: newest[start:end], Number: page, TotalPages: totalPages}, nil
+	}
+}
+
+func TestLogFollower(t *testing.T) {
+	var parts []string
+	withLog(t, &parts, 2)
+	f := &logFollower{jobID: "job"}
+
+	next := func() []string {
+		t.Helper()
+		lines, err := f.next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lines
+	}
+	if lines := next(); len(lines) != 0 {
+		t.Errorf("lines of an empty log = %q", lines)
+	}
+	// More parts than a page, the last one ending in the middle of a line
+	parts = append(parts, "1\n", "2\n3", "\n4", "5")
+	if lines := next(); strings.Join(lines, ",") != "1,2,3" {
+		t.Errorf("lines = %q, want 1, 2 and 3", lines)
+	}
+	parts = append(parts, "\n6\n")
+	if lines := next(); strings.Join(lines, ",") != "45,6" {
+		t.Errorf("lines = %q, want the end of the partial line and 6", lines)
+	}
+	if lines := next(); len(lines) != 0 {
+		t.Errorf("lines already read = %q", lines)
+	}
+
+	withConfig(t, func(c *Config) { c.MaxOutputBytes = 4 })
+	parts = append(parts, "7\n")
+	if lines := next(); len(lines) != 0 {
+		t.Errorf("lines past the maximum output = %q", lines)
+	}
+}
+
+// dialStream opens a WebSocket to Stream
+func dialStream(t *testing.T) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := testContext{Context: echo.New().NewContext(r, w), done: make(chan any)}
+		_ = Stream(c)
+	}))
+	t.Cleanup(server.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func TestStream(t *testing.T) {
+	withLog(t, new([]string), logPartsPageSize)
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job {
+		return tracedJob("stdout=hi")
+	})
+
+	ws := dialStream(t)
+	if err := websocket.Message.Send(ws, `{"language":"c","code":"int main() {}"}`); err != nil {
+		t.Fatal(err)
+	}
+	var frame struct {
+		Event  string         `json:"event"`
+		Status int            `json:"status"`
+		Result map[string]any `json:"result"`
+	}
+	if err := websocket.JSON.Receive(ws, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Event != "result" || frame.Status != http.StatusOK || frame.Result["stdout"] != "hi" {
+		t.Errorf("frame = %+v", frame)
+	}
+	if jobs := fake.submitted(); len(jobs) != 1 || !strings.Contains(jobs[0].Tasks[0].Run, "tail -n +1 -f ") {
+		t.Errorf("the output of the program isn't followed: %v", jobs)
+	}
+
+	ws = dialStream(t)
+	if err := websocket.Message.Send(ws, `{"language":"c"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.JSON.Receive(ws, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Event != "result" || frame.Status != http.StatusBadRequest {
+		t.Errorf("frame of an invalid request = %+v", frame)
+	}
+}
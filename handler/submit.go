@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/engine"
+	"github.com/runabol/tork/input"
+)
+
+// engineSubmitJob submits jobs to the engine. It's a variable, so the engine can be replaced, e.g. by a fake one
+var engineSubmitJob = engine.SubmitJob
+
+// submitJob submits a job to the engine, trying again up to Config.SubmitRetries times when it fails for a reason that
+// may go away, e.g. the datastore or the broker being briefly unreachable. The waits between the tries double every
+// time, and a try that would end after the deadline of ctx isn't made
+func submitJob(ctx context.Context, job *input.Job, listeners ...engine.JobListener) (*tork.Job, error) {
+	backoff := config.SubmitBackoff
+	for try := 0; ; try++ {
+		j, err := engineSubmitJob(ctx, job, listeners...)
+		if err == nil || try >= config.SubmitRetries || !transientSubmitError(err) {
+			return j, err
+		}
+		// Jittered, so the requests that failed together don't all try again at once
+		delay := backoff/2 + rand.N(backoff/2+1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return j, err
+		}
+		log.Debug().Err(err).Msgf("retrying the submission of job %s in %s", job.ID(), delay)
+		select {
+		case <-ctx.Done():
+			return j, err
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+// transientSubmitError reports whether submitting a job may succeed if it's tried again. The job being invalid, or
+// the request being gone, never change
+func transientSubmitError(err error) bool {
+	var invalid validator.ValidationErrors
+	return !errors.As(err, &invalid) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
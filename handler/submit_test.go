@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/engine"
+	"github.com/runabol/tork/input"
+)
+
+// withFailingSubmissions makes the first submissions of the test, up to failures, fail with err, and submits the next
+// ones to the fake engine. It returns the number of tries
+func withFailingSubmissions(t *testing.T, fake *fakeEngine, failures int, err error) *atomic.Int64 {
+	t.Helper()
+	var tries atomic.Int64
+	engineSubmitJob = func(ctx context.Context, job *input.Job, listeners ...engine.JobListener) (*tork.Job, error) {
+		if tries.Add(1) <= int64(failures) {
+			return nil, err
+		}
+		return fake.submit(ctx, job, listeners...)
+	}
+	return &tries
+}
+
+func TestSubmitJobRetries(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.SubmitRetries = 2
+		c.SubmitBackoff = time.Millisecond
+	})
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job {
+		return tracedJob()
+	})
+	tries := withFailingSubmissions(t, fake, 1, errors.New("broker unreachable"))
+
+	c, rec := newTestContext(newJSONRequest("/execute", strings.NewReader(`{"language":"c","code":"int main() {}"}`)))
+	if err := Handler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if n := tries.Load(); n != 2 {
+		t.Errorf("tried %d times, want 2", n)
+	}
+	if n := len(fake.submitted()); n != 1 {
+		t.Errorf("the engine got %d jobs, want 1", n)
+	}
+}
+
+func TestSubmitJobGivesUp(t *testing.T) {
+	job := &input.Job{Name: "code execution", Tasks: []input.Task{{Name: "task"}}}
+	tests := []struct {
+		name    string
+		err     error
+		backoff time.Duration
+		timeout time.Duration
+		tries   int64
+	}{
+		{name: "transient", err: errors.New("broker unreachable"), backoff: time.Millisecond, tries: 3},
+		{name: "invalid job", err: errors.Wrap(validator.ValidationErrors{}, "invalid job"), backoff: time.Millisecond, tries: 1},
+		{name: "cancelled", err: context.Canceled, backoff: time.Millisecond, tries: 1},
+		// The wait would outlast the request
+		{name: "deadline", err: errors.New("broker unreachable"), backoff: time.Minute, timeout: time.Second, tries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.SubmitRetries = 2
+				c.SubmitBackoff = tt.backoff
+			})
+			fake := withFakeEngine(t, func(*input.Job) *tork.Job { return nil })
+			tries := withFailingSubmissions(t, fake, 10, tt.err)
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			if _, err := submitJob(ctx, job); !errors.Is(err, tt.err) {
+				t.Errorf("submitJob() = %v, want %v", err, tt.err)
+			}
+			if n := tries.Load(); n != tt.tries {
+				t.Errorf("tried %d times, want %d", n, tt.tries)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// traceResult is the response to a traced execution: the trace of the parser, in the format of Online Python Tutor,
+// and what the server found out about the run
+type traceResult struct {
+	Code  string      `json:"code"`
+	Trace []traceStep `json:"trace"`
+
+	Warnings []ErrorMsg `json:"warnings"`
+	Stdout   string     `json:"stdout"`
+	Stderr   string     `json:"stderr"`
+	// Only present when the request asked for files, even if the program wrote none of them
+	Files     map[string]string `json:"files,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+	Phase     string            `json:"phase"`
+	// Omitted when the script couldn't report it
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	ExitSignal string `json:"exit_signal,omitempty"`
+	// The error that stopped the program, if any. Errors has it too, for clients that handle compile errors already
+	Error  *ErrorMsg  `json:"error,omitempty"`
+	Errors []ErrorMsg `json:"errors,omitempty"`
+	// The measures are omitted when time couldn't report them
+	ElapsedMs *int `json:"elapsed_ms,omitempty"`
+	MaxRSSKb  *int `json:"max_rss_kb,omitempty"`
+
+	Debug map[string]string `json:"debug,omitempty"`
+}
+
+// traceStep is a step of the trace. Values are kept as the parser encoded them, e.g. ["REF", 1], since the server
+// never looks into them, and their numbers may not fit in a float64, like 64-bit integers
+type traceStep struct {
+	Event string `json:"event"`
+	Line  int    `json:"line"`
+	// Only syntax errors of Python have it, the column of the error
+	Offset         *int                       `json:"offset,omitempty"`
+	FuncName       string                     `json:"func_name,omitempty"`
+	Globals        map[string]json.RawMessage `json:"globals"`
+	OrderedGlobals []string                   `json:"ordered_globals"`
+	StackToRender  []traceFrame               `json:"stack_to_render"`
+	Heap           map[string]json.RawMessage `json:"heap"`
+	// What the program printed until this step
+	Stdout       string `json:"stdout"`
+	ExceptionMsg string `json:"exception_msg,omitempty"`
+}
+
+// traceFrame is a frame of the stack of a step
+type traceFrame struct {
+	FuncName string `json:"func_name"`
+	// A number for Python, the frame pointer for C/C++
+	FrameID           json.RawMessage            `json:"frame_id"`
+	UniqueHash        string                     `json:"unique_hash"`
+	IsHighlighted     bool                       `json:"is_highlighted"`
+	EncodedLocals     map[string]json.RawMessage `json:"encoded_locals"`
+	OrderedVarnames   []string                   `json:"ordered_varnames"`
+	Line              int                        `json:"line,omitempty"`
+	IsParent          bool                       `json:"is_parent"`
+	IsZombie          bool                       `json:"is_zombie"`
+	ParentFrameIDList []json.RawMessage          `json:"parent_frame_id_list"`
+}
+
+// parseTrace reads the output of the parser. Fields it doesn't know are dropped, and the ones a step may lack, e.g.
+// the step of a syntax error, are filled in empty, so clients never get null instead of a list
+func parseTrace(output string) (*traceResult, error) {
+	var fields struct {
+		Code  *string      `json:"code"`
+		Trace *[]traceStep `json:"trace"`
+	}
+	if err := json.Unmarshal([]byte(output), &fields); err != nil {
+		return nil, err
+	}
+	if fields.Code == nil {
+		return nil, errors.New("the trace has no code")
+	}
+	if fields.Trace == nil {
+		return nil, errors.New("the trace has no steps")
+	}
+
+	result := &traceResult{Code: *fields.Code, Trace: *fields.Trace}
+	for i := range result.Trace {
+		step := &result.Trace[i]
+		if step.Event == "" {
+			return nil, errors.Errorf("step %d of the trace has no event", i)
+		}
+		if step.Globals == nil {
+			step.Globals = make(map[string]json.RawMessage)
+		}
+		if step.OrderedGlobals == nil {
+			step.OrderedGlobals = []string{}
+		}
+		if step.StackToRender == nil {
+			step.StackToRender = []traceFrame{}
+		}
+		if step.Heap == nil {
+			step.Heap = make(map[string]json.RawMessage)
+		}
+		for j := range step.StackToRender {
+			frame := &step.StackToRender[j]
+			if frame.EncodedLocals == nil {
+				frame.EncodedLocals = make(map[string]json.RawMessage)
+			}
+			if frame.OrderedVarnames == nil {
+				frame.OrderedVarnames = []string{}
+			}
+			if frame.ParentFrameIDList == nil {
+				frame.ParentFrameIDList = []json.RawMessage{}
+			}
+		}
+	}
+	return result, nil
+}
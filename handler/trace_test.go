@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parserTrace is the output of the parser for a C program with a pointer to the heap and a 64-bit integer
+const parserTrace = `{"code":"int main() {\n  int *p = malloc(4);\n}","trace":[` +
+	`{"event":"step_line","line":2,"func_name":"main","globals":{},"ordered_globals":[],` +
+	`"stack_to_render":[{"func_name":"main","frame_id":"0xFFEFFFE40","unique_hash":"main_0xFFEFFFE40",` +
+	`"is_highlighted":true,"encoded_locals":{"p":["C_DATA","0xFFEFFFE38","pointer","<UNINITIALIZED>"],` +
+	`"n":["C_DATA","0xFFEFFFE30","unsigned long",18446744073709551615]},"ordered_varnames":["p","n"],` +
+	`"line":2,"is_parent":false,"is_zombie":false,"parent_frame_id_list":[]}],` +
+	`"heap":{"0x4C2B040":["C_ARRAY","0x4C2B040",["C_DATA","0x4C2B040","int","<UNINITIALIZED>"]]},"stdout":""},` +
+	`{"event":"return","line":3,"func_name":"main","globals":{},"ordered_globals":[],"stack_to_render":[],"heap":{},"stdout":"done\n"}]}`
+
+// decodeJSON decodes the JSON keeping its numbers as they are, so they can be compared exactly
+func decodeJSON(t *testing.T, data []byte) any {
+	t.Helper()
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	return v
+}
+
+func TestParseTrace(t *testing.T) {
+	result, err := parseTrace(parserTrace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeJSON(t, encoded).(map[string]any)
+	want := decodeJSON(t, []byte(parserTrace)).(map[string]any)
+	if !reflect.DeepEqual(got["code"], want["code"]) || !reflect.DeepEqual(got["trace"], want["trace"]) {
+		t.Errorf("round trip = %s, want %s", encoded, parserTrace)
+	}
+	if !strings.Contains(string(encoded), "18446744073709551615") {
+		t.Error("the 64-bit integer lost its precision")
+	}
+}
+
+func TestParseTraceFillsMissingFields(t *testing.T) {
+	result, err := parseTrace(`{"code":"x = (","trace":[{"event":"uncaught_exception","line":1,"offset":5,` +
+		`"exception_msg":"SyntaxError: invalid syntax","stack_to_render":[{"func_name":"f"}]}],"unknown":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(result.Trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"globals":{}`, `"ordered_globals":[]`, `"heap":{}`, `"encoded_locals":{}`,
+		`"ordered_varnames":[]`, `"parent_frame_id_list":[]`, `"offset":5`} {
+		if !strings.Contains(string(encoded), field) {
+			t.Errorf("%s missing from %s", field, encoded)
+		}
+	}
+}
+
+func TestParseTraceRejectsInvalidTraces(t *testing.T) {
+	for _, output := range []string{
+		`not JSON`,
+		`{"trace":[]}`,
+		`{"code":"int main() {}"}`,
+		`{"code":"int main() {}","trace":null}`,
+		`{"code":"int main() {}","trace":[{"line":1}]}`,
+	} {
+		if _, err := parseTrace(output); err == nil {
+			t.Errorf("parseTrace(%s) succeeded", output)
+		}
+	}
+}
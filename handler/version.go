@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/runabol/tork/input"
+	"github.com/runabol/tork/middleware/web"
+)
+
+// Build information, set with:
+// go build -ldflags "-X github.com/arturo32/HowPointersWork-server/handler.Commit=... -X github.com/arturo32/HowPointersWork-server/handler.BuildTime=..."
+var (
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Maximum time to wait for the compilers to report their versions
+const probeTimeout = 30 * time.Second
+
+type VersionInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	// Version of each compiler of the execution image. Omitted when probing is disabled or failed
+	Compilers map[string]string `json:"compilers,omitempty"`
+}
+
+// Compiler versions are probed once, when the server starts, since probing starts a container. Requests only read
+// what was cached
+var compilerVersions struct {
+	sync.Mutex
+	// Version of each probed binary by image. Binaries that aren't in the image, or whose image couldn't be probed,
+	// have an empty version
+	images map[string]map[string]string
+}
+
+// Binaries of the execution image whose versions /version reports
+var versionBinaries = []string{"gcc", "g++", "clang", "clang++"}
+
+// Version reports the build of the server and the versions of the compilers it runs
+func Version(c web.Context) error {
+	info := VersionInfo{
+		Commit:    Commit,
+		BuildTime: BuildTime,
+	}
+	if config.ProbeCompilers {
+		info.Compilers = make(map[string]string)
+		for binary, version := range cachedVersions(config.Image, versionBinaries) {
+			if version != "" {
+				info.Compilers[binary] = version
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// cachedVersions returns the cached versions of the binaries of the image. The ones that weren't probed yet are
+// missing, and the unavailable ones are empty
+func cachedVersions(image string, binaries []string) map[string]string {
+	compilerVersions.Lock()
+	defer compilerVersions.Unlock()
+
+	versions := make(map[string]string)
+	for _, binary := range binaries {
+		if version, ok := compilerVersions.images[image][binary]; ok {
+			versions[binary] = version
+		}
+	}
+	return versions
+}
+
+// probeVersions runs "--version" of the binaries in the image and caches their versions. When the probe fails, e.g.
+// because the image is missing, they're cached as unavailable, so it isn't tried again
+func probeVersions(ctx context.Context, image string, binaries []string) error {
+	var run string
+	for _, binary := range binaries {
+		// Only the first line has the version, e.g. "gcc (Debian 6.3.0-18+deb9u1) 6.3.0 20170516"
+		run += "echo \"" + binary + "=$(" + binary + " --version 2>/dev/null | head -n 1)\" >> $TORK_OUTPUT; "
+	}
+	// The probe may take a while, so the lock is only taken to store its result
+	output, err := runProbe(ctx, image, run)
+
+	probed := make(map[string]string)
+	for _, binary := range binaries {
+		probed[binary] = ""
+	}
+	if err == nil {
+		for _, line := range strings.Split(output, "\n") {
+			binary, version, ok := strings.Cut(line, "=")
+			if _, asked := probed[binary]; ok && asked {
+				probed[binary] = version
+			}
+		}
+	}
+
+	compilerVersions.Lock()
+	defer compilerVersions.Unlock()
+	if compilerVersions.images == nil {
+		compilerVersions.images = make(map[string]map[string]string)
+	}
+	if compilerVersions.images[image] == nil {
+		compilerVersions.images[image] = make(map[string]string)
+	}
+	for binary, version := range probed {
+		compilerVersions.images[image][binary] = version
+	}
+	return err
+}
+
+// runProbe runs a short task in the image and returns its output
+func runProbe(ctx context.Context, image string, run string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	result := make(chan jobResult, 1)
+	listener := newJobListener(result)
+
+	probe := &input.Job{
+		Name: "probe",
+		Tasks: []input.Task{{
+			Name:    "probe",
+			Image:   image,
+			Run:     run,
+			Timeout: probeTimeout.String(),
+		}},
+	}
+	if _, err := submitJob(ctx, probe, listener); err != nil {
+		return "", errors.Wrapf(err, "error submitting probe")
+	}
+
+	select {
+	case r := <-result:
+		if r.failed {
+			return "", errors.Errorf("probe failed: %s", r.output)
+		}
+		return r.output, nil
+	case <-ctx.Done():
+		return "", errors.Wrapf(ctx.Err(), "probe timed out")
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/runabol/tork"
+	"github.com/runabol/tork/input"
+)
+
+func TestVersionServesOnlyTheCache(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ProbeCompilers = true })
+	resetCompilerVersions(t)
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job { return completedJob("gcc=gcc 6.3.0\n") })
+
+	c, rec := newTestContext(httptest.NewRequest(http.MethodGet, "/version", nil))
+	if err := Version(c); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.submitted()); n != 0 {
+		t.Fatalf("Version submitted %d probes", n)
+	}
+	var info VersionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Compilers) != 0 {
+		t.Errorf("compilers before the probe = %v, want none", info.Compilers)
+	}
+
+	if err := probeVersions(context.Background(), config.Image, versionBinaries); err != nil {
+		t.Fatal(err)
+	}
+	c, rec = newTestContext(httptest.NewRequest(http.MethodGet, "/version", nil))
+	if err := Version(c); err != nil {
+		t.Fatal(err)
+	}
+	info = VersionInfo{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"gcc": "gcc 6.3.0"}
+	if len(info.Compilers) != len(want) || info.Compilers["gcc"] != want["gcc"] {
+		t.Errorf("compilers = %v, want %v", info.Compilers, want)
+	}
+}
+
+func TestProbeVersionsCachesFailures(t *testing.T) {
+	withConfig(t, func(c *Config) { c.SubmitRetries = 0 })
+	resetCompilerVersions(t)
+	fake := withFakeEngine(t, func(*input.Job) *tork.Job { return failedJob("no such image") })
+
+	binaries := []string{"gcc", "clang"}
+	if err := probeVersions(context.Background(), "missing", binaries); err == nil {
+		t.Fatal("probing a missing image succeeded")
+	}
+	versions := cachedVersions("missing", binaries)
+	for _, binary := range binaries {
+		if version, ok := versions[binary]; !ok || version != "" {
+			t.Errorf("%s = %q, %v, want cached as unavailable", binary, version, ok)
+		}
+	}
+	if n := len(fake.submitted()); n != 1 {
+		t.Errorf("submitted %d probes, want 1", n)
+	}
+	if !strings.Contains(fake.submitted()[0].Tasks[0].Run, "gcc --version") {
+		t.Errorf("probe doesn't ask gcc its version: %s", fake.submitted()[0].Tasks[0].Run)
+	}
+}
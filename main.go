@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/arturo32/HowPointersWork-server/handler"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/runabol/tork/cli"
 	"github.com/runabol/tork/conf"
 	"github.com/runabol/tork/engine"
@@ -17,10 +25,119 @@ func main() {
 		os.Exit(1)
 	}
 
-	engine.RegisterEndpoint(http.MethodPost, "/execute", handler.Handler)
+	if err := handler.LoadConfig(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Compress is outside AccessLog, which then sees the responses before they're gzipped, the ones of Recover too
+	engine.RegisterEndpoint(http.MethodPost, "/execute", handler.Compress(handler.AccessLog(handler.Recover(handler.CORS(handler.Drain(handler.RateLimit(handler.Handler)))))))
+	engine.RegisterEndpoint(http.MethodPost, "/execute/batch", handler.Compress(handler.AccessLog(handler.Recover(handler.CORS(handler.Drain(handler.RateLimit(handler.Batch)))))))
+	engine.RegisterEndpoint(http.MethodPost, "/validate", handler.Compress(handler.AccessLog(handler.Recover(handler.CORS(handler.Drain(handler.RateLimit(handler.Validate)))))))
+	engine.RegisterEndpoint(http.MethodGet, "/execute/stream", handler.AccessLog(handler.Recover(handler.Drain(handler.RateLimit(handler.Stream)))))
+	engine.RegisterEndpoint(http.MethodGet, "/jobs/:id", handler.Compress(handler.AccessLog(handler.Recover(handler.CORS(handler.Job)))))
+	engine.RegisterEndpoint(http.MethodPost, "/jobs/:id/cancel", handler.AccessLog(handler.Recover(handler.CORS(handler.CancelJob))))
+	engine.RegisterEndpoint(http.MethodGet, "/languages", handler.Compress(handler.AccessLog(handler.Recover(handler.CORS(handler.Languages)))))
+	engine.RegisterEndpoint(http.MethodGet, "/compilers", handler.Compress(handler.AccessLog(handler.Recover(handler.CORS(handler.Compilers)))))
+	engine.RegisterEndpoint(http.MethodGet, "/health", handler.Recover(handler.CORS(handler.Health)))
+	engine.RegisterEndpoint(http.MethodGet, "/ready", handler.Recover(handler.CORS(handler.Ready)))
+	engine.RegisterEndpoint(http.MethodGet, "/version", handler.AccessLog(handler.Recover(handler.CORS(handler.Version))))
+	engine.RegisterEndpoint(http.MethodGet, "/metrics", handler.Recover(handler.Metrics))
+	// Preflight requests of the browser
+	engine.RegisterEndpoint(http.MethodOptions, "/execute", handler.Recover(handler.CORS(handler.Preflight)))
+	engine.RegisterEndpoint(http.MethodOptions, "/execute/batch", handler.Recover(handler.CORS(handler.Preflight)))
+	engine.RegisterEndpoint(http.MethodOptions, "/validate", handler.Recover(handler.CORS(handler.Preflight)))
+	engine.RegisterEndpoint(http.MethodOptions, "/jobs/:id", handler.Recover(handler.CORS(handler.Preflight)))
+	engine.RegisterEndpoint(http.MethodOptions, "/jobs/:id/cancel", handler.Recover(handler.CORS(handler.Preflight)))
+
+	// Anything but running the engine, e.g. the migration, is left to the engine's CLI
+	if len(os.Args) != 3 || os.Args[1] != "run" {
+		if err := cli.New().Run(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := setupLogging(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// The signals are ours before the engine starts, so none is missed while it does
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
-	if err := cli.New().Run(); err != nil {
+	mode := engine.Mode(os.Args[2])
+	engine.SetMode(mode)
+	if err := engine.Start(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	takeOverSignals(quit)
+
+	// Caches the versions of the compilers, so the first request doesn't wait for them. Workers don't submit jobs
+	if mode != engine.ModeWorker {
+		go handler.ProbeAllCompilers(context.Background())
+	}
+
+	<-quit
+	log.Info().Msgf("shutting down, waiting up to %s for running executions", handler.ShutdownGrace())
+
+	ctx, cancel := context.WithTimeout(context.Background(), handler.ShutdownGrace())
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("executions still running, they will be cancelled")
+	}
+
+	if err := engine.Terminate(); err != nil {
+		log.Error().Err(err).Msg("error terminating the engine")
+	}
+}
+
+// takeOverSignals leaves quit as the only receiver of SIGINT/SIGTERM. The engine listens for them too, and stops right
+// away, from a goroutine that Start doesn't wait for: its handler is removed once that goroutine waits for them
+func takeOverSignals(quit chan os.Signal) {
+	for !engineAwaitingSignals() {
+		runtime.Gosched()
+	}
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+}
+
+// engineAwaitingSignals reports whether the engine's goroutine registered its handler and waits for the signals
+func engineAwaitingSignals() bool {
+	buf := make([]byte, 1<<20)
+	for _, g := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+		if strings.Contains(g, " [select") && strings.Contains(g, "/tork/engine.(*Engine).awaitTerm(") {
+			return true
+		}
+	}
+	return false
+}
+
+// setupLogging configures the logger from the logging section, as the engine's CLI does
+func setupLogging() error {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	switch level := strings.ToLower(conf.StringDefault("logging.level", "debug")); level {
+	case "debug":
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	case "info":
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	case "warn", "warning":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	case "error":
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	default:
+		return errors.Errorf("invalid logging level: %s", level)
+	}
+	switch format := strings.ToLower(conf.StringDefault("logging.format", "pretty")); format {
+	case "pretty":
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "2006-01-02 15:04:05"})
+	case "json":
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	default:
+		return errors.Errorf("invalid logging format: %s", format)
+	}
+	return nil
 }
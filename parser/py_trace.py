@@ -0,0 +1,267 @@
+# Trace a Python program line by line and produce JSON to stdout in the
+# Online Python Tutor format, like vg_to_opt_trace.py does for C/C++
+#
+# Runs with the python3 of the execution image (3.5), so no f-strings
+#
+# Usage: python3 py_trace.py [--stdout=path] /tmp/user_code/job.Ab12Cd/usercode.py [args...] < input
+#
+# With --stdout, what the program prints is also written to that file as it
+# runs, so it's kept even if the tracer is killed
+
+import io
+import json
+import math
+import os
+import sys
+import traceback
+
+MAX_STEPS = 300
+
+
+class StepLimitReached(Exception):
+    pass
+
+
+# keeps what the program prints for the steps, and copies it to a file
+class Output(io.StringIO):
+    def __init__(self, copy=None):
+        super().__init__()
+        self.copy = copy
+
+    def write(self, s):
+        if self.copy is not None:
+            self.copy.write(s)
+            self.copy.flush()
+        return super().write(s)
+
+
+class Tracer:
+    def __init__(self, filename, copy=None):
+        self.filename = filename
+        self.trace = []
+        self.stdout = Output(copy)
+        # small, stable ids for frames and heap objects. The objects are kept
+        # alive, so their id() is never reused by another one
+        self.frame_ids = {}
+        self.object_ids = {}
+        self.objects = []
+        self.ordered_globals = []
+
+    def frame_id(self, frame):
+        if id(frame) not in self.frame_ids:
+            self.frame_ids[id(frame)] = len(self.frame_ids) + 1
+        return self.frame_ids[id(frame)]
+
+    def object_id(self, obj):
+        if id(obj) not in self.object_ids:
+            self.object_ids[id(obj)] = len(self.object_ids) + 1
+            self.objects.append(obj)
+        return self.object_ids[id(obj)]
+
+    # returns an encoded value in OPT format and possibly mutates the heap
+    def encode(self, value, heap):
+        if value is None or isinstance(value, (bool, int, str)):
+            return value
+        if isinstance(value, float):
+            if math.isnan(value) or math.isinf(value):
+                return ['SPECIAL_FLOAT', repr(value)]
+            return value
+
+        oid = self.object_id(value)
+        ref = ['REF', oid]
+        if oid in heap:
+            return ref
+        heap[oid] = None  # placeholder, so cycles end here
+
+        if isinstance(value, list):
+            heap[oid] = ['LIST'] + [self.encode(e, heap) for e in value]
+        elif isinstance(value, tuple):
+            heap[oid] = ['TUPLE'] + [self.encode(e, heap) for e in value]
+        elif isinstance(value, (set, frozenset)):
+            heap[oid] = ['SET'] + [self.encode(e, heap) for e in value]
+        elif isinstance(value, dict):
+            heap[oid] = ['DICT'] + [[self.encode(k, heap), self.encode(v, heap)] for k, v in value.items()]
+        elif callable(value) and hasattr(value, '__code__'):
+            args = value.__code__.co_varnames[:value.__code__.co_argcount]
+            heap[oid] = ['FUNCTION', value.__name__ + '(' + ', '.join(args) + ')', None]
+        elif isinstance(value, type):
+            heap[oid] = ['CLASS', value.__name__, [b.__name__ for b in value.__bases__ if b is not object]]
+        elif hasattr(value, '__dict__'):
+            heap[oid] = ['INSTANCE', type(value).__name__] + \
+                [[k, self.encode(v, heap)] for k, v in sorted(vars(value).items()) if not k.startswith('__')]
+        else:
+            heap[oid] = ['HEAP_PRIMITIVE', type(value).__name__, repr(value)]
+        return ref
+
+    def is_user_frame(self, frame):
+        return frame.f_code.co_filename == self.filename
+
+    def visible_globals(self, frame):
+        names = []
+        for name, value in frame.f_globals.items():
+            if name.startswith('__') or type(value).__name__ == 'module':
+                continue
+            names.append(name)
+            if name not in self.ordered_globals:
+                self.ordered_globals.append(name)
+        return names
+
+    def record(self, frame, event, return_value=None, exception_msg=None):
+        if len(self.trace) >= MAX_STEPS:
+            self.trace[-1]['event'] = 'instruction_limit_reached'
+            self.trace[-1]['exception_msg'] = 'Stopped after running ' + str(MAX_STEPS) + \
+                ' steps. Please shorten your code,\nsince Python Tutor is not designed to handle long-running code.'
+            raise StepLimitReached()
+
+        heap = {}
+        names = self.visible_globals(frame)
+        globals_ = {}
+        for name in names:
+            globals_[name] = self.encode(frame.f_globals[name], heap)
+
+        # the module frame holds the globals, every other frame is rendered
+        frames = []
+        f = frame
+        while f is not None and self.is_user_frame(f):
+            if f.f_code.co_name != '<module>':
+                frames.append(f)
+            f = f.f_back
+        frames.reverse()
+
+        stack = []
+        for f in frames:
+            encoded_locals = {}
+            for name, value in f.f_locals.items():
+                encoded_locals[name] = self.encode(value, heap)
+            ordered = [n for n in f.f_code.co_varnames if n in f.f_locals]
+            ordered += sorted(n for n in f.f_locals if n not in ordered)
+            if f is frame and event == 'return':
+                encoded_locals['__return__'] = self.encode(return_value, heap)
+                ordered.append('__return__')
+            frame_id = self.frame_id(f)
+            stack.append({
+                'func_name': f.f_code.co_name,
+                'frame_id': frame_id,
+                'unique_hash': f.f_code.co_name + '_' + str(frame_id),
+                'is_highlighted': f is frame,
+                'encoded_locals': encoded_locals,
+                'ordered_varnames': ordered,
+                'line': f.f_lineno,
+                'is_parent': False,
+                'is_zombie': False,
+                'parent_frame_id_list': [],
+            })
+
+        step = {
+            'event': event,
+            'line': frame.f_lineno,
+            'func_name': frame.f_code.co_name,
+            'globals': globals_,
+            'ordered_globals': [n for n in self.ordered_globals if n in globals_],
+            'stack_to_render': stack,
+            'heap': heap,
+            'stdout': self.stdout.getvalue(),
+        }
+        if exception_msg:
+            step['exception_msg'] = exception_msg
+        self.trace.append(step)
+
+    def dispatch(self, frame, event, arg):
+        # code of other modules (e.g. the standard library) is not traced
+        if not self.is_user_frame(frame):
+            return None
+        if event == 'line':
+            self.record(frame, 'step_line')
+        elif event == 'call':
+            self.record(frame, 'call')
+        elif event == 'return':
+            self.record(frame, 'return', return_value=arg)
+        elif event == 'exception':
+            self.record(frame, 'exception', exception_msg=exception_message(arg[1]))
+        return self.dispatch
+
+    # the last step is repeated where the exception left the program
+    def uncaught(self, exc):
+        msg = exception_message(exc)
+        line = None
+        for entry in traceback.extract_tb(exc.__traceback__):
+            if entry[0] == self.filename:
+                line = entry[1]
+        if self.trace:
+            step = dict(self.trace[-1])
+        else:
+            step = {'func_name': '<module>', 'globals': {}, 'ordered_globals': [], 'stack_to_render': [],
+                    'heap': {}}
+        step['event'] = 'uncaught_exception'
+        step['exception_msg'] = msg
+        step['stdout'] = self.stdout.getvalue()
+        if line is not None:
+            step['line'] = line
+        self.trace.append(step)
+
+
+def exception_message(exc):
+    msg = str(exc)
+    return type(exc).__name__ + (': ' + msg if msg else '')
+
+
+def run(filename, args, copy=None):
+    with open(filename, encoding='utf8') as f:
+        code = f.read()
+    tracer = Tracer(filename, copy)
+
+    try:
+        compiled = compile(code, filename, 'exec')
+    except SyntaxError as e:
+        tracer.trace.append({
+            'event': 'uncaught_exception',
+            'exception_msg': 'SyntaxError: ' + str(e.msg),
+            'line': e.lineno or 0,
+            'offset': e.offset or 0,
+        })
+        return code, tracer.trace, 1
+
+    exit_code = 0
+    user_globals = {'__name__': '__main__', '__file__': filename, '__builtins__': __builtins__}
+    real_stdout = sys.stdout
+    real_stdin = sys.stdin
+    # the locale of the image is ASCII, but the input of the program is UTF-8
+    sys.stdin = io.TextIOWrapper(sys.stdin.buffer, encoding='utf8', errors='replace')
+    # the program sees its own arguments, not the tracer's
+    sys.argv = [filename] + [os.fsencode(a).decode('utf8', 'replace') for a in args]
+    sys.stdout = tracer.stdout
+    sys.settrace(tracer.dispatch)
+    try:
+        exec(compiled, user_globals)
+    except StepLimitReached:
+        pass
+    except SystemExit as e:
+        # like the interpreter: sys.exit() is a success, and any other value than a number is printed as the error
+        if e.code is None:
+            exit_code = 0
+        elif isinstance(e.code, int):
+            exit_code = e.code
+        else:
+            print(e.code, file=sys.stderr)
+            exit_code = 1
+    except BaseException as e:
+        tracer.uncaught(e)
+        exit_code = 1
+    finally:
+        sys.settrace(None)
+        sys.stdout = real_stdout
+        sys.stdin = real_stdin
+
+    return code, tracer.trace, exit_code
+
+
+if __name__ == '__main__':
+    argv = sys.argv[1:]
+    copy = None
+    if argv and argv[0].startswith('--stdout='):
+        copy = open(argv[0][len('--stdout='):], 'w', encoding='utf8')
+        argv = argv[1:]
+    (code, trace, exit_code) = run(argv[0], argv[1:], copy)
+    print(json.dumps({'code': code, 'trace': trace}, sort_keys=True))
+    # the exit code of the user program becomes ours, like with valgrind
+    sys.exit(exit_code)
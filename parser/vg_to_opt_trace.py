@@ -235,7 +235,8 @@ if __name__ == '__main__':
 
     success = True
 
-    for line in open(basename + '.vgtrace'):
+    # the output of the program is written as it is, so it's UTF-8 whatever the locale of the image is
+    for line in open(basename + '.vgtrace', encoding='utf8', errors='replace'):
         line = line.strip()
         if line == RECORD_SEP:
             success = process_record(cur_record_lines)
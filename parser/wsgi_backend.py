@@ -34,10 +34,12 @@ def get_request_param(key, request_info):
 def setup_options():
     opts = {
         'VALGRIND_MSG_RE': re.compile('==\d+== (.*)$'),
-        'PROGRAM_DIR': '/tmp/user_code',
+        # the directory of the job, created by the server for each execution
+        'PROGRAM_DIR': sys.argv[2] if len(sys.argv) > 2 else '/tmp/user_code',
         'LIB_DIR': '/tmp/parser',  # /var/spp/lib
         'USER_PROGRAM': 'usercode.c',
         'USER_PROGRAM_INPUT' : 'programInput.txt',
+        'USER_PROGRAM_ARGS': 'programArgs.txt',
         'LANG': sys.argv[1],
         'INCLUDE': '-I/var/spp/include',  # TODO: update this
         'PRETTY_DUMP': False
@@ -50,11 +52,25 @@ def setup_options():
         opts['CC'] = 'g++'
         opts['DIALECT'] = '-std=c++11'
         opts['FN'] = 'usercode.cpp'
+    elif opts['LANG'] == 'rust':
+        opts['CC'] = 'rustc'
+        opts['DIALECT'] = '--edition=2021'
+        opts['FN'] = 'usercode.rs'
+    elif opts['LANG'] == 'python':
+        # interpreted, so there's nothing to compile
+        opts['FN'] = 'usercode.py'
     opts.update({
         'F_PATH': os.path.join(opts['PROGRAM_DIR'], opts['FN']),
         'I_PATH': os.path.join(opts['PROGRAM_DIR'], opts['USER_PROGRAM_INPUT']),
+        'ARGS_PATH': os.path.join(opts['PROGRAM_DIR'], opts['USER_PROGRAM_ARGS']),
         'VGTRACE_PATH': os.path.join(opts['PROGRAM_DIR'], 'usercode.vgtrace'),
         'EXE_PATH': os.path.join(opts['PROGRAM_DIR'], 'usercode'),
+        # what the program prints, written as it runs, so it's kept if the program is killed
+        'STDOUT_PATH': os.path.join(opts['PROGRAM_DIR'], 'stdout.txt'),
+        'STDERR_PATH': os.path.join(opts['PROGRAM_DIR'], 'stderr.txt'),
+        'VALGRIND_LOG_PATH': os.path.join(opts['PROGRAM_DIR'], 'valgrind.log'),
+        # only written once the program ended, so the server tells a timeout apart from a program exiting with 124
+        'EXIT_PATH': os.path.join(opts['PROGRAM_DIR'], 'exit_code.txt'),
     })
     return opts
 
@@ -80,6 +96,14 @@ def compile_c(opts):
     return gcc_retcode, gcc_stdout, gcc_stderr
 
 
+# Arguments of the user program, one per line. Older servers don't send the file
+def program_args(opts):
+    if not os.path.exists(opts['ARGS_PATH']):
+        return []
+    with open(opts['ARGS_PATH'], 'r', encoding='utf8') as f:
+        return f.read().split('\n')[:-1]
+
+
 def check_for_valgrind_errors(opts, valgrind_stderr):
     error_lines = []
     in_error_msg = False
@@ -98,26 +122,35 @@ def check_for_valgrind_errors(opts, valgrind_stderr):
 
 def run_valgrind(opts):
     VALGRIND_EXE = os.path.join(opts['LIB_DIR'], 'valgrind-3.11.0/inst/bin/valgrind') # version 3.11.0
-    with open(opts['I_PATH'], 'r') as infile:
+    # the program's output goes straight to its files, and valgrind's messages to their own log
+    with open(opts['I_PATH'], 'r') as infile, open(opts['STDOUT_PATH'], 'wb') as outfile, \
+            open(opts['STDERR_PATH'], 'wb') as errfile:
         valgrind_p = Popen(
             ['stdbuf', '-o0',  # VERY IMPORTANT to disable stdout buffering so that stdout is traced properly
              VALGRIND_EXE,
              '--tool=memcheck',
+             '--log-file=' + opts['VALGRIND_LOG_PATH'],
              '--source-filename=' + opts['FN'],
              '--trace-filename=' + opts['VGTRACE_PATH'],
              opts['EXE_PATH'],
-             ],
+             ] + program_args(opts),
             stdin=infile,
-            stdout=PIPE,
-            stderr=PIPE
+            stdout=outfile,
+            stderr=errfile
         )
-        (valgrind_stdout, valgrind_stderr) = valgrind_p.communicate()
-        valgrind_retcode = valgrind_p.returncode
-        valgrind_out = '\n'.join(
-            ['=== Valgrind stdout ===', valgrind_stdout.decode(), '=== Valgrind stderr ===', valgrind_stderr.decode()])
-        # print(valgrind_out)
-        end_of_trace_error_msg = check_for_valgrind_errors(opts, str(valgrind_stderr)) if valgrind_retcode != 0 else None
-        return valgrind_out, end_of_trace_error_msg
+        valgrind_retcode = valgrind_p.wait()
+    with open(opts['STDOUT_PATH'], 'r', encoding='utf8', errors='replace') as f:
+        valgrind_stdout = f.read()
+    with open(opts['VALGRIND_LOG_PATH'], 'r', encoding='utf8', errors='replace') as f:
+        valgrind_stderr = f.read()
+    valgrind_out = '\n'.join(['=== Valgrind stdout ===', valgrind_stdout, '=== Valgrind stderr ===', valgrind_stderr])
+    end_of_trace_error_msg = check_for_valgrind_errors(opts, valgrind_stderr) if valgrind_retcode != 0 else None
+    return valgrind_out, end_of_trace_error_msg, exit_status(valgrind_retcode)
+
+
+# Shell convention: a process killed by signal n exits with 128+n
+def exit_status(returncode):
+    return 128 - returncode if returncode < 0 else returncode
 
 
 def get_opt_trace_from_vg_trace(opts, end_of_trace_error_msg):
@@ -128,16 +161,27 @@ def get_opt_trace_from_vg_trace(opts, end_of_trace_error_msg):
     args.append(opts['F_PATH'])
     postprocess_p = Popen(args, stdout=PIPE, stderr=PIPE)
     (postprocess_stdout, postprocess_stderr) = postprocess_p.communicate()
-    postprocess_stderr = '\n'.join(['=== postprocess stderr ===', postprocess_stderr.decode(), '==='])
+    postprocess_stderr = '\n'.join(['=== postprocess stderr ===', postprocess_stderr.decode(errors='replace'), '==='])
     return postprocess_stdout, postprocess_stderr
 
 
+# Python is traced by py_trace.py instead of valgrind, in the same trace format
+def generate_python_trace(opts):
+    TRACER_EXE = os.path.join(opts['LIB_DIR'], 'py_trace.py')
+    # the tracer writes the program's output to its file as it runs, its own stdout is the trace
+    with open(opts['I_PATH'], 'r') as infile, open(opts['STDERR_PATH'], 'wb') as errfile:
+        tracer_p = Popen(['python3', TRACER_EXE, '--stdout=' + opts['STDOUT_PATH'], opts['F_PATH']] + program_args(opts),
+                         stdin=infile, stdout=PIPE, stderr=errfile)
+        (tracer_stdout, _) = tracer_p.communicate()
+    return '', tracer_stdout, exit_status(tracer_p.returncode)
+
+
 def generate_trace(opts, gcc_stderr):
     gcc_stderr = '\n'.join(['=== gcc stderr ===', gcc_stderr, '==='])
-    (valgrind_out, end_of_trace_error_msg) = run_valgrind(opts)
+    (valgrind_out, end_of_trace_error_msg, exit_code) = run_valgrind(opts)
     (postprocess_stdout, postprocess_stderr) = get_opt_trace_from_vg_trace(opts, valgrind_out)
     std_err = '\n'.join([gcc_stderr, valgrind_out, postprocess_stderr])
-    return std_err, postprocess_stdout
+    return std_err, postprocess_stdout, exit_code
 
 
 def handle_gcc_error(opts, gcc_stderr):
@@ -198,14 +242,24 @@ def handle_gcc_error(opts, gcc_stderr):
 def application():
     opts = setup_options()
     # (gcc_retcode, gcc_stdout, gcc_stderr) = compile_c(opts)
-    (stderr, stdout) = generate_trace(opts, "")
+    if opts['LANG'] == 'python':
+        (stderr, stdout, exit_code) = generate_python_trace(opts)
+    else:
+        (stderr, stdout, exit_code) = generate_trace(opts, "")
     # if gcc_retcode == 0 else handle_gcc_error(opts, gcc_stderr)
     # cleanup(opts)
     # TODO: Figure out how to handle stderr
     # print('-------------')
     # print(stderr)
-    return stdout.decode()
+    return stdout.decode(), exit_code
 
 
 if __name__ == "__main__":
-    print(application())
+    (output, exit_code) = application()
+    print(output)
+    sys.stdout.flush()
+    opts = setup_options()
+    with open(opts['EXIT_PATH'], 'w') as f:
+        f.write(str(exit_code))
+    # the exit code of the user program becomes ours, so the caller can read it from $?
+    sys.exit(exit_code)